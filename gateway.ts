@@ -42,6 +42,11 @@ app.use(async ctx => {
     result = await new Promise((res, rej) => {
       client[functionName]({ ...query, ...body }, (err: any, response: any) => {
         if (err) {
+          // Go services put the error code in the err-code trailer
+          const errCode = err.metadata && err.metadata.get('err-code')[0];
+          if (errCode) {
+            return res({ code: Number(errCode), message: err.details });
+          }
           return rej({ code: 2, message: JSON.stringify(err) });
         }
         res(response || { code: 0, message: 'empty' });
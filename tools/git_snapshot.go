@@ -0,0 +1,208 @@
+package main
+
+import (
+	"brick/log"
+	"brick/tools/rpc_gen/logic"
+	"bytes"
+	"fmt"
+	"github.com/emicklei/proto"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitTree 把某个 git ref 下的 proto 文件还原到临时目录, 目录结构与仓库一致,
+// 这样 include path 只需要映射一下就能复用 getIncludePathList 的逻辑
+type gitTree struct {
+	ref      string
+	repoRoot string
+	tmpDir   string
+	done     map[string]bool
+}
+
+func runGit(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v %s", strings.Join(args, " "), err, errBuf.String())
+	}
+	return outBuf.Bytes(), nil
+}
+
+func newGitTree(ref string) (*gitTree, error) {
+	out, err := runGit(".", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	_, err = runGit(".", "rev-parse", "--verify", ref+"^{commit}")
+	if err != nil {
+		return nil, fmt.Errorf("invalid git ref %s", ref)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "rpc_gen_diff")
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := filepath.EvalSymlinks(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &gitTree{
+		ref:      ref,
+		repoRoot: root,
+		tmpDir:   tmpDir,
+		done:     make(map[string]bool),
+	}, nil
+}
+
+func (p *gitTree) close() {
+	os.RemoveAll(p.tmpDir)
+}
+
+// relPath 返回 path 相对于仓库根目录的路径, 不在仓库中时返回 false
+func (p *gitTree) relPath(path string) (string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	if x, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = x
+	}
+	rel, err := filepath.Rel(p.repoRoot, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// mapPath 把当前工作区的路径映射到临时目录中, 仓库外的路径保持不变
+func (p *gitTree) mapPath(path string) string {
+	rel, ok := p.relPath(path)
+	if !ok {
+		return path
+	}
+	return filepath.Join(p.tmpDir, rel)
+}
+
+func (p *gitTree) exists(rel string) bool {
+	_, err := runGit(p.repoRoot, "cat-file", "-e", fmt.Sprintf("%s:%s", p.ref, filepath.ToSlash(rel)))
+	return err == nil
+}
+
+// checkout 取出 path 在 ref 中的版本, 并按 incPaths 递归取出它 import 的文件
+func (p *gitTree) checkout(path string, incPaths []string) error {
+	rel, ok := p.relPath(path)
+	if !ok {
+		return fmt.Errorf("%s is not in git repository %s", path, p.repoRoot)
+	}
+	if p.done[rel] {
+		return nil
+	}
+	p.done[rel] = true
+
+	content, err := runGit(p.repoRoot, "show", fmt.Sprintf("%s:%s", p.ref, filepath.ToSlash(rel)))
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(p.tmpDir, rel)
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(target, content, 0644)
+	if err != nil {
+		return err
+	}
+
+	definition, err := proto.NewParser(bytes.NewReader(content)).Parse()
+	if err != nil {
+		return fmt.Errorf("parse %s at %s: %v", rel, p.ref, err)
+	}
+
+	var imports []string
+	proto.Walk(definition, proto.WithImport(func(i *proto.Import) {
+		if !strings.HasPrefix(i.Filename, "google/") {
+			imports = append(imports, i.Filename)
+		}
+	}))
+
+	// 与 logic.SearchImportPb 相同的查找顺序: 先当前目录, 再 include path
+	for _, imp := range imports {
+		candidates := append([]string{imp}, incPaths...)
+		for i, inc := range candidates {
+			c := imp
+			if i > 0 {
+				c = filepath.Join(inc, imp)
+			}
+			r, inRepo := p.relPath(c)
+			if !inRepo || !p.exists(r) {
+				continue
+			}
+			err = p.checkout(c, incPaths)
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// loadGitSnapshot 解析 protoFile 在 ref 中的版本, ref 中不存在该文件时返回 nil
+func loadGitSnapshot(ref string, protoFile string) (*logic.ProtoSnapshot, error) {
+	tree, err := newGitTree(ref)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.close()
+
+	incPaths := getIncludePathList(protoFile)
+
+	rel, ok := tree.relPath(protoFile)
+	if !ok {
+		return nil, fmt.Errorf("%s is not in git repository", protoFile)
+	}
+	if !tree.exists(rel) {
+		log.Infof("%s not exists at %s, nothing to compare", rel, ref)
+		return nil, nil
+	}
+
+	err = tree.checkout(protoFile, incPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	var oldIncPaths []string
+	for _, inc := range incPaths {
+		oldIncPaths = append(oldIncPaths, tree.mapPath(inc))
+	}
+
+	// logic.SearchImportPb 会先按当前目录查找, 切换到临时目录中对应的位置
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	oldCwd := tree.mapPath(cwd)
+	err = os.MkdirAll(oldCwd, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chdir(oldCwd)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Chdir(cwd)
+
+	return loadSnapshotWithInc(filepath.Join(tree.tmpDir, rel), oldIncPaths), nil
+}
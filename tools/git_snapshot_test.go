@@ -0,0 +1,124 @@
+package main
+
+import (
+	"brick/tools/rpc_gen/logic"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, fn string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func gitCommit(t *testing.T, repo string, msg string) {
+	t.Helper()
+	for _, args := range [][]string{
+		{"add", "-A"},
+		{"-c", "user.name=test", "-c", "user.email=test@test", "commit", "-q", "-m", msg},
+	} {
+		if _, err := runGit(repo, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+const testTypesProto = `syntax = "proto3";
+package common;
+option go_package = "shop/common/%s";
+
+message Money {
+  int64 cents = 1;
+}
+`
+
+const testShopProto = `syntax = "proto3";
+package shop;
+option go_package = "shop";
+
+import "common/types.proto";
+
+message Order {
+  common.Money price = 1;
+%s}
+`
+
+// 旧版本的 proto 和它通过 include path 引用的文件都从 HEAD~1 中取出
+func TestLoadGitSnapshot(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	repo, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runGit(repo, "init", "-q"); err != nil {
+		t.Fatal(err)
+	}
+
+	// $GOPATH/proto 在仓库中, 比较时要映射到取出的旧版本
+	types := filepath.Join(repo, "proto", "common", "types.proto")
+	shop := filepath.Join(repo, "svc", "shop.proto")
+	writeTestFile(t, types, strings.Replace(testTypesProto, "%s", "v1", 1))
+	writeTestFile(t, shop, strings.Replace(testShopProto, "%s", "  string name = 2;\n", 1))
+	gitCommit(t, repo, "v1")
+
+	writeTestFile(t, types, strings.Replace(testTypesProto, "%s", "v2", 1))
+	writeTestFile(t, shop, strings.Replace(testShopProto, "%s", "", 1))
+	gitCommit(t, repo, "v2")
+
+	t.Setenv("GOPATH", repo)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(repo); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	newFile := "svc/shop.proto"
+	oldSnap, err := loadGitSnapshot("HEAD~1", newFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldSnap == nil {
+		t.Fatal("shop.proto not found at HEAD~1")
+	}
+	if wd, _ := os.Getwd(); wd != repo {
+		t.Errorf("cwd not restored: %s", wd)
+	}
+
+	var imports []string
+	for _, v := range oldSnap.PD.ImportList {
+		imports = append(imports, v.ImportPath+" "+v.GoPackage)
+	}
+	if strings.Join(imports, ",") != "common/types.proto shop/common/v1" {
+		t.Errorf("import not read from HEAD~1: %v", imports)
+	}
+
+	issues := logic.DiffProto(oldSnap, loadSnapshot(newFile))
+	if len(issues) != 1 || issues[0].Severity != logic.DiffError ||
+		!strings.Contains(issues[0].Msg, "field `name` (2) removed without reserved") {
+		for _, x := range issues {
+			t.Log(x.String())
+		}
+		t.Fatalf("unexpected issues")
+	}
+
+	// 比较的 ref 中没有这个文件时不报错
+	writeTestFile(t, filepath.Join(repo, "svc", "order.proto"), "syntax = \"proto3\";\npackage order;\n")
+	if snap, err := loadGitSnapshot("HEAD", "svc/order.proto"); err != nil || snap != nil {
+		t.Errorf("want nil snapshot for a new file, got %v %v", snap, err)
+	}
+}
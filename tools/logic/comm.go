@@ -18,6 +18,9 @@ import (
 type ErrCodeDef struct {
 	ErrCodeSetName string
 	ErrCodeEnums   []*proto.EnumField
+
+	// 枚举值 -> locale -> 提示信息, 来自 @msg.zh: 注释或 (ext.msg).zh 选项
+	Msgs map[string]map[string]string
 }
 
 type ImportNode struct {
@@ -33,6 +36,14 @@ type RpcNode struct {
 	Url        string
 	Flags      string
 
+	// 调用策略, 由 option(ext.Timeout/Idempotent/Retry) 指定
+	TimeoutMs  int
+	Idempotent bool
+	Retry      int
+
+	// option(ext.Interceptors) 指定的拦截器调整, 如 "-auth,trace"
+	Interceptors []string
+
 	CommentLines []string
 	commentMap   map[string]*linesCommentNode
 }
@@ -43,6 +54,8 @@ type ProtoDetect struct {
 	GoPackageName string
 	RpcList       []*RpcNode
 	ErrCodes      []ErrCodeDef
+	ErrCodeRange  *ErrCodeRange
+	EnumList      []*proto.Enum
 
 	SvrDef map[string]string
 
@@ -59,6 +72,8 @@ type PbField struct {
 	NormalField *proto.NormalField
 	MapField    *proto.MapField
 	Msg         *PbMsg
+	Rules       *FieldRules // (ext.rules) 校验规则
+	Db          *FieldDb    // (ext.db) 列属性
 
 	comment map[string]*linesCommentNode
 }
@@ -95,13 +110,31 @@ func (p *PbField) GetPbComment() *proto.Comment {
 }
 
 type PbMsg struct {
-	Name    string
-	Fields  []*PbField
-	ModName string
+	Name     string
+	FullName string         // 嵌套 message 为 Outer.Inner
+	Table    string         // gorm 模型的表名, 见 GormTables
+	Caches   []*CacheSchema // 注释中 @cache 声明的 redis 缓存
+	Fields   []*PbField
+	ModName  string
+	Reserved []*proto.Reserved
+	Oneofs   []*proto.Oneof // oneof 中的字段不在 Fields 里
 
 	NameDupCnt int
 }
 
+func PbMsgFullName(m *proto.Message) string {
+	name := m.Name
+	for p := m.Parent; p != nil; {
+		x, ok := p.(*proto.Message)
+		if !ok {
+			break
+		}
+		name = x.Name + "." + name
+		p = x.Parent
+	}
+	return name
+}
+
 var PbMap = make(map[string]*PbMsg)
 
 type ErrCodes struct {
@@ -177,6 +210,9 @@ var CurrentPb string
 var CurrentMod string
 var PbIncPaths []string
 
+// PruneRemovedRpc 为 true 时, 重新生成时删除 proto 中已不存在的 rpc 对应的客户端函数
+var PruneRemovedRpc bool
+
 func SetCurrentPb(pb string) {
 	CurrentPb = pb
 	p := strings.LastIndex(pb, "/")
@@ -207,6 +243,12 @@ func GetTargetFileName(PD ProtoDetect, objType string, rootDir string) string {
 		fallthrough
 	case "client":
 		fallthrough
+	case "client_policy":
+		fallthrough
+	case "errors":
+		fallthrough
+	case "model":
+		fallthrough
 	case "errcode":
 		fallthrough
 	case "console":
@@ -216,15 +258,49 @@ func GetTargetFileName(PD ProtoDetect, objType string, rootDir string) string {
 		fallthrough
 	case "supervisor_conf":
 		fallthrough
+	case "systemd":
+		fallthrough
+	case "dockerfile":
+		fallthrough
+	case "k8s":
+		fallthrough
 	case "server":
+		fallthrough
+	case "server_bootstrap":
+		fallthrough
+	case "server_hooks":
+		fallthrough
+	case "server_grpc":
+		fallthrough
+	case "server_grpc_ctx":
+		fallthrough
+	case "server_interceptor":
+		fallthrough
+	case "server_interceptor_test":
+		fallthrough
+	case "server_auth":
+		fallthrough
+	case "server_config":
 		dirName = fmt.Sprintf("%s/server/", rootDir)
 
 	case "logic_state_obj_cache":
 		fallthrough
+	case "logic_state_obj_cache_repo":
+		fallthrough
+	case "logic_state_obj_cache_test":
+		fallthrough
 	case "logic_state_redis":
 		fallthrough
+	case "logic_state_redis_cache":
+		fallthrough
 	case "logic_state_db":
 		fallthrough
+	case "logic_state_db_repo":
+		fallthrough
+	case "logic_state_db_test":
+		fallthrough
+	case "logic_state_db_driver":
+		fallthrough
 	case "logic_cfg":
 		fallthrough
 	case "logic":
@@ -246,22 +322,62 @@ func GetTargetFileName(PD ProtoDetect, objType string, rootDir string) string {
 		fn = fmt.Sprintf("%s%sdef.go", dirName, PD.SvrName)
 	case "client":
 		fn = fmt.Sprintf("%s%sclient.go", dirName, PD.SvrName)
+	case "client_policy":
+		fn = fmt.Sprintf("%s%sclient_policy_autogen.go", dirName, PD.SvrName)
 	case "errcode":
 		fn = fmt.Sprintf("%s%serrcode.go", dirName, PD.SvrName)
+	case "errors":
+		fn = fmt.Sprintf("%s%serrors_autogen.go", dirName, PD.SvrName)
+	case "model":
+		fn = fmt.Sprintf("%s%smodel_autogen.go", dirName, PD.SvrName)
 	case "server":
 		fn = fmt.Sprintf("%s%s.go", dirName, PD.SvrName)
+	case "server_bootstrap":
+		fn = fmt.Sprintf("%s%sbootstrap_autogen.go", dirName, PD.SvrName)
+	case "server_hooks":
+		fn = fmt.Sprintf("%s%shooks.go", dirName, PD.SvrName)
+	case "server_grpc":
+		fn = fmt.Sprintf("%s%sgrpc_autogen.go", dirName, PD.SvrName)
+	case "server_grpc_ctx":
+		fn = fmt.Sprintf("%s%sgrpc.go", dirName, PD.SvrName)
+	case "server_interceptor":
+		fn = fmt.Sprintf("%s%sinterceptor_autogen.go", dirName, PD.SvrName)
+	case "server_interceptor_test":
+		fn = fmt.Sprintf("%s%sinterceptor_autogen_test.go", dirName, PD.SvrName)
+	case "server_auth":
+		fn = fmt.Sprintf("%s%sauth.go", dirName, PD.SvrName)
+	case "server_config":
+		fn = fmt.Sprintf("%s%sconfig_autogen.go", dirName, PD.SvrName)
 	case "logic":
 		fn = fmt.Sprintf("%s%simpl.go", dirName, PD.SvrName)
 	case "logic_cfg":
 		fn = fmt.Sprintf("%s%scfg.go", dirName, PD.SvrName)
 	case "logic_state_db":
 		fn = fmt.Sprintf("%s%sstatedb_autogen.go", dirName, PD.SvrName)
+	case "logic_state_db_repo":
+		fn = fmt.Sprintf("%s%sstatedb_repo_autogen.go", dirName, PD.SvrName)
+	case "logic_state_db_test":
+		fn = fmt.Sprintf("%s%sstatedb_autogen_test.go", dirName, PD.SvrName)
+	case "logic_state_db_driver":
+		fn = fmt.Sprintf("%s%sstatedb_driver_autogen.go", dirName, PD.SvrName)
 	case "logic_state_redis":
 		fn = fmt.Sprintf("%s%sstateredis_autogen.go", dirName, PD.SvrName)
+	case "logic_state_redis_cache":
+		fn = fmt.Sprintf("%s%sstateredis_cache_autogen.go", dirName, PD.SvrName)
 	case "logic_state_obj_cache":
 		fn = fmt.Sprintf("%s%sstateobjcache_autogen.go", dirName, PD.SvrName)
+	case "logic_state_obj_cache_repo":
+		fn = fmt.Sprintf("%s%sstateobjcache_repo_autogen.go", dirName, PD.SvrName)
+	case "logic_state_obj_cache_test":
+		fn = fmt.Sprintf("%s%sstateobjcache_autogen_test.go", dirName, PD.SvrName)
 	case "supervisor_conf":
 		fn = fmt.Sprintf("%ssupervisor.%s.conf", dirName, PD.SvrName)
+	case "systemd":
+		fn = fmt.Sprintf("%s%s.service", dirName, PD.SvrName)
+	case "dockerfile":
+		fn = fmt.Sprintf("%sDockerfile", dirName)
+	case "k8s":
+		fn = fmt.Sprintf("%s%s.k8s.yaml", dirName, PD.SvrName)
 	case "tool":
 		fn = fmt.Sprintf("%s%s_tool.go", dirName, PD.SvrName)
 	}
@@ -288,23 +404,12 @@ func ParseGoCode(PD *ProtoDetect, fn string, objType string) {
 			} else if objType == "tool" {
 				PD.FuncTool[t.Name.Name] = 1
 			}
-		case *ast.GenDecl:
-			if objType == "def" {
-				for _, spec := range t.Specs {
-					switch spec := spec.(type) {
-					case *ast.ImportSpec:
-						fmt.Println("Import", spec.Path.Value)
-					case *ast.TypeSpec:
-						fmt.Println("Type", spec.Name.String())
-					case *ast.ValueSpec:
-						for _, id := range spec.Names {
-							PD.SvrDef[id.Name] = id.Obj.Decl.(*ast.ValueSpec).Values[0].(*ast.BasicLit).Value
-						}
-					}
-				}
-			}
 		}
 	}
+
+	if objType == "def" {
+		parseDefFile(PD, fSet, f)
+	}
 }
 
 func ParseGoServer(s *ServerComposement, fn string) {
@@ -476,6 +581,9 @@ func ParseErrCode(protoFile string) error {
 			for _, ei := range e.Elements {
 				ei.Accept(&pv)
 			}
+			for _, f := range pv.EnumFields {
+				AllErrCodes.Set(CurrentMod, f.Name, uint32(f.Integer))
+			}
 		}
 	}
 
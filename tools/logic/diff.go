@@ -0,0 +1,354 @@
+package logic
+
+import (
+	"fmt"
+	"github.com/emicklei/proto"
+	"sort"
+)
+
+const (
+	DiffError = "ERROR" // 线上协议不兼容
+	DiffWarn  = "WARN"  // JSON 不兼容或需要关注
+	DiffInfo  = "INFO"
+)
+
+type DiffIssue struct {
+	Severity string
+	Where    string
+	Msg      string
+}
+
+func (p *DiffIssue) String() string {
+	return fmt.Sprintf("%-5s %s: %s", p.Severity, p.Where, p.Msg)
+}
+
+// ProtoSnapshot 一个版本的 proto 解析结果, 只包含该文件自身定义的 message
+type ProtoSnapshot struct {
+	PD   *ProtoDetect
+	Msgs []*PbMsg
+}
+
+func pbEnumFullName(e *proto.Enum) string {
+	if m, ok := e.Parent.(*proto.Message); ok {
+		return PbMsgFullName(m) + "." + e.Name
+	}
+	return e.Name
+}
+
+type diffCtx struct {
+	issues []*DiffIssue
+}
+
+func (p *diffCtx) add(severity, where, format string, args ...interface{}) {
+	p.issues = append(p.issues, &DiffIssue{
+		Severity: severity, Where: where, Msg: fmt.Sprintf(format, args...)})
+}
+
+func isReserved(list []*proto.Reserved, num int, name string) bool {
+	for _, r := range list {
+		for _, rg := range r.Ranges {
+			if num >= rg.From && (rg.Max || num <= rg.To) {
+				return true
+			}
+		}
+	}
+	return isReservedName(list, name)
+}
+
+func isReservedName(list []*proto.Reserved, name string) bool {
+	for _, r := range list {
+		for _, n := range r.FieldNames {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 线上编码兼容的类型组, 组内互改只给警告
+var wireCompatGroup = map[string]int{
+	"int32": 1, "uint32": 1, "int64": 1, "uint64": 1, "bool": 1,
+	"sint32": 2, "sint64": 2,
+	"fixed32": 3, "sfixed32": 3,
+	"fixed64": 4, "sfixed64": 4,
+	"string": 5, "bytes": 5,
+}
+
+type diffField struct {
+	num      int
+	name     string
+	typ      string
+	repeated bool
+	isMap    bool
+	oneof    string // 所在的 oneof, 不在 oneof 中时为空
+}
+
+func collectDiffFields(m *PbMsg) (map[int]*diffField, map[string]*diffField) {
+	byNum := make(map[int]*diffField)
+	byName := make(map[string]*diffField)
+	add := func(x *diffField) {
+		byNum[x.num] = x
+		byName[x.name] = x
+	}
+
+	for _, f := range m.Fields {
+		x := &diffField{name: f.GetName(), typ: f.GetType()}
+		if f.NormalField != nil {
+			x.num = f.NormalField.Sequence
+			x.repeated = f.NormalField.Repeated
+		} else if f.MapField != nil {
+			x.num = f.MapField.Sequence
+			x.isMap = true
+			x.typ = fmt.Sprintf("map<%s,%s>", f.MapField.KeyType, f.MapField.Type)
+		}
+		add(x)
+	}
+
+	for _, o := range m.Oneofs {
+		for _, el := range o.Elements {
+			if f, ok := el.(*proto.OneOfField); ok {
+				add(&diffField{num: f.Sequence, name: f.Name, typ: f.Type, oneof: o.Name})
+			}
+		}
+	}
+	return byNum, byName
+}
+
+func (p *diffCtx) diffMsg(oldMsg, newMsg *PbMsg) {
+	where := "message " + newMsg.FullName
+	oldByNum, _ := collectDiffFields(oldMsg)
+	newByNum, newByName := collectDiffFields(newMsg)
+
+	var nums []int
+	for n := range oldByNum {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+
+	for _, n := range nums {
+		o := oldByNum[n]
+		x := newByNum[n]
+
+		if x == nil {
+			if nf := newByName[o.name]; nf != nil {
+				p.add(DiffError, where, "field `%s` number changed %d -> %d", o.name, o.num, nf.num)
+			} else if isReserved(newMsg.Reserved, o.num, o.name) {
+				p.add(DiffInfo, where, "field `%s` (%d) removed and reserved", o.name, o.num)
+			} else {
+				p.add(DiffError, where, "field `%s` (%d) removed without reserved", o.name, o.num)
+			}
+			continue
+		}
+
+		// 编号被另一个字段占用: 旧字段换了编号, 名字被 reserved, 或者类型也变了,
+		// 说明不是改名而是删除后复用了编号, 老数据会被当成新字段解析
+		if x.name != o.name {
+			nf, moved := newByName[o.name]
+			if moved || x.typ != o.typ || isReservedName(newMsg.Reserved, o.name) {
+				p.add(DiffError, where, "field number %d reused by `%s` %s, was `%s` %s",
+					n, x.name, x.typ, o.name, o.typ)
+				if moved {
+					p.add(DiffError, where, "field `%s` number changed %d -> %d", o.name, o.num, nf.num)
+				}
+				continue
+			}
+			p.add(DiffWarn, where, "field %d renamed `%s` -> `%s`, breaks JSON clients", n, o.name, x.name)
+		}
+
+		if x.typ != o.typ {
+			ga, gb := wireCompatGroup[o.typ], wireCompatGroup[x.typ]
+			if ga != 0 && ga == gb {
+				p.add(DiffWarn, where, "field %d type changed %s -> %s, wire compatible but may truncate",
+					n, o.typ, x.typ)
+			} else {
+				p.add(DiffError, where, "field %d type changed %s -> %s", n, o.typ, x.typ)
+			}
+		}
+
+		if x.repeated != o.repeated || x.isMap != o.isMap {
+			p.add(DiffError, where, "field %d label changed (repeated/map)", n)
+		}
+
+		if x.oneof != o.oneof {
+			p.add(DiffWarn, where, "field %d moved between oneof `%s` -> `%s`, set values may be lost",
+				n, o.oneof, x.oneof)
+		}
+	}
+
+	nums = nums[:0]
+	for n := range newByNum {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+
+	for _, n := range nums {
+		x := newByNum[n]
+		if oldByNum[n] == nil && isReserved(oldMsg.Reserved, n, x.name) {
+			p.add(DiffError, where, "field `%s` uses reserved number or name (%d)", x.name, n)
+		}
+	}
+}
+
+func enumValues(e *proto.Enum) []*proto.EnumField {
+	var list []*proto.EnumField
+	for _, el := range e.Elements {
+		if f, ok := el.(*proto.EnumField); ok {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+func enumReserved(e *proto.Enum) []*proto.Reserved {
+	var list []*proto.Reserved
+	for _, el := range e.Elements {
+		if r, ok := el.(*proto.Reserved); ok {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// enumAllowAlias enum 设置了 option allow_alias = true 时, 多个值可以共用一个编号
+func enumAllowAlias(e *proto.Enum) bool {
+	for _, el := range e.Elements {
+		if o, ok := el.(*proto.Option); ok && o.Name == "allow_alias" && o.Constant.Source == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *diffCtx) diffEnum(oldEnum, newEnum *proto.Enum) {
+	where := "enum " + pbEnumFullName(newEnum)
+
+	oldByName := make(map[string]int)
+	oldByNum := make(map[int]string)
+	for _, f := range enumValues(oldEnum) {
+		oldByName[f.Name] = f.Integer
+		oldByNum[f.Integer] = f.Name
+	}
+	newByName := make(map[string]int)
+	newByNum := make(map[int]string)
+	for _, f := range enumValues(newEnum) {
+		newByName[f.Name] = f.Integer
+		newByNum[f.Integer] = f.Name
+	}
+
+	for _, f := range enumValues(oldEnum) {
+		n, ok := newByName[f.Name]
+		if ok {
+			if n != f.Integer {
+				p.add(DiffError, where, "value `%s` renumbered %d -> %d", f.Name, f.Integer, n)
+			}
+			continue
+		}
+
+		if other, ok := newByNum[f.Integer]; ok {
+			if _, existed := oldByName[other]; existed {
+				continue
+			}
+			// 旧名字被 reserved 说明是删除后复用了编号, 不是改名
+			if isReservedName(enumReserved(newEnum), f.Name) {
+				p.add(DiffError, where, "value %d reused by `%s`, was removed `%s`", f.Integer, other, f.Name)
+				continue
+			}
+			p.add(DiffWarn, where, "value %d renamed `%s` -> `%s`, breaks JSON clients",
+				f.Integer, f.Name, other)
+		} else if !isReserved(enumReserved(newEnum), f.Integer, f.Name) {
+			p.add(DiffError, where, "value `%s` (%d) removed without reserved", f.Name, f.Integer)
+		}
+	}
+
+	if enumAllowAlias(newEnum) {
+		return
+	}
+	for _, f := range enumValues(newEnum) {
+		if old, ok := oldByNum[f.Integer]; ok && old != f.Name {
+			if _, stillThere := newByName[old]; stillThere {
+				p.add(DiffError, where, "value %d reused by `%s`, was `%s`", f.Integer, f.Name, old)
+			}
+		}
+	}
+}
+
+func (p *diffCtx) diffRpc(oldPd, newPd *ProtoDetect) {
+	newMap := make(map[string]*RpcNode)
+	for _, v := range newPd.RpcList {
+		newMap[v.MethodName] = v
+	}
+
+	for _, o := range oldPd.RpcList {
+		where := "rpc " + o.MethodName
+		x := newMap[o.MethodName]
+		if x == nil {
+			p.add(DiffError, where, "removed")
+			continue
+		}
+		if x.CmdID != o.CmdID {
+			p.add(DiffError, where, "CmdID changed %s -> %s", o.CmdID, x.CmdID)
+		}
+		if a, b := rpcPath(*oldPd, o), rpcPath(*newPd, x); a != b {
+			p.add(DiffError, where, "url changed %s -> %s", a, b)
+		}
+		if x.ReqType != o.ReqType {
+			p.add(DiffError, where, "request type changed %s -> %s", o.ReqType, x.ReqType)
+		}
+		if x.RspType != o.RspType {
+			p.add(DiffError, where, "response type changed %s -> %s", o.RspType, x.RspType)
+		}
+	}
+
+	oldCmd := make(map[string]string)
+	for _, o := range oldPd.RpcList {
+		oldCmd[o.CmdID] = o.MethodName
+	}
+	for _, x := range newPd.RpcList {
+		if owner, ok := oldCmd[x.CmdID]; ok && owner != x.MethodName && x.CmdID != "0" {
+			if _, stillThere := newMap[owner]; !stillThere {
+				p.add(DiffError, "rpc "+x.MethodName, "reuses CmdID %s of removed rpc %s", x.CmdID, owner)
+			}
+		}
+	}
+}
+
+// DiffProto 找出 old -> new 的不兼容修改
+func DiffProto(oldSnap, newSnap *ProtoSnapshot) []*DiffIssue {
+	ctx := &diffCtx{}
+
+	if oldSnap.PD.PackageName != newSnap.PD.PackageName {
+		ctx.add(DiffError, "package", "changed %s -> %s", oldSnap.PD.PackageName, newSnap.PD.PackageName)
+	}
+
+	ctx.diffRpc(oldSnap.PD, newSnap.PD)
+
+	newMsgs := make(map[string]*PbMsg)
+	for _, m := range newSnap.Msgs {
+		newMsgs[m.FullName] = m
+	}
+	for _, m := range oldSnap.Msgs {
+		x := newMsgs[m.FullName]
+		if x == nil {
+			ctx.add(DiffWarn, "message "+m.FullName, "removed")
+			continue
+		}
+		ctx.diffMsg(m, x)
+	}
+
+	newEnums := make(map[string]*proto.Enum)
+	for _, e := range newSnap.PD.EnumList {
+		newEnums[pbEnumFullName(e)] = e
+	}
+	for _, e := range oldSnap.PD.EnumList {
+		name := pbEnumFullName(e)
+		x := newEnums[name]
+		if x == nil {
+			ctx.add(DiffWarn, "enum "+name, "removed")
+			continue
+		}
+		ctx.diffEnum(e, x)
+	}
+
+	return ctx.issues
+}
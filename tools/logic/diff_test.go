@@ -0,0 +1,268 @@
+package logic
+
+import (
+	"fmt"
+	"github.com/emicklei/proto"
+	"strings"
+	"testing"
+)
+
+// parseTestSnapshot 把 proto 源码解析成 ProtoSnapshot, 和 walkPb 记录的内容一致
+func parseTestSnapshot(t *testing.T, src string) *ProtoSnapshot {
+	t.Helper()
+
+	def, err := proto.NewParser(strings.NewReader(src)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snap := &ProtoSnapshot{PD: NewProtoDetect()}
+	proto.Walk(def,
+		proto.WithPackage(func(p *proto.Package) {
+			snap.PD.PackageName = p.Name
+		}),
+		proto.WithRPC(func(r *proto.RPC) {
+			node := &RpcNode{MethodName: r.Name, ReqType: r.RequestType, RspType: r.ReturnsType, CmdID: "0"}
+			for _, el := range r.Elements {
+				if o, ok := el.(*proto.Option); ok && o.Name == "(ext.CmdID)" {
+					node.CmdID = o.Constant.Source
+				}
+			}
+			snap.PD.RpcList = append(snap.PD.RpcList, node)
+		}),
+		proto.WithEnum(func(e *proto.Enum) {
+			snap.PD.EnumList = append(snap.PD.EnumList, e)
+		}),
+		proto.WithMessage(func(m *proto.Message) {
+			msg := &PbMsg{Name: m.Name, FullName: PbMsgFullName(m)}
+			for _, el := range m.Elements {
+				switch x := el.(type) {
+				case *proto.NormalField:
+					msg.Fields = append(msg.Fields, &PbField{NormalField: x})
+				case *proto.MapField:
+					msg.Fields = append(msg.Fields, &PbField{MapField: x})
+				case *proto.Reserved:
+					msg.Reserved = append(msg.Reserved, x)
+				case *proto.Oneof:
+					msg.Oneofs = append(msg.Oneofs, x)
+				}
+			}
+			snap.Msgs = append(snap.Msgs, msg)
+		}),
+	)
+	return snap
+}
+
+func TestDiffProto(t *testing.T) {
+	head := "syntax = \"proto3\";\npackage shop;\n"
+	cases := []struct {
+		name string
+		old  string
+		new  string
+		want []string // "SEVERITY substring", 顺序无关
+	}{
+		{
+			name: "no change",
+			old:  "message A { string name = 1; }",
+			new:  "message A { string name = 1; }",
+		},
+		{
+			name: "field renumbered",
+			old:  "message A { string name = 1; }",
+			new:  "message A { string name = 2; }",
+			want: []string{"ERROR field `name` number changed 1 -> 2"},
+		},
+		{
+			name: "field removed without reserved",
+			old:  "message A { string name = 1; int32 age = 2; }",
+			new:  "message A { string name = 1; }",
+			want: []string{"ERROR field `age` (2) removed without reserved"},
+		},
+		{
+			name: "field removed and reserved",
+			old:  "message A { string name = 1; int32 age = 2; }",
+			new:  "message A { string name = 1; reserved 2; }",
+			want: []string{"INFO field `age` (2) removed and reserved"},
+		},
+		{
+			name: "incompatible type change",
+			old:  "message A { string name = 1; }",
+			new:  "message A { int64 name = 1; }",
+			want: []string{"ERROR field 1 type changed string -> int64"},
+		},
+		{
+			name: "wire compatible type change",
+			old:  "message A { int32 n = 1; }",
+			new:  "message A { int64 n = 1; }",
+			want: []string{"WARN field 1 type changed int32 -> int64"},
+		},
+		{
+			name: "pure rename",
+			old:  "message A { string name = 1; }",
+			new:  "message A { string title = 1; }",
+			want: []string{"WARN field 1 renamed `name` -> `title`"},
+		},
+		{
+			name: "number reused with other type",
+			old:  "message A { string name = 1; }",
+			new:  "message A { int64 id = 1; }",
+			want: []string{"ERROR field number 1 reused by `id` int64, was `name` string"},
+		},
+		{
+			name: "number reused after old name reserved",
+			old:  "message A { string name = 1; }",
+			new:  "message A { string title = 1; reserved \"name\"; }",
+			want: []string{"ERROR field number 1 reused by `title`"},
+		},
+		{
+			name: "number reused after old field moved",
+			old:  "message A { string name = 1; }",
+			new:  "message A { string title = 1; string name = 2; }",
+			want: []string{"ERROR field number 1 reused by `title`", "ERROR field `name` number changed 1 -> 2"},
+		},
+		{
+			name: "new field uses reserved number",
+			old:  "message A { string name = 1; reserved 2; }",
+			new:  "message A { string name = 1; string age = 2; reserved 3; }",
+			want: []string{"ERROR field `age` uses reserved number or name (2)"},
+		},
+		{
+			name: "label changed",
+			old:  "message A { string tags = 1; }",
+			new:  "message A { repeated string tags = 1; }",
+			want: []string{"ERROR field 1 label changed"},
+		},
+		{
+			name: "map value type changed",
+			old:  "message A { map<string, int32> m = 1; }",
+			new:  "message A { map<string, string> m = 1; }",
+			want: []string{"ERROR field 1 type changed map<string,int32> -> map<string,string>"},
+		},
+		{
+			name: "oneof field type changed",
+			old:  "message A { oneof v { string s = 1; int32 n = 2; } }",
+			new:  "message A { oneof v { string s = 1; string n = 2; } }",
+			want: []string{"ERROR field 2 type changed int32 -> string"},
+		},
+		{
+			name: "oneof field removed",
+			old:  "message A { oneof v { string s = 1; int32 n = 2; } }",
+			new:  "message A { oneof v { string s = 1; } }",
+			want: []string{"ERROR field `n` (2) removed without reserved"},
+		},
+		{
+			name: "field moved into oneof",
+			old:  "message A { string s = 1; int32 n = 2; }",
+			new:  "message A { string s = 1; oneof v { int32 n = 2; } }",
+			want: []string{"WARN field 2 moved between oneof `` -> `v`"},
+		},
+		{
+			name: "nested message compared by full name",
+			old:  "message A { message B { string s = 1; } }",
+			new:  "message A { message B { bytes s = 1; } }",
+			want: []string{"WARN field 1 type changed string -> bytes"},
+		},
+		{
+			name: "message removed",
+			old:  "message A { string s = 1; }",
+			new:  "",
+			want: []string{"WARN removed"},
+		},
+		{
+			name: "enum value renumbered",
+			old:  "enum E { A = 0; B = 1; }",
+			new:  "enum E { A = 0; B = 2; }",
+			want: []string{"ERROR value `B` renumbered 1 -> 2"},
+		},
+		{
+			name: "enum value removed",
+			old:  "enum E { A = 0; B = 1; }",
+			new:  "enum E { A = 0; }",
+			want: []string{"ERROR value `B` (1) removed without reserved"},
+		},
+		{
+			name: "enum value renamed",
+			old:  "enum E { A = 0; B = 1; }",
+			new:  "enum E { A = 0; C = 1; }",
+			want: []string{"WARN value 1 renamed `B` -> `C`"},
+		},
+		{
+			name: "enum number reused after name reserved",
+			old:  "enum E { A = 0; B = 1; }",
+			new:  "enum E { A = 0; C = 1; reserved \"B\"; }",
+			want: []string{"ERROR value 1 reused by `C`, was removed `B`"},
+		},
+		{
+			name: "enum number reused while old value moved",
+			old:  "enum E { A = 0; B = 1; }",
+			new:  "enum E { A = 0; C = 1; B = 2; }",
+			want: []string{"ERROR value `B` renumbered 1 -> 2", "ERROR value 1 reused by `C`, was `B`"},
+		},
+		{
+			name: "enum alias added",
+			old:  "enum E { option allow_alias = true; A = 0; B = 1; }",
+			new:  "enum E { option allow_alias = true; A = 0; B = 1; C = 1; }",
+		},
+		{
+			name: "rpc removed and CmdID reused",
+			old:  "service S { rpc A (R) returns (R) { option (ext.CmdID) = 1; } }",
+			new:  "service S { rpc B (R) returns (R) { option (ext.CmdID) = 1; } }",
+			want: []string{"ERROR removed", "ERROR reuses CmdID 1 of removed rpc A"},
+		},
+		{
+			name: "rpc types and CmdID changed",
+			old:  "service S { rpc A (R) returns (R) { option (ext.CmdID) = 1; } }",
+			new:  "service S { rpc A (Q) returns (Q) { option (ext.CmdID) = 2; } }",
+			want: []string{"ERROR CmdID changed 1 -> 2", "ERROR request type changed R -> Q", "ERROR response type changed R -> Q"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			issues := DiffProto(parseTestSnapshot(t, head+c.old), parseTestSnapshot(t, head+c.new))
+
+			var got []string
+			for _, x := range issues {
+				got = append(got, fmt.Sprintf("%s %s", x.Severity, x.Msg))
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("got %d issues, want %d:\n%s", len(got), len(c.want), strings.Join(got, "\n"))
+			}
+			for _, w := range c.want {
+				found := false
+				for _, g := range got {
+					if strings.HasPrefix(g, w) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("missing issue %q in:\n%s", w, strings.Join(got, "\n"))
+				}
+			}
+		})
+	}
+}
+
+func TestDiffProtoOrder(t *testing.T) {
+	head := "syntax = \"proto3\";\npackage shop;\n"
+	old := parseTestSnapshot(t, head+"message A { string a = 1; reserved 2 to 9; }")
+	x := parseTestSnapshot(t, head+"message A { string a = 1; string b = 2; string c = 3; string d = 4; string e = 5; reserved 6 to 9; }")
+
+	var first string
+	for i := 0; i < 20; i++ {
+		var got []string
+		for _, x := range DiffProto(old, x) {
+			got = append(got, x.Msg)
+		}
+		s := strings.Join(got, "\n")
+		if i == 0 {
+			first = s
+			if !strings.HasPrefix(s, "field `b`") || !strings.HasSuffix(s, "(5)") {
+				t.Fatalf("issues not sorted by number:\n%s", s)
+			}
+		} else if s != first {
+			t.Fatalf("issue order changed:\n%s\nfirst:\n%s", s, first)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package logic
+
+import (
+	"fmt"
+	"github.com/emicklei/proto"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrCodeRange 模块允许使用的错误码区间, 由 option(ext.ErrCodeRange) = "20000-20999" 声明
+type ErrCodeRange struct {
+	From uint32
+	To   uint32
+}
+
+func (p *ErrCodeRange) String() string {
+	return fmt.Sprintf("%d-%d", p.From, p.To)
+}
+
+func (p *ErrCodeRange) Contains(code uint32) bool {
+	return code >= p.From && code <= p.To
+}
+
+func (p *ErrCodeRange) Overlaps(o *ErrCodeRange) bool {
+	return p.From <= o.To && o.From <= p.To
+}
+
+func ParseErrCodeRange(s string) (*ErrCodeRange, error) {
+	fs := strings.Split(strings.TrimSpace(s), "-")
+	if len(fs) != 2 {
+		return nil, fmt.Errorf("invalid error code range `%s`, want like 20000-20999", s)
+	}
+	from, err := strconv.ParseUint(strings.TrimSpace(fs[0]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid error code range `%s`, %v", s, err)
+	}
+	to, err := strconv.ParseUint(strings.TrimSpace(fs[1]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid error code range `%s`, %v", s, err)
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid error code range `%s`, from > to", s)
+	}
+	return &ErrCodeRange{From: uint32(from), To: uint32(to)}, nil
+}
+
+// GetErrCodeRange 读取文件级的 option(ext.ErrCodeRange)
+func GetErrCodeRange(definition *proto.Proto) (*ErrCodeRange, error) {
+	for _, e := range definition.Elements {
+		if o, ok := e.(*proto.Option); ok && o.Name == "(ext.ErrCodeRange)" {
+			return ParseErrCodeRange(o.Constant.Source)
+		}
+	}
+	return nil, nil
+}
+
+type ErrCodeEntry struct {
+	Mod  string
+	Enum string
+	Name string
+	Code uint32
+	File string
+}
+
+func (p *ErrCodeEntry) String() string {
+	return fmt.Sprintf("%s.%s.%s(%d) in %s", p.Mod, p.Enum, p.Name, p.Code, p.File)
+}
+
+// ErrCodeRegistry 项目内所有 proto 中 *ErrCode 枚举的错误码, 用于保证错误码全局唯一.
+// 模块名是 proto 相对 include path 的路径去掉 .proto, 不同目录下的同名文件是不同的模块
+type ErrCodeRegistry struct {
+	List   []*ErrCodeEntry
+	Ranges map[string]*ErrCodeRange
+
+	roots  []string
+	loaded map[string]bool
+}
+
+func NewErrCodeRegistry() *ErrCodeRegistry {
+	return &ErrCodeRegistry{
+		Ranges: make(map[string]*ErrCodeRange),
+		loaded: make(map[string]bool),
+	}
+}
+
+func parseErrCodeFile(fn string, mod string) ([]*ErrCodeEntry, *ErrCodeRange, error) {
+	reader, err := os.Open(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+
+	definition, err := proto.NewParser(reader).Parse()
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse %s err %v", fn, err)
+	}
+
+	rg, err := GetErrCodeRange(definition)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", fn, err)
+	}
+
+	var list []*ErrCodeEntry
+	proto.Walk(definition, proto.WithEnum(func(e *proto.Enum) {
+		if !strings.HasSuffix(e.Name, "ErrCode") {
+			return
+		}
+		for _, x := range e.Elements {
+			f, ok := x.(*proto.EnumField)
+			if !ok {
+				continue
+			}
+			if f.Integer < 0 && err == nil {
+				err = fmt.Errorf("%s: %s.%s = %d, error code must not be negative", fn, e.Name, f.Name, f.Integer)
+			}
+			list = append(list, &ErrCodeEntry{
+				Mod: mod, Enum: e.Name, Name: f.Name, Code: uint32(f.Integer), File: fn})
+		}
+	}))
+
+	return list, rg, err
+}
+
+// modName 返回 fn 相对第一个包含它的 include path 的路径, 不在 include path 下时用文件名
+func (p *ErrCodeRegistry) modName(abs string) string {
+	for _, root := range p.roots {
+		rel, err := filepath.Rel(root, abs)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return strings.TrimSuffix(filepath.ToSlash(rel), ".proto")
+		}
+	}
+	return strings.TrimSuffix(filepath.Base(abs), ".proto")
+}
+
+func (p *ErrCodeRegistry) AddFile(fn string) error {
+	abs, err := filepath.Abs(fn)
+	if err != nil {
+		return err
+	}
+	if p.loaded[abs] {
+		return nil
+	}
+	p.loaded[abs] = true
+
+	mod := p.modName(abs)
+	list, rg, err := parseErrCodeFile(fn, mod)
+	if err != nil {
+		return err
+	}
+
+	if rg != nil {
+		p.Ranges[mod] = rg
+	}
+
+	// AllErrCodes 和生成代码一样按文件名区分模块
+	for _, v := range list {
+		AllErrCodes.Set(path.Base(v.Mod), v.Name, v.Code)
+	}
+	p.List = append(p.List, list...)
+
+	return nil
+}
+
+// AddDir 递归加载目录下所有 proto, 跳过隐藏目录和 node_modules
+func (p *ErrCodeRegistry) AddDir(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			name := info.Name()
+			if path != dir && (strings.HasPrefix(name, ".") || name == "node_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".proto") {
+			return nil
+		}
+
+		return p.AddFile(path)
+	})
+}
+
+// LoadErrCodeRegistry 加载 protoFile 以及所有 include path 下的错误码.
+// 默认加入的当前目录 . 通常是项目根目录, 只有 protoFile 就在当前目录时才加载
+func LoadErrCodeRegistry(protoFile string, incPaths []string) (*ErrCodeRegistry, error) {
+	reg := NewErrCodeRegistry()
+
+	for _, inc := range incPaths {
+		if filepath.Clean(inc) == "." && filepath.Dir(protoFile) != "." {
+			continue
+		}
+		if ok, _ := IsDirectory(inc); !ok {
+			continue
+		}
+		abs, err := filepath.Abs(inc)
+		if err != nil {
+			return nil, err
+		}
+		reg.roots = append(reg.roots, abs)
+	}
+
+	err := reg.AddFile(protoFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, root := range reg.roots {
+		err = reg.AddDir(root)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reg, nil
+}
+
+// Collisions 返回数值相同但定义不同的错误码, 0 是 proto3 枚举的默认值, 不参与检查.
+// 同一个模块同名的定义视为同一个文件的不同拷贝
+func (p *ErrCodeRegistry) Collisions() []string {
+	byCode := make(map[uint32][]*ErrCodeEntry)
+	for _, v := range p.List {
+		if v.Code == 0 {
+			continue
+		}
+		byCode[v.Code] = append(byCode[v.Code], v)
+	}
+
+	var res []string
+	for code, list := range byCode {
+		seen := make(map[string]bool)
+		var uniq []*ErrCodeEntry
+		for _, v := range list {
+			key := v.Mod + "." + v.Name
+			if !seen[key] {
+				seen[key] = true
+				uniq = append(uniq, v)
+			}
+		}
+		if len(uniq) < 2 {
+			continue
+		}
+
+		var names []string
+		for _, v := range uniq {
+			names = append(names, v.String())
+		}
+		res = append(res, fmt.Sprintf("error code %d defined %d times: %s",
+			code, len(uniq), strings.Join(names, ", ")))
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+// RangeViolations 返回超出模块声明区间的错误码, 以及不同模块之间重叠的区间
+func (p *ErrCodeRegistry) RangeViolations() []string {
+	var res []string
+
+	for _, v := range p.List {
+		rg := p.Ranges[v.Mod]
+		if rg != nil && v.Code != 0 && !rg.Contains(v.Code) {
+			res = append(res, fmt.Sprintf("%s out of range %s", v.String(), rg.String()))
+		}
+	}
+
+	var mods []string
+	for mod := range p.Ranges {
+		mods = append(mods, mod)
+	}
+	sort.Strings(mods)
+	for i := 0; i < len(mods); i++ {
+		for j := i + 1; j < len(mods); j++ {
+			a, b := p.Ranges[mods[i]], p.Ranges[mods[j]]
+			if a.Overlaps(b) {
+				res = append(res, fmt.Sprintf("error code range %s of %s overlaps %s of %s",
+					a.String(), mods[i], b.String(), mods[j]))
+			}
+		}
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+// Problems 返回所有会导致生成失败的问题
+func (p *ErrCodeRegistry) Problems() []string {
+	return append(p.Collisions(), p.RangeViolations()...)
+}
+
+// NextFree 给模块推荐下一个可用的错误码: 优先使用已用最大值之后的值,
+// 区间用完时回头找区间内的空位. 模块未声明区间时只保证全局不重复
+func (p *ErrCodeRegistry) NextFree(mod string) (uint32, error) {
+	used := make(map[uint32]bool)
+	var max uint32
+	for _, v := range p.List {
+		used[v.Code] = true
+		if v.Mod == mod && v.Code > max {
+			max = v.Code
+		}
+	}
+
+	rg := p.Ranges[mod]
+	if rg == nil {
+		for c := max + 1; c != 0; c++ {
+			if !used[c] {
+				return c, nil
+			}
+		}
+		return 0, fmt.Errorf("no free error code for %s", mod)
+	}
+
+	var maxIn uint32
+	for _, v := range p.List {
+		if v.Mod == mod && rg.Contains(v.Code) && v.Code > maxIn {
+			maxIn = v.Code
+		}
+	}
+
+	start := rg.From
+	if maxIn >= rg.From && maxIn < rg.To {
+		start = maxIn + 1
+	}
+	for c := start; c <= rg.To && c >= start; c++ {
+		if c != 0 && !used[c] {
+			return c, nil
+		}
+	}
+	for c := rg.From; c < start; c++ {
+		if c != 0 && !used[c] {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("error code range %s of %s is full", rg.String(), mod)
+}
@@ -0,0 +1,278 @@
+package logic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseErrCodeRange(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+		err  string
+	}{
+		{in: "20000-20999", want: "20000-20999"},
+		{in: " 1 - 2 ", want: "1-2"},
+		{in: "5-5", want: "5-5"},
+		{in: "20000", err: "want like"},
+		{in: "a-2", err: "invalid error code range"},
+		{in: "3-2", err: "from > to"},
+		{in: "1-99999999999", err: "invalid error code range"},
+	}
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			rg, err := ParseErrCodeRange(c.in)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want err %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rg.String() != c.want {
+				t.Errorf("got %s, want %s", rg, c.want)
+			}
+		})
+	}
+}
+
+func writeProtos(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, src := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestErrCodeCollisions(t *testing.T) {
+	cases := []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{
+			name: "unique codes",
+			files: map[string]string{
+				"a.proto": `syntax="proto3"; package a; enum AErrCode { Ok = 0; Bad = 1000; }`,
+				"b.proto": `syntax="proto3"; package b; enum BErrCode { Ok = 0; Bad = 2000; }`,
+			},
+		},
+		{
+			name: "collision across modules",
+			files: map[string]string{
+				"a.proto": `syntax="proto3"; package a; enum AErrCode { Ok = 0; Bad = 7; }`,
+				"b.proto": `syntax="proto3"; package b; enum BErrCode { Ok = 0; Other = 7; }`,
+			},
+			want: []string{"error code 7 defined 2 times"},
+		},
+		{
+			name: "same file name in different directories",
+			files: map[string]string{
+				"a.proto":         `syntax="proto3"; package a;`,
+				"auth/user.proto": `syntax="proto3"; package auth; enum UserErrCode { Ok = 0; Bad = 7; }`,
+				"crm/user.proto":  `syntax="proto3"; package crm; enum UserErrCode { Ok = 0; Bad = 7; }`,
+			},
+			want: []string{"auth/user.UserErrCode.Bad(7)"},
+		},
+		{
+			name: "non ErrCode enums ignored",
+			files: map[string]string{
+				"a.proto": `syntax="proto3"; package a; enum AErrCode { Ok = 0; Bad = 7; }
+enum Color { Red = 0; Blue = 7; }`,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := writeProtos(t, c.files)
+			reg, err := LoadErrCodeRegistry(filepath.Join(dir, "a.proto"), []string{dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := reg.Collisions()
+			if len(got) != len(c.want) {
+				t.Fatalf("got collisions %v, want %v", got, c.want)
+			}
+			for i, w := range c.want {
+				if !strings.Contains(got[i], w) {
+					t.Errorf("collision %q does not contain %q", got[i], w)
+				}
+			}
+		})
+	}
+}
+
+func TestErrCodeRegistry(t *testing.T) {
+	cases := []struct {
+		name     string
+		files    map[string]string
+		problems []string
+		nextMod  string
+		next     uint32
+		nextErr  string
+	}{
+		{
+			name: "unique codes in ranges",
+			files: map[string]string{
+				"a.proto": `syntax="proto3"; package a; option(ext.ErrCodeRange) = "1000-1099";
+enum AErrCode { Ok = 0; Bad = 1000; Worse = 1001; }`,
+				"b.proto": `syntax="proto3"; package b; option(ext.ErrCodeRange) = "2000-2099";
+enum BErrCode { Ok = 0; Bad = 2000; }`,
+			},
+			nextMod: "a",
+			next:    1002,
+		},
+		{
+			name: "collision across modules",
+			files: map[string]string{
+				"a.proto": `syntax="proto3"; package a; enum AErrCode { Ok = 0; Bad = 7; }`,
+				"b.proto": `syntax="proto3"; package b; enum BErrCode { Ok = 0; Other = 7; }`,
+			},
+			problems: []string{"error code 7 defined 2 times"},
+			nextMod:  "a",
+			next:     8,
+		},
+		{
+			name: "non ErrCode enums ignored",
+			files: map[string]string{
+				"a.proto": `syntax="proto3"; package a; enum AErrCode { Ok = 0; Bad = 7; }
+enum Color { Red = 0; Blue = 7; }`,
+			},
+			nextMod: "a",
+			next:    8,
+		},
+		{
+			name: "out of range and overlap",
+			files: map[string]string{
+				"a.proto": `syntax="proto3"; package a; option(ext.ErrCodeRange) = "1500-1600";
+enum AErrCode { Ok = 0; Bad = 1501; }`,
+				"b.proto": `syntax="proto3"; package b; option(ext.ErrCodeRange) = "1000-1999";
+enum BErrCode { Ok = 0; Worse = 1003; Far = 3000; }`,
+			},
+			problems: []string{
+				"b.BErrCode.Far(3000)",
+				"error code range 1500-1600 of a overlaps 1000-1999 of b",
+			},
+			nextMod: "b",
+			next:    1004,
+		},
+		{
+			name: "fill gap when range tail is used",
+			files: map[string]string{
+				"a.proto": `syntax="proto3"; package a; option(ext.ErrCodeRange) = "10-12";
+enum AErrCode { Ok = 0; X = 10; Z = 12; }`,
+			},
+			nextMod: "a",
+			next:    11,
+		},
+		{
+			name: "range full",
+			files: map[string]string{
+				"a.proto": `syntax="proto3"; package a; option(ext.ErrCodeRange) = "10-11";
+enum AErrCode { Ok = 0; X = 10; Y = 11; }`,
+			},
+			nextMod: "a",
+			nextErr: "is full",
+		},
+		{
+			name: "range without codes yet",
+			files: map[string]string{
+				"a.proto": `syntax="proto3"; package a; option(ext.ErrCodeRange) = "300-399";`,
+				"b.proto": `syntax="proto3"; package b; enum BErrCode { Ok = 0; X = 300; }`,
+			},
+			nextMod: "a",
+			next:    301,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := writeProtos(t, c.files)
+			var first string
+			for name := range c.files {
+				first = filepath.Join(dir, name)
+				break
+			}
+			reg, err := LoadErrCodeRegistry(first, []string{dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			problems := reg.Problems()
+			if len(problems) != len(c.problems) {
+				t.Fatalf("got problems %v, want %v", problems, c.problems)
+			}
+			for _, w := range c.problems {
+				found := false
+				for _, p := range problems {
+					if strings.Contains(p, w) {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("missing problem %q in %v", w, problems)
+				}
+			}
+
+			next, err := reg.NextFree(c.nextMod)
+			if c.nextErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.nextErr) {
+					t.Fatalf("want err %q, got %v", c.nextErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next != c.next {
+				t.Errorf("next free of %s got %d, want %d", c.nextMod, next, c.next)
+			}
+		})
+	}
+}
+
+func TestLoadErrCodeRegistryRoots(t *testing.T) {
+	root := writeProtos(t, map[string]string{
+		"proto/a.proto":    `syntax="proto3"; package a; enum AErrCode { Ok = 0; Bad = 7; }`,
+		"testdata/b.proto": `syntax="proto3"; package b; enum BErrCode { Ok = 0; Bad = 7; }`,
+	})
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	// 当前目录不是 include path, 其它目录下的 proto 不加载
+	reg, err := LoadErrCodeRegistry("proto/a.proto", []string{"proto", "."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reg.Collisions(); len(got) != 0 {
+		t.Errorf("proto outside include path loaded: %v", got)
+	}
+
+	// include path 下解析失败的 proto 返回错误
+	if err := ioutil.WriteFile(filepath.Join(root, "proto", "bad.proto"), []byte("message {"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadErrCodeRegistry("proto/a.proto", []string{"proto", "."}); err == nil || !strings.Contains(err.Error(), "bad.proto") {
+		t.Errorf("want parse error of bad.proto, got %v", err)
+	}
+}
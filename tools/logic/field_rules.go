@@ -0,0 +1,236 @@
+package logic
+
+import (
+	"fmt"
+	"github.com/emicklei/proto"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FieldRules 字段校验规则, 两种写法都支持:
+//
+//	string name = 1 [(ext.rules).min_len = 1, (ext.rules).max_len = 32];
+//	uint32 age = 2 [(ext.rules) = {min: 1, max: 150}];
+//
+// repeated/map 字段上 required/min_len/max_len 约束元素个数, min/max/pattern/in 约束每个元素
+type FieldRules struct {
+	Required bool
+	MinLen   *int
+	MaxLen   *int
+	Min      string // 数值字面量, 空表示未指定
+	Max      string
+	Pattern  string
+	In       []string
+}
+
+const (
+	fieldKindString = iota + 1
+	fieldKindBytes
+	fieldKindInt
+	fieldKindUint
+	fieldKindFloat
+	fieldKindBool
+	fieldKindEnum
+	fieldKindMsg
+)
+
+func (p *PbField) GetOptions() []*proto.Option {
+	if p.NormalField != nil {
+		return p.NormalField.Options
+	} else if p.MapField != nil {
+		return p.MapField.Options
+	}
+
+	return nil
+}
+
+func (p *PbField) IsRepeated() bool {
+	return p.MapField != nil || (p.NormalField != nil && p.NormalField.Repeated)
+}
+
+// isOptionalScalar proto3 optional 的标量字段在 Go 中是指针, 未设置时为 nil, bytes 和 message 不受影响
+func (p *PbField) isOptionalScalar() bool {
+	if p.NormalField == nil || !p.NormalField.Optional || p.NormalField.Repeated {
+		return false
+	}
+	kind := p.kind()
+	return kind != fieldKindMsg && kind != fieldKindBytes
+}
+
+// kind 在 setMsgPtr 之后调用, 非内置类型且找不到 message 的当作枚举
+func (p *PbField) kind() int {
+	switch p.GetType() {
+	case "string":
+		return fieldKindString
+	case "bytes":
+		return fieldKindBytes
+	case "int32", "int64", "sint32", "sint64", "sfixed32", "sfixed64":
+		return fieldKindInt
+	case "uint32", "uint64", "fixed32", "fixed64":
+		return fieldKindUint
+	case "float", "double":
+		return fieldKindFloat
+	case "bool":
+		return fieldKindBool
+	}
+	if p.Msg != nil {
+		return fieldKindMsg
+	}
+	return fieldKindEnum
+}
+
+func setFieldRule(r *FieldRules, key string, v *proto.Literal) error {
+	atoi := func() (*int, error) {
+		n, err := strconv.Atoi(v.Source)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative integer, got %s", key, v.Source)
+		}
+		return &n, nil
+	}
+
+	var err error
+	switch key {
+	case "required":
+		r.Required = v.Source == "true"
+	case "min_len":
+		r.MinLen, err = atoi()
+	case "max_len":
+		r.MaxLen, err = atoi()
+	case "min":
+		r.Min = v.Source
+	case "max":
+		r.Max = v.Source
+	case "pattern":
+		r.Pattern = v.Source
+	case "in":
+		if len(v.Array) > 0 {
+			for _, x := range v.Array {
+				r.In = append(r.In, x.Source)
+			}
+		} else {
+			for _, x := range strings.Split(v.Source, ",") {
+				if x = strings.TrimSpace(x); x != "" {
+					r.In = append(r.In, x)
+				}
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown rule `%s`", key)
+	}
+	return err
+}
+
+// ParseFieldRules 解析字段上的 (ext.rules) 选项, 没有规则时返回 nil
+func ParseFieldRules(opts []*proto.Option) (*FieldRules, error) {
+	var r *FieldRules
+	for _, o := range opts {
+		if o.Name != "(ext.rules)" && !strings.HasPrefix(o.Name, "(ext.rules).") {
+			continue
+		}
+		if r == nil {
+			r = &FieldRules{}
+		}
+
+		if o.Name == "(ext.rules)" {
+			for _, x := range o.Constant.OrderedMap {
+				err := setFieldRule(r, x.Name, x.Literal)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		err := setFieldRule(r, strings.TrimPrefix(o.Name, "(ext.rules)."), &o.Constant)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func checkRuleNumber(kind int, key, s string) error {
+	var err error
+	switch kind {
+	case fieldKindInt, fieldKindEnum:
+		_, err = strconv.ParseInt(s, 0, 64)
+	case fieldKindUint:
+		_, err = strconv.ParseUint(s, 0, 64)
+	case fieldKindFloat:
+		_, err = strconv.ParseFloat(s, 64)
+	default:
+		return fmt.Errorf("%s is only for numeric fields", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s value %s", key, s)
+	}
+	return nil
+}
+
+// CheckFieldRules 检查规则与字段类型是否匹配, 生成代码前调用
+func CheckFieldRules(f *PbField) error {
+	r := f.Rules
+	if r == nil {
+		return nil
+	}
+
+	kind := f.kind()
+	repeated := f.IsRepeated()
+	if kind == fieldKindBool && !repeated {
+		return fmt.Errorf("rules are not supported on bool field")
+	}
+	if (r.MinLen != nil || r.MaxLen != nil) && !repeated &&
+		kind != fieldKindString && kind != fieldKindBytes {
+		return fmt.Errorf("min_len/max_len are only for string, bytes, repeated or map fields")
+	}
+	if r.MinLen != nil && r.MaxLen != nil && *r.MinLen > *r.MaxLen {
+		return fmt.Errorf("min_len %d > max_len %d", *r.MinLen, *r.MaxLen)
+	}
+	if r.Min != "" {
+		if err := checkRuleNumber(kind, "min", r.Min); err != nil {
+			return err
+		}
+	}
+	if r.Max != "" {
+		if err := checkRuleNumber(kind, "max", r.Max); err != nil {
+			return err
+		}
+	}
+	if r.Pattern != "" {
+		if kind != fieldKindString {
+			return fmt.Errorf("pattern is only for string fields")
+		}
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern %s: %v", r.Pattern, err)
+		}
+	}
+	if len(r.In) > 0 && kind != fieldKindString {
+		for _, x := range r.In {
+			if err := checkRuleNumber(kind, "in", x); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckOneofRules oneof 中的字段不在 Fields 里, 不会生成检查, 写了规则时报错而不是悄悄忽略
+func CheckOneofRules(m *PbMsg) error {
+	for _, o := range m.Oneofs {
+		for _, el := range o.Elements {
+			f, ok := el.(*proto.OneOfField)
+			if !ok {
+				continue
+			}
+			r, err := ParseFieldRules(f.Options)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %v", m.FullName, f.Name, err)
+			}
+			if r != nil {
+				return fmt.Errorf("%s.%s: rules are not supported on oneof field", m.FullName, f.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package logic
+
+import (
+	"brick/log"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 生成区域标记, rpc_gen 完全拥有标记之间的代码, 标记之外的用户代码不会被改动:
+//
+//	// rpc_gen:begin client.Login 1a2b3c4d
+//
+//	func Login(...) {...}
+//
+//	// rpc_gen:end client.Login
+//
+// begin 行上的摘要是生成时内容的 sha1, 重新生成时摘要不符说明用户改过这个区域,
+// 此时报告冲突并保留用户的修改, 除非指定了 -force 1
+const (
+	genRegionBegin = "// rpc_gen:begin "
+	genRegionEnd   = "// rpc_gen:end "
+)
+
+// ForceRegion 为 true 时, 覆盖用户改过的生成区域
+var ForceRegion bool
+
+type GenRegion struct {
+	Name string
+	Body string
+
+	sum   string
+	start int
+	end   int
+}
+
+func (r *GenRegion) Edited() bool {
+	return r.sum != genRegionSum(r.Body)
+}
+
+func genRegionSum(body string) string {
+	h := sha1.Sum([]byte(strings.Join(strings.Fields(body), "")))
+	return hex.EncodeToString(h[:4])
+}
+
+func WrapGenRegion(name string, body string) string {
+	body = strings.Trim(body, "\n")
+	return fmt.Sprintf("%s%s %s\n\n%s\n\n%s%s\n",
+		genRegionBegin, name, genRegionSum(body), body, genRegionEnd, name)
+}
+
+func ParseGenRegions(src []byte) ([]*GenRegion, error) {
+	var list []*GenRegion
+	var cur *GenRegion
+	var body []string
+
+	off := 0
+	lineNo := 0
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	scanner.Buffer(make([]byte, 64*1024), len(src)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineStart := off
+		off += len(line) + 1
+		lineNo++
+
+		t := strings.TrimSpace(line) + " "
+		if strings.HasPrefix(t, genRegionBegin) {
+			if cur != nil {
+				return nil, fmt.Errorf("line %d: nested region, `%s` not closed", lineNo, cur.Name)
+			}
+			fs := strings.Fields(t[len(genRegionBegin):])
+			if len(fs) == 0 {
+				return nil, fmt.Errorf("line %d: region missed name", lineNo)
+			}
+			cur = &GenRegion{Name: fs[0], start: lineStart}
+			if len(fs) > 1 {
+				cur.sum = fs[1]
+			}
+			body = nil
+		} else if strings.HasPrefix(t, genRegionEnd) {
+			name := strings.TrimSpace(t[len(genRegionEnd):])
+			if cur == nil || cur.Name != name {
+				return nil, fmt.Errorf("line %d: unexpected region end `%s`", lineNo, name)
+			}
+			cur.Body = strings.Trim(strings.Join(body, "\n"), "\n")
+			cur.end = off
+			if cur.end > len(src) {
+				cur.end = len(src)
+			}
+			list = append(list, cur)
+			cur = nil
+		} else if cur != nil {
+			body = append(body, line)
+		}
+	}
+
+	if cur != nil {
+		return nil, fmt.Errorf("region `%s` not closed", cur.Name)
+	}
+
+	return list, nil
+}
+
+func inGenRegion(regions []*GenRegion, offset int) bool {
+	for _, r := range regions {
+		if offset >= r.start && offset < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeGenRegions 用 want 中的内容重新生成 src 里同名的区域, 不存在的追加到文件末尾.
+// 用户改过的区域不覆盖, 作为冲突返回. want 中没有的区域, keepOrphan 为 false 时删除
+func MergeGenRegions(src []byte, want []*GenRegion, keepOrphan bool) ([]byte, []string, error) {
+	regions, err := ParseGenRegions(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wantMap := make(map[string]*GenRegion)
+	for _, w := range want {
+		wantMap[w.Name] = w
+	}
+
+	var conflicts []string
+	var out bytes.Buffer
+	exists := make(map[string]bool)
+	last := 0
+	for _, r := range regions {
+		out.Write(src[last:r.start])
+		last = r.end
+		exists[r.Name] = true
+
+		w := wantMap[r.Name]
+		// 用户改成和生成结果一样时不算冲突, 重新写入摘要
+		if r.Edited() && !ForceRegion && (w == nil || !sameCode(w.Body, r.Body)) {
+			conflicts = append(conflicts, r.Name)
+			out.Write(src[r.start:r.end])
+			continue
+		}
+
+		if w == nil {
+			if keepOrphan {
+				out.Write(src[r.start:r.end])
+			}
+			continue
+		}
+
+		out.WriteString(WrapGenRegion(r.Name, w.Body))
+	}
+	out.Write(src[last:])
+
+	for _, w := range want {
+		if exists[w.Name] {
+			continue
+		}
+		s := strings.TrimRight(out.String(), "\n") + "\n\n" + WrapGenRegion(w.Name, w.Body)
+		out.Reset()
+		out.WriteString(s)
+	}
+
+	return out.Bytes(), conflicts, nil
+}
+
+// RemoveGenRegion 删除名为 name 的生成区域, 区域被手动修改过时保留并作为冲突返回
+func RemoveGenRegion(src []byte, name string) ([]byte, []string, error) {
+	regions, err := ParseGenRegions(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, r := range regions {
+		if r.Name != name {
+			continue
+		}
+		if r.Edited() && !ForceRegion {
+			return src, []string{name}, nil
+		}
+		out := append([]byte{}, src[:r.start]...)
+		return append(out, src[r.end:]...), nil, nil
+	}
+	return src, nil, nil
+}
+
+func reportGenRegionConflicts(fn string, conflicts []string) {
+	for _, c := range conflicts {
+		log.Warnf("%s: generated region `%s` was edited by hand, keep it, use -force 1 to overwrite", fn, c)
+	}
+}
+
+// genFileHeader 旧版本整体生成的文件以它开头, 可以直接覆盖
+const genFileHeader = "// Code generated by rpc_gen"
+
+const genFileNote = "// 标记 rpc_gen:begin 和 rpc_gen:end 之间的代码由 rpc_gen 生成, 之外的代码可以自由修改\n\n"
+
+// writeGenRegionFile 把生成的整个文件 src 写入 fn, import 之后的代码放到生成区域 name 中.
+// fn 不存在或是旧版本整体生成的文件时直接写入; 已经有生成区域时只更新这个区域和 import,
+// 区域之外的用户代码保留; 其它手写的文件不改动, 返回错误
+func writeGenRegionFile(fn string, src []byte, name string) error {
+	p, err := parseGoSourceBytes(fn, src)
+	if err != nil {
+		return err
+	}
+	end, imports := goImports(p)
+	head := string(src[:end])
+	if strings.HasPrefix(head, genFileHeader) {
+		head = head[strings.Index(head, "\n")+1:]
+	}
+	region := &GenRegion{Name: name, Body: string(src[end:])}
+
+	old, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var out []byte
+	if regions, _ := ParseGenRegions(old); len(regions) == 0 {
+		if len(old) > 0 && !bytes.HasPrefix(old, []byte(genFileHeader)) {
+			return fmt.Errorf("%s was not generated by rpc_gen, move it away and generate again", fn)
+		}
+		out, err = format.Source([]byte(genFileNote + head + "\n\n" + WrapGenRegion(name, region.Body)))
+	} else {
+		var conflicts []string
+		out, conflicts, err = MergeGenRegions(old, []*GenRegion{region}, true)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+		reportGenRegionConflicts(fn, conflicts)
+		// 原来的 import 也交给 fixImports 管理, 生成代码不再用到的会被删除
+		if q, err := parseGoSourceBytes(fn, old); err == nil {
+			_, have := goImports(q)
+			imports = append(imports, have...)
+		}
+		out, err = fixImports(fn, out, imports)
+	}
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+	return ioutil.WriteFile(fn, out, 0644)
+}
+
+// goImports 返回 import 结束的位置和 import 列表, 列表中的格式和 fixImports 的 managed 一致
+func goImports(p *goSource) (int, []string) {
+	end := p.offset(p.file.Name.End())
+	var imports []string
+	for _, decl := range p.file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			continue
+		}
+		end = p.offset(gd.End())
+		for _, s := range gd.Specs {
+			spec := s.(*ast.ImportSpec)
+			imp, _ := strconv.Unquote(spec.Path.Value)
+			if spec.Name != nil {
+				imp = spec.Name.Name + " " + imp
+			}
+			imports = append(imports, imp)
+		}
+	}
+	return end, imports
+}
@@ -0,0 +1,232 @@
+package logic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseGenRegions(t *testing.T) {
+	cases := []struct {
+		name  string
+		src   string
+		names []string
+		err   string
+	}{
+		{
+			name:  "two regions",
+			src:   "package x\n" + WrapGenRegion("a", "func A() {}") + "\nfunc U() {}\n" + WrapGenRegion("b", "func B() {}"),
+			names: []string{"a", "b"},
+		},
+		{
+			name: "nested",
+			src:  genRegionBegin + "a 0\n" + genRegionBegin + "b 0\n",
+			err:  "nested region",
+		},
+		{
+			name: "unexpected end",
+			src:  genRegionBegin + "a 0\n" + genRegionEnd + "b\n",
+			err:  "unexpected region end",
+		},
+		{
+			name: "not closed",
+			src:  genRegionBegin + "a 0\nfunc A() {}\n",
+			err:  "not closed",
+		},
+		{
+			name: "missed name",
+			src:  genRegionBegin + "\n",
+			err:  "missed name",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			list, err := ParseGenRegions([]byte(c.src))
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want err %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, r := range list {
+				names = append(names, r.Name)
+				if r.Edited() {
+					t.Errorf("region %s reported as edited", r.Name)
+				}
+			}
+			if strings.Join(names, ",") != strings.Join(c.names, ",") {
+				t.Errorf("got regions %v, want %v", names, c.names)
+			}
+		})
+	}
+}
+
+func TestMergeGenRegions(t *testing.T) {
+	user := "\n// 用户代码\nfunc U() {}\n"
+	base := "package x\n" + WrapGenRegion("a", "func A() {}") + user + WrapGenRegion("b", "func B() {}")
+	edited := strings.Replace(base, "func A() {}", "func A() { println() }", 1)
+
+	cases := []struct {
+		name       string
+		src        string
+		want       []*GenRegion
+		keepOrphan bool
+		force      bool
+		contains   []string
+		absent     []string
+		conflicts  []string
+	}{
+		{
+			name:     "regenerate changed region",
+			src:      base,
+			want:     []*GenRegion{{Name: "a", Body: "func A() { return }"}, {Name: "b", Body: "func B() {}"}},
+			contains: []string{"func A() { return }", user},
+		},
+		{
+			name:     "append new region",
+			src:      base,
+			want:     []*GenRegion{{Name: "a", Body: "func A() {}"}, {Name: "b", Body: "func B() {}"}, {Name: "c", Body: "func C() {}"}},
+			contains: []string{genRegionBegin + "c ", "func C() {}"},
+		},
+		{
+			name:   "drop orphan region",
+			src:    base,
+			want:   []*GenRegion{{Name: "a", Body: "func A() {}"}},
+			absent: []string{"func B() {}"},
+		},
+		{
+			name:       "keep orphan region",
+			src:        base,
+			want:       []*GenRegion{{Name: "a", Body: "func A() {}"}},
+			keepOrphan: true,
+			contains:   []string{"func B() {}"},
+		},
+		{
+			name:      "edited region kept as conflict",
+			src:       edited,
+			want:      []*GenRegion{{Name: "a", Body: "func A() {}"}, {Name: "b", Body: "func B() {}"}},
+			contains:  []string{"func A() { println() }"},
+			conflicts: []string{"a"},
+		},
+		{
+			name:     "edited region same as wanted is no conflict",
+			src:      edited,
+			want:     []*GenRegion{{Name: "a", Body: "func A() { println() }"}, {Name: "b", Body: "func B() {}"}},
+			contains: []string{"func A() { println() }"},
+		},
+		{
+			name:     "force overwrites edited region",
+			src:      edited,
+			want:     []*GenRegion{{Name: "a", Body: "func A() {}"}, {Name: "b", Body: "func B() {}"}},
+			force:    true,
+			contains: []string{"func A() {}"},
+			absent:   []string{"println"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ForceRegion = c.force
+			defer func() { ForceRegion = false }()
+
+			out, conflicts, err := MergeGenRegions([]byte(c.src), c.want, c.keepOrphan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := string(out)
+			for _, w := range c.contains {
+				if !strings.Contains(got, w) {
+					t.Errorf("missing %q in\n%s", w, got)
+				}
+			}
+			for _, a := range c.absent {
+				if strings.Contains(got, a) {
+					t.Errorf("unexpected %q in\n%s", a, got)
+				}
+			}
+			if strings.Join(conflicts, ",") != strings.Join(c.conflicts, ",") {
+				t.Errorf("got conflicts %v, want %v", conflicts, c.conflicts)
+			}
+
+			// 合并的结果再次解析时区域完整, 且重新生成的区域没有被标记为修改过
+			regions, err := ParseGenRegions(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range regions {
+				if r.Edited() && !inList(c.conflicts, r.Name) {
+					t.Errorf("region %s edited after merge", r.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteGenRegionFile(t *testing.T) {
+	gen := func(body string, imports ...string) []byte {
+		return []byte(fmt.Sprintf("// Code generated by rpc_gen. DO NOT EDIT.\npackage main\n\nimport (\n\t%s\n)\n\n%s", strings.Join(imports, "\n\t"), body))
+	}
+	fn := filepath.Join(t.TempDir(), "shop_autogen.go")
+
+	// 旧版本整体生成的文件直接覆盖
+	if err := ioutil.WriteFile(fn, gen("func a() { fmt.Println() }\n", `"fmt"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeGenRegionFile(fn, gen("func a() { fmt.Println() }\n", `"fmt"`), "server.a"); err != nil {
+		t.Fatal(err)
+	}
+	got := string(readGenerated(t, fn))
+	if strings.Contains(got, "DO NOT EDIT") || !strings.Contains(got, genRegionBegin+"server.a ") {
+		t.Fatalf("legacy file not converted:\n%s", got)
+	}
+
+	// 区域外的用户代码和 import 保留, 生成代码不再用到的 import 删除
+	user := "\n// b 用户代码\nfunc b() { os.Exit(0) }\n"
+	src := strings.Replace(got, "import (\n", "import (\n\t\"os\"\n", 1) + user
+	if err := ioutil.WriteFile(fn, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeGenRegionFile(fn, gen("func a() { log.Println() }\n", `"log"`), "server.a"); err != nil {
+		t.Fatal(err)
+	}
+	got = string(readGenerated(t, fn))
+	for _, w := range []string{"func b() { os.Exit(0) }", "log.Println()", `"os"`, `"log"`} {
+		if !strings.Contains(got, w) {
+			t.Errorf("missing %q in\n%s", w, got)
+		}
+	}
+	if strings.Contains(got, `"fmt"`) {
+		t.Errorf("unused import kept\n%s", got)
+	}
+
+	// 改过的区域保留
+	src = strings.Replace(got, "log.Println()", "log.Println(1)", 1)
+	if err := ioutil.WriteFile(fn, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeGenRegionFile(fn, gen("func a() { log.Println() }\n", `"log"`), "server.a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readGenerated(t, fn)); got != src {
+		t.Errorf("edited region overwritten:\n%s", lineDiff(src, got))
+	}
+
+	// 手写的文件不改动
+	hand := "package main\n\nfunc a() {}\n"
+	if err := ioutil.WriteFile(fn, []byte(hand), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeGenRegionFile(fn, gen("func a() {}\n"), "server.a"); err == nil {
+		t.Error("hand written file accepted")
+	}
+	if got := string(readGenerated(t, fn)); got != hand {
+		t.Errorf("hand written file changed:\n%s", got)
+	}
+}
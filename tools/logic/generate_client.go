@@ -1,12 +1,15 @@
 package logic
 
 import (
+	"brick/log"
 	"fmt"
-	"os"
+	"go/ast"
+	"go/format"
+	"io/ioutil"
+	"strings"
 )
 
-func GenerateClient(PD *ProtoDetect, rootDir string) error {
-	var clientTemp = `package %s
+var clientTemp = `package %s
 
 import (
 %s
@@ -15,64 +18,365 @@ import (
 var ServiceName = "%s"
 `
 
-	var clientCMDFunTemp = `
+var clientCMDFunTemp = `
 func %s(ctx *rpc.Context, req *%s) (*%s, error) {
 	rsp := &%s{}
-	return rsp, rpc.ClientCall(ctx, ServiceName, %sCMDPath, req, rsp)
+	return rsp, clientCall(ctx, %sCMDPath, req, rsp)
 }
 `
 
+func genClientFunc(node *RpcNode) string {
+	return fmt.Sprintf(
+		clientCMDFunTemp,
+		node.MethodName, node.ReqType, node.RspType, node.RspType, node.MethodName)
+}
+
+func clientImportList(PD *ProtoDetect) []string {
+	impList := []string{"brick/rpc"}
+	return append(impList, PD.GetImportPbList()...)
+}
+
+// isGeneratedClientFunc 判断是否是 rpc_gen 生成的客户端函数, 形如:
+//
+//	rsp := &XxxRsp{}
+//	return rsp, clientCall(ctx, XxxCMDPath, req, rsp)
+//
+// 老版本生成的 rpc.ClientCall 调用也算在内. 手写的函数不会被改动
+func isGeneratedClientFunc(fd *ast.FuncDecl) bool {
+	if fd.Body == nil || len(fd.Body.List) != 2 {
+		return false
+	}
+
+	assign, ok := fd.Body.List[0].(*ast.AssignStmt)
+	if !ok || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+		return false
+	}
+	if id, ok := assign.Lhs[0].(*ast.Ident); !ok || id.Name != "rsp" {
+		return false
+	}
+
+	ret, ok := fd.Body.List[1].(*ast.ReturnStmt)
+	if !ok || len(ret.Results) != 2 {
+		return false
+	}
+	call, ok := ret.Results[1].(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		return fun.Name == "clientCall"
+	case *ast.SelectorExpr:
+		x, ok := fun.X.(*ast.Ident)
+		return ok && x.Name == "rpc" && fun.Sel.Name == "ClientCall"
+	}
+	return false
+}
+
+func sameCode(a, b string) bool {
+	strip := func(s string) string {
+		return strings.Join(strings.Fields(s), "")
+	}
+	return strip(a) == strip(b)
+}
+
+const clientDeprecatedMark = "// Deprecated: rpc removed from proto"
+
+func clientRegionName(method string) string {
+	return "client." + method
+}
+
+func mergeClientFile(PD *ProtoDetect, fn string) ([]byte, error) {
+	src, err := parseGoSource(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	regions, err := ParseGenRegions(src.src)
+	if err != nil {
+		return nil, err
+	}
+
+	rpcMap := make(map[string]*RpcNode)
+	for _, v := range PD.RpcList {
+		rpcMap[v.MethodName] = v
+	}
+
+	// 区域外的函数: 老版本生成的函数收编进生成区域, 手写的不动
+	userFuncs := make(map[string]bool)
+	for name, fd := range src.funcDecls() {
+		start, _ := src.declRange(fd)
+		if inGenRegion(regions, start) {
+			continue
+		}
+
+		node := rpcMap[name]
+		generated := isGeneratedClientFunc(fd)
+
+		if node == nil {
+			if !generated {
+				continue
+			}
+			if PruneRemovedRpc {
+				log.Warnf("rpc `%s` removed from proto, delete client func", name)
+				src.remove(fd)
+			} else if fd.Doc == nil || strings.Index(fd.Doc.Text(), "Deprecated:") < 0 {
+				log.Warnf("rpc `%s` removed from proto, client func marked deprecated, use -prune 1 to delete", name)
+				src.replace(fd, clientDeprecatedMark+"\n"+src.declText(fd))
+			}
+			continue
+		}
+
+		expect := genClientFunc(node)
+		if !generated {
+			if !sameCode(src.nodeText(fd), expect) {
+				log.Warnf("client func `%s` is hand-written and differs from rpc, skip", name)
+			}
+			userFuncs[name] = true
+			continue
+		}
+
+		if !sameCode(src.nodeText(fd), expect) {
+			log.Infof("client func `%s` signature changed, regenerate", name)
+		}
+		src.replace(fd, WrapGenRegion(clientRegionName(name), expect))
+	}
+
+	var want []*GenRegion
+	for _, v := range PD.RpcList {
+		if userFuncs[v.MethodName] {
+			continue
+		}
+		want = append(want, &GenRegion{
+			Name: clientRegionName(v.MethodName), Body: genClientFunc(v)})
+	}
+
+	for _, r := range regions {
+		name := strings.TrimPrefix(r.Name, "client.")
+		if rpcMap[name] == nil && !PruneRemovedRpc {
+			log.Warnf("rpc `%s` removed from proto, keep generated region, use -prune 1 to delete", name)
+		}
+	}
+
+	content, conflicts, err := MergeGenRegions(src.apply(), want, !PruneRemovedRpc)
+	if err != nil {
+		return nil, err
+	}
+	reportGenRegionConflicts(fn, conflicts)
+
+	return fixImports(fn, content, clientImportList(PD))
+}
+
+func GenerateClient(PD *ProtoDetect, rootDir string) error {
 	fn := GetTargetFileName(*PD, "client", rootDir)
 
-	header := ""
-	context := ""
+	var content []byte
+	var err error
 	if FileExists(fn) {
 		ParseGoCode(PD, fn, "client")
-		for i := 0; i < len(PD.RpcList); i++ {
-			_, ok := PD.FuncCli[PD.RpcList[i].MethodName]
-			if ok == false {
-				method := PD.RpcList[i].MethodName
-				req := PD.RpcList[i].ReqType
-				rsp := PD.RpcList[i].RspType
-				cli := fmt.Sprintf(
-					clientCMDFunTemp,
-					method, req, rsp, rsp, method)
-				context += cli
-			}
+		content, err = mergeClientFile(PD, fn)
+		if err != nil {
+			log.Errorf("merge client file %s err %v", fn, err)
+			return err
 		}
 	} else {
-		for i := 0; i < len(PD.RpcList); i++ {
-			method := PD.RpcList[i].MethodName
-			req := PD.RpcList[i].ReqType
-			rsp := PD.RpcList[i].RspType
-			cli := fmt.Sprintf(
-				clientCMDFunTemp,
-				method, req, rsp, rsp, method)
-			context += cli
+		context := ""
+		for _, v := range PD.RpcList {
+			context += "\n" + WrapGenRegion(clientRegionName(v.MethodName), genClientFunc(v))
 		}
 
-		impList := []string{"brick/rpc"}
-		impList = append(impList, PD.GetImportPbList()...)
-		header = fmt.Sprintf(
+		header := fmt.Sprintf(
 			clientTemp, PD.PackageName,
-			JoinImportListWithBuf(impList, context), PD.PackageName)
+			JoinImportListWithBuf(clientImportList(PD), context), PD.PackageName)
+
+		content, err = format.Source([]byte(header + context))
+		if err != nil {
+			log.Errorf("format client file %s err %v", fn, err)
+			return err
+		}
 	}
 
-	f, err := os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	err = ioutil.WriteFile(fn, content, 0644)
 	if err != nil {
-		fmt.Printf("can not generate file %s,Error :%v\n", fn, err)
+		log.Errorf("can not generate file %s, err %v", fn, err)
+		return err
+	}
 
+	return generateClientPolicy(PD, rootDir)
+}
+
+var clientPolicyTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package %s
+
+import (
+	"brick/rpc"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type callPolicy struct {
+	Timeout    time.Duration
+	Idempotent bool
+	Retry      int
+}
+
+var path2Policy = map[string]*callPolicy{
+%s
+}
+
+const (
+	breakerFailThreshold = 5
+	breakerCoolDown      = 10 * time.Second
+	retryBackoffBase     = 50 * time.Millisecond
+	retryBackoffMax      = time.Second
+)
+
+var (
+	ErrCircuitOpen = errors.New(ServiceName + ": circuit breaker open")
+	ErrTimeout     = errors.New("timeout")
+)
+
+// IsFailure 判断 err 是否计入熔断并允许重试, 为 nil 时带 Code() uint32 的业务错误不算失败,
+// 其它 err 都算失败. 可以在 init 中覆盖.
+var IsFailure func(err error) bool
+
+func isFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if IsFailure != nil {
+		return IsFailure(err)
+	}
+	var e interface{ Code() uint32 }
+	return !errors.As(err, &e)
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < breakerFailThreshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+
+	// 半开状态, 只放一个请求去探测
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) report(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= breakerFailThreshold {
+		b.openUntil = time.Now().Add(breakerCoolDown)
+	}
+}
+
+var breaker = &circuitBreaker{}
+
+// callOnce 超时后立即返回. rpc.ClientCall 不能取消, 超时的调用会在后台结束,
+// 所以每次用独立的 rsp, 成功后再拷贝回去, 不会改写调用方已经放弃的结果
+func callOnce(ctx *rpc.Context, path string, timeout time.Duration, req, rsp interface{}) error {
+	if timeout <= 0 {
+		return rpc.ClientCall(ctx, ServiceName, path, req, rsp)
+	}
+
+	tmp := reflect.New(reflect.TypeOf(rsp).Elem())
+	done := make(chan error, 1)
+	go func() {
+		done <- rpc.ClientCall(ctx, ServiceName, path, req, tmp.Interface())
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			reflect.ValueOf(rsp).Elem().Set(tmp.Elem())
+		}
 		return err
+	case <-timer.C:
+		return fmt.Errorf("%%s %%s: %%w after %%v", ServiceName, path, ErrTimeout, timeout)
 	}
-	if len(header) > 0 {
-		if _, err := f.Write([]byte(header)); err != nil {
-			return err
+}
+
+func clientCall(ctx *rpc.Context, path string, req, rsp interface{}) error {
+	p := path2Policy[path]
+	if p == nil {
+		p = &callPolicy{}
+	}
+
+	if !breaker.allow() {
+		return ErrCircuitOpen
+	}
+
+	attempts := 1
+	if p.Idempotent {
+		attempts += p.Retry
+	}
+
+	var err error
+	backoff := retryBackoffBase
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+			backoff *= 2
+			if backoff > retryBackoffMax {
+				backoff = retryBackoffMax
+			}
+		}
+
+		err = callOnce(ctx, path, p.Timeout, req, rsp)
+		if !isFailure(err) {
+			break
 		}
 	}
-	if _, err := f.Write([]byte(context)); err != nil {
-		return err
+
+	breaker.report(isFailure(err))
+	return err
+}
+`
+
+func generateClientPolicy(PD *ProtoDetect, rootDir string) error {
+	fn := GetTargetFileName(*PD, "client_policy", rootDir)
+
+	var policyList []string
+	for _, v := range PD.RpcList {
+		policyList = append(policyList, fmt.Sprintf(
+			"\t%sCMDPath: {Timeout: %d * time.Millisecond, Idempotent: %v, Retry: %d},",
+			v.MethodName, v.TimeoutMs, v.Idempotent, v.Retry))
 	}
-	if err := f.Close(); err != nil {
+
+	context := fmt.Sprintf(
+		clientPolicyTemp, PD.PackageName, strings.Join(policyList, "\n"))
+
+	err := ioutil.WriteFile(fn, []byte(context), 0644)
+	if err != nil {
+		log.Errorf("can not generate file %s, err %v", fn, err)
 		return err
 	}
 	return nil
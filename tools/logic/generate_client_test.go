@@ -0,0 +1,159 @@
+package logic
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testClientPD() *ProtoDetect {
+	PD := NewProtoDetect()
+	PD.PackageName = "shop"
+	PD.SvrName = "shop"
+	PD.GoPackageName = "shop"
+	PD.RpcList = []*RpcNode{
+		{MethodName: "Login", ReqType: "LoginReq", RspType: "LoginRsp", TimeoutMs: 300, Idempotent: true, Retry: 2},
+		{MethodName: "Logout", ReqType: "LogoutReq", RspType: "LogoutRsp"},
+	}
+	return PD
+}
+
+func TestGenerateClientPolicyGolden(t *testing.T) {
+	root := t.TempDir()
+	PD := testClientPD()
+	if err := GenerateClient(PD, root); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "client_policy", readGenerated(t, GetTargetFileName(*PD, "client_policy", root)))
+}
+
+func TestGenerateClientGolden(t *testing.T) {
+	root := t.TempDir()
+	PD := testClientPD()
+	if err := GenerateClient(PD, root); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "client", readGenerated(t, GetTargetFileName(*PD, "client", root)))
+
+	// 没有变化时重新生成结果不变
+	first := readGenerated(t, GetTargetFileName(*PD, "client", root))
+	if err := GenerateClient(testClientPD(), root); err != nil {
+		t.Fatal(err)
+	}
+	if again := readGenerated(t, GetTargetFileName(*PD, "client", root)); string(again) != string(first) {
+		t.Errorf("regenerate changed client file:\n%s", lineDiff(string(first), string(again)))
+	}
+}
+
+func TestMergeClientFile(t *testing.T) {
+	legacyLogin := `
+func Login(ctx *rpc.Context, req *LoginReq) (*LoginRsp, error) {
+	rsp := &LoginRsp{}
+	return rsp, rpc.ClientCall(ctx, ServiceName, LoginCMDPath, req, rsp)
+}
+`
+	cases := []struct {
+		name   string
+		src    string
+		rpcs   []*RpcNode
+		prune  bool
+		want   []string
+		absent []string
+	}{
+		{
+			name: "legacy func adopted into region",
+			src:  legacyLogin,
+			want: []string{
+				genRegionBegin + "client.Login ",
+				"return rsp, clientCall(ctx, LoginCMDPath, req, rsp)",
+				genRegionBegin + "client.Logout ",
+			},
+			absent: []string{"rpc.ClientCall"},
+		},
+		{
+			name: "signature drift regenerated",
+			src:  legacyLogin,
+			rpcs: []*RpcNode{{MethodName: "Login", ReqType: "SignInReq", RspType: "SignInRsp"}},
+			want: []string{
+				"func Login(ctx *rpc.Context, req *SignInReq) (*SignInRsp, error)",
+				"rsp := &SignInRsp{}",
+			},
+			absent: []string{"*LoginReq"},
+		},
+		{
+			name: "removed rpc marked deprecated",
+			src:  legacyLogin,
+			rpcs: []*RpcNode{{MethodName: "Logout", ReqType: "LogoutReq", RspType: "LogoutRsp"}},
+			want: []string{clientDeprecatedMark + "\nfunc Login("},
+		},
+		{
+			name:   "removed rpc pruned",
+			src:    legacyLogin,
+			rpcs:   []*RpcNode{{MethodName: "Logout", ReqType: "LogoutReq", RspType: "LogoutRsp"}},
+			prune:  true,
+			absent: []string{"func Login("},
+		},
+		{
+			name: "hand-written func kept",
+			src: `
+func Login(ctx *rpc.Context, req *LoginReq) (*LoginRsp, error) {
+	// 手写的实现
+	return nil, nil
+}
+`,
+			want:   []string{"// 手写的实现", genRegionBegin + "client.Logout "},
+			absent: []string{genRegionBegin + "client.Login "},
+		},
+		{
+			name: "unused managed import removed and user import kept",
+			src: `
+import (
+	"brick/rpc"
+	"fmt"
+	"strings"
+)
+
+func Helper() string { return fmt.Sprint(strings.ToUpper("x")) }
+`,
+			want:   []string{`"fmt"`, `"strings"`, `"brick/rpc"`, "func Helper() string"},
+			absent: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			PD := testClientPD()
+			if c.rpcs != nil {
+				PD.RpcList = c.rpcs
+			}
+			PruneRemovedRpc = c.prune
+			defer func() { PruneRemovedRpc = false }()
+
+			fn := filepath.Join(t.TempDir(), "shopclient.go")
+			src := c.src
+			if !strings.Contains(src, "import (") {
+				src = "\nimport \"brick/rpc\"\n" + src
+			}
+			if err := ioutil.WriteFile(fn, []byte("package shop\n"+src), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := mergeClientFile(PD, fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := string(out)
+			for _, w := range c.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("missing %q in\n%s", w, got)
+				}
+			}
+			for _, a := range c.absent {
+				if strings.Contains(got, a) {
+					t.Errorf("unexpected %q in\n%s", a, got)
+				}
+			}
+		})
+	}
+}
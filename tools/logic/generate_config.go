@@ -0,0 +1,705 @@
+package logic
+
+import (
+	"brick/log"
+	"bufio"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configTemp 作为生成区域写入 impl/<svr>cfg.go, 和 GenerateLogicCfg 生成的代码放在一起
+var configTemp = `// 配置来自 {{Svr}}.toml 的 [config], 由 proto 中的 message {{Type}} 生成.
+// 环境变量 {{ENV}}_<字段> 覆盖非 repeated 的字段, 嵌套的 message 为 {{ENV}}_<字段>_<子字段>,
+// repeated string 用逗号分隔
+var (
+	{{Var}}Value atomic.Value
+	{{Var}}Once  sync.Once
+	{{Var}}Mu    sync.Mutex
+	{{Var}}Hooks []func(old, cur *{{Type}})
+)
+
+// {{Type}}File 配置文件路径, 和 server 一样由 {{ENV}}_CONF 指定, 默认 {{Svr}}.toml
+func {{Type}}File() string {
+	if fn := os.Getenv("{{ENV}}_CONF"); fn != "" {
+		return fn
+	}
+	return "{{Svr}}.toml"
+}
+
+{{Types}}
+
+// Load{{Type}} 读取 fn 中的 [config], 依次使用默认值, 配置文件, 环境变量, 最后校验
+func Load{{Type}}(fn string) (*{{Type}}, error) {
+	c := new{{Type}}()
+	if _, err := os.Stat(fn); err == nil {
+		conf := struct {
+			Config *{{Type}} ` + "`toml:\"config\"`" + `
+		}{c}
+		md, err := toml.DecodeFile(fn, &conf)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s err %v", fn, err)
+		}
+		for _, k := range md.Undecoded() {
+			if len(k) > 0 && k[0] == "config" {
+				log.Warnf("%s: unknown config key %s", fn, k)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := c.applyEnv("{{ENV}}"); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return c, nil
+}
+
+// Current{{Type}} 返回当前配置. 不经过 server 的 initConfig 时, 第一次调用从 {{Type}}File() 加载,
+// 加载失败时使用默认配置. 重新加载时整体替换, 不要修改返回的配置
+func Current{{Type}}() *{{Type}} {
+	if c, ok := {{Var}}Value.Load().(*{{Type}}); ok {
+		return c
+	}
+	{{Var}}Once.Do(func() {
+		c, err := Load{{Type}}({{Type}}File())
+		if err != nil {
+			log.Errorf("load config err %v, use default", err)
+			c = new{{Type}}()
+		}
+		{{Var}}Mu.Lock()
+		if _, ok := {{Var}}Value.Load().(*{{Type}}); !ok {
+			{{Var}}Value.Store(c)
+		}
+		{{Var}}Mu.Unlock()
+	})
+	return {{Var}}Value.Load().(*{{Type}})
+}
+
+// On{{Type}}Change 注册配置重新加载后的回调, 回调在检查文件的 goroutine 中依次执行
+func On{{Type}}Change(f func(old, cur *{{Type}})) {
+	{{Var}}Mu.Lock()
+	{{Var}}Hooks = append({{Var}}Hooks, f)
+	{{Var}}Mu.Unlock()
+}
+
+// Init{{Type}} 加载配置, reload > 0 时按这个间隔检查文件, 修改后重新加载, 加载失败时保留原来的配置
+func Init{{Type}}(fn string, reload time.Duration) error {
+	c, err := Load{{Type}}(fn)
+	if err != nil {
+		return err
+	}
+	{{Var}}Mu.Lock()
+	{{Var}}Value.Store(c)
+	{{Var}}Mu.Unlock()
+	if reload > 0 {
+		go watch{{Type}}(fn, reload)
+	}
+	return nil
+}
+
+func watch{{Type}}(fn string, reload time.Duration) {
+	stat := func() string {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size())
+	}
+
+	last := stat()
+	for range time.Tick(reload) {
+		cur := stat()
+		if cur == last {
+			continue
+		}
+		last = cur
+
+		c, err := Load{{Type}}(fn)
+		if err != nil {
+			log.Errorf("reload config err %v, keep the old one", err)
+			continue
+		}
+		old := Current{{Type}}()
+		{{Var}}Value.Store(c)
+		log.Infof("config %s reloaded", fn)
+
+		{{Var}}Mu.Lock()
+		hooks := {{Var}}Hooks
+		{{Var}}Mu.Unlock()
+		for _, f := range hooks {
+			f(old, c)
+		}
+	}
+}
+
+func configEnv(name string, set func(s string) error) error {
+	s, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	if err := set(s); err != nil {
+		return fmt.Errorf("env %s=%q: %v", name, s, err)
+	}
+	return nil
+}
+`
+
+var serverConfigTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package main
+
+import (
+	"time"
+	{{Import}}
+)
+
+// initConfig 在 onInit 之前加载 impl 的配置
+func initConfig(fn string, reload time.Duration) error {
+	{{Body}}
+}
+`
+
+type configWriter struct {
+	validateWriter
+
+	msgs []*PbMsg
+	seen map[*PbMsg]bool
+}
+
+// configGoType 配置字段的 Go 类型, 不支持的类型返回空
+func configGoType(f *PbField) string {
+	scalar := func(t string) string {
+		switch t {
+		case "string", "bool":
+			return t
+		case "int32", "sint32", "sfixed32":
+			return "int32"
+		case "int64", "sint64", "sfixed64":
+			return "int64"
+		case "uint32", "fixed32":
+			return "uint32"
+		case "uint64", "fixed64":
+			return "uint64"
+		case "float":
+			return "float32"
+		case "double":
+			return "float64"
+		}
+		return ""
+	}
+
+	if f.MapField != nil {
+		k, v := scalar(f.MapField.KeyType), scalar(f.GetType())
+		if k == "" || v == "" {
+			return ""
+		}
+		return "map[" + k + "]" + v
+	}
+	t := scalar(f.GetType())
+	if f.Msg != nil {
+		t = "*" + GoMsgName(f.Msg)
+	}
+	if t == "" {
+		return ""
+	}
+	if f.IsRepeated() {
+		return "[]" + t
+	}
+	return t
+}
+
+// configComment 字段注释, 去掉 @default 行
+func configComment(f *PbField) ([]string, string, bool) {
+	c := f.GetPbComment()
+	if c == nil {
+		return nil, "", false
+	}
+	var lines []string
+	var def string
+	var ok bool
+	for _, l := range c.Lines {
+		s := strings.TrimSpace(l)
+		if strings.HasPrefix(s, "@default:") {
+			def, ok = strings.TrimSpace(strings.TrimPrefix(s, "@default:")), true
+		} else if s != "" {
+			lines = append(lines, s)
+		}
+	}
+	return lines, def, ok
+}
+
+// configLiteral 把 @default 的值转成 Go 和 toml 的字面量
+func configLiteral(f *PbField, typ, def string) (string, string, error) {
+	elem := strings.TrimPrefix(typ, "[]")
+	one := func(s string) (string, string, error) {
+		s = strings.TrimSpace(s)
+		in := s
+		var err error
+		switch elem {
+		case "string":
+			if u, e := strconv.Unquote(s); e == nil {
+				s = u
+			}
+			return strconv.Quote(s), tomlQuote(s), nil
+		case "bool":
+			var v bool
+			v, err = strconv.ParseBool(s)
+			s = strconv.FormatBool(v)
+		case "float32", "float64":
+			// 重新格式化, 去掉 .5, 1. 这类 toml 不支持的写法
+			var v float64
+			v, err = strconv.ParseFloat(s, 64)
+			if err == nil && (math.IsInf(v, 0) || math.IsNaN(v)) {
+				err = fmt.Errorf("not finite")
+			}
+			s = strconv.FormatFloat(v, 'g', -1, 64)
+			if !strings.ContainsAny(s, ".e") {
+				s += ".0"
+			}
+		case "uint32", "uint64":
+			// 007 在 Go 中是八进制, 在 toml 中不合法, 统一写成十进制
+			var v uint64
+			v, err = strconv.ParseUint(s, 10, 64)
+			s = strconv.FormatUint(v, 10)
+		default:
+			var v int64
+			v, err = strconv.ParseInt(s, 10, 64)
+			s = strconv.FormatInt(v, 10)
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("invalid @default %s for %s", in, elem)
+		}
+		return s, s, nil
+	}
+
+	if !f.IsRepeated() {
+		return one(def)
+	}
+	var goList, tomlList []string
+	for _, x := range strings.Split(def, ",") {
+		if strings.TrimSpace(x) == "" {
+			continue
+		}
+		g, t, err := one(x)
+		if err != nil {
+			return "", "", err
+		}
+		goList = append(goList, g)
+		tomlList = append(tomlList, t)
+	}
+	return typ + "{" + strings.Join(goList, ", ") + "}", "[" + strings.Join(tomlList, ", ") + "]", nil
+}
+
+// tomlQuote 生成 toml 的基本字符串, 只使用 toml 支持的转义, 其它控制字符写成 \uXXXX
+func tomlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func configZero(typ string) string {
+	switch {
+	case typ == "string":
+		return `""`
+	case typ == "bool":
+		return "false"
+	case strings.HasPrefix(typ, "[]"):
+		return "[]"
+	}
+	return "0"
+}
+
+// check 找出 m 引用的所有 message, 检查字段类型
+func (p *configWriter) check(m *PbMsg, path []string) error {
+	if p.seen[m] {
+		for _, x := range path {
+			if x == m.FullName {
+				return fmt.Errorf("config message %s refers to itself", m.FullName)
+			}
+		}
+		return nil
+	}
+	p.seen[m] = true
+	p.msgs = append(p.msgs, m)
+
+	for _, f := range m.Fields {
+		if configGoType(f) == "" {
+			return fmt.Errorf("%s.%s: type %s not supported in config", m.FullName, f.GetName(), f.GetType())
+		}
+		if err := CheckFieldRules(f); err != nil {
+			return fmt.Errorf("%s.%s: %v", m.FullName, f.GetName(), err)
+		}
+		if _, def, ok := configComment(f); ok {
+			if f.Msg != nil || f.MapField != nil {
+				return fmt.Errorf("%s.%s: @default only for scalar fields", m.FullName, f.GetName())
+			}
+			if _, _, err := configLiteral(f, configGoType(f), def); err != nil {
+				return fmt.Errorf("%s.%s: %v", m.FullName, f.GetName(), err)
+			}
+		}
+		if f.Msg != nil {
+			if err := p.check(f.Msg, append(path, m.FullName)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *configWriter) writeType(m *PbMsg) {
+	name := GoMsgName(m)
+	var defaults []string
+
+	p.out(0, "type %s struct {", name)
+	for _, f := range m.Fields {
+		typ := configGoType(f)
+		lines, def, ok := configComment(f)
+		for _, l := range lines {
+			p.out(1, "// %s", l)
+		}
+		p.out(1, "%s %s `toml:%q`", goCamelCase(f.GetName()), typ, f.GetName())
+
+		if ok {
+			g, _, _ := configLiteral(f, typ, def)
+			defaults = append(defaults, fmt.Sprintf("%s: %s,", goCamelCase(f.GetName()), g))
+		} else if f.Msg != nil && !f.IsRepeated() {
+			defaults = append(defaults, fmt.Sprintf("%s: new%s(),", goCamelCase(f.GetName()), GoMsgName(f.Msg)))
+		}
+	}
+	p.out(0, "}")
+	p.out(0, "")
+
+	p.out(0, "func new%s() *%s {", name, name)
+	p.out(1, "return &%s{", name)
+	for _, x := range defaults {
+		p.out(2, "%s", x)
+	}
+	p.out(1, "}")
+	p.out(0, "}")
+	p.out(0, "")
+
+	p.out(0, "func (m *%s) applyEnv(prefix string) error {", name)
+	for _, f := range m.Fields {
+		p.envField(f)
+	}
+	p.out(1, "return nil")
+	p.out(0, "}")
+	p.out(0, "")
+
+	p.out(0, "// Validate 检查 (ext.rules) 中声明的字段规则")
+	p.out(0, "func (m *%s) Validate() error {", name)
+	p.out(1, "if m == nil {")
+	p.out(2, "return nil")
+	p.out(1, "}")
+	for _, f := range m.Fields {
+		p.field(m, f)
+	}
+	p.out(1, "return nil")
+	p.out(0, "}")
+	p.out(0, "")
+}
+
+// configConv strconv 解析出的 v 转成字段类型
+func configConv(typ, parsed string) string {
+	if typ == parsed {
+		return "v"
+	}
+	return typ + "(v)"
+}
+
+func (p *configWriter) envField(f *PbField) {
+	field := "m." + goCamelCase(f.GetName())
+	env := fmt.Sprintf("prefix+%q", "_"+envName(f.GetName()))
+	typ := configGoType(f)
+
+	if f.Msg != nil {
+		if !f.IsRepeated() {
+			p.out(1, "if err := %s.applyEnv(%s); err != nil {", field, env)
+			p.out(2, "return err")
+			p.out(1, "}")
+		}
+		return
+	}
+
+	var parse string
+	switch typ {
+	case "string":
+		parse = fmt.Sprintf("%s = s\n\t\treturn nil", field)
+	case "[]string":
+		parse = fmt.Sprintf("%s = strings.Split(s, \",\")\n\t\treturn nil", field)
+	case "bool":
+		parse = fmt.Sprintf("v, err := strconv.ParseBool(s)\n\t\t%s = v\n\t\treturn err", field)
+	case "int32", "int64":
+		parse = fmt.Sprintf("v, err := strconv.ParseInt(s, 10, %s)\n\t\t%s = %s\n\t\treturn err", typ[3:], field, configConv(typ, "int64"))
+	case "uint32", "uint64":
+		parse = fmt.Sprintf("v, err := strconv.ParseUint(s, 10, %s)\n\t\t%s = %s\n\t\treturn err", typ[4:], field, configConv(typ, "uint64"))
+	case "float32", "float64":
+		parse = fmt.Sprintf("v, err := strconv.ParseFloat(s, %s)\n\t\t%s = %s\n\t\treturn err", typ[5:], field, configConv(typ, "float64"))
+	default:
+		// map 和其它 repeated 字段只能在配置文件中修改
+		return
+	}
+	p.out(1, "if err := configEnv(%s, func(s string) error {", env)
+	p.out(2, "%s", parse)
+	p.out(1, "}); err != nil {")
+	p.out(2, "return err")
+	p.out(1, "}")
+}
+
+// configToml 生成 [config] 的默认内容, 嵌套的 message 为子表
+func configToml(m *PbMsg, table string) string {
+	var lines, subs []string
+	lines = append(lines, "", "["+table+"]")
+	for _, f := range m.Fields {
+		name := f.GetName()
+		comments, def, ok := configComment(f)
+		if f.Msg != nil || f.MapField != nil {
+			switch {
+			case f.MapField != nil:
+				subs = append(subs, "", "["+table+"."+name+"]")
+			case f.IsRepeated():
+				subs = append(subs, "", "# [["+table+"."+name+"]]")
+			default:
+				subs = append(subs, configToml(f.Msg, table+"."+name))
+			}
+			continue
+		}
+		for _, c := range comments {
+			lines = append(lines, "# "+c)
+		}
+		v := configZero(configGoType(f))
+		if ok {
+			_, v, _ = configLiteral(f, configGoType(f), def)
+		}
+		lines = append(lines, fmt.Sprintf("%s = %s", name, v))
+	}
+	return strings.Join(append(lines, subs...), "\n")
+}
+
+// tomlKeys 读取 toml 中每个表的 key, 用于提示新加的配置
+func tomlKeys(fn string) (map[string]bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]bool)
+	table := ""
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[["):
+			table = strings.Trim(line, "[] ")
+			keys[table] = true
+		case strings.HasPrefix(line, "["):
+			table = strings.Trim(line, "[] ")
+			keys[table] = true
+		default:
+			if i := strings.Index(line, "="); i > 0 {
+				keys[table+"."+strings.TrimSpace(line[:i])] = true
+			}
+		}
+	}
+	return keys, s.Err()
+}
+
+func missingConfigKeys(m *PbMsg, table string, keys map[string]bool) []string {
+	var list []string
+	for _, f := range m.Fields {
+		key := table + "." + f.GetName()
+		if f.Msg != nil && !f.IsRepeated() {
+			list = append(list, missingConfigKeys(f.Msg, key, keys)...)
+		} else if f.Msg == nil && f.MapField == nil && !keys[key] {
+			list = append(list, key)
+		}
+	}
+	return list
+}
+
+// findConfigMsg 配置 message 命名为 <Svr>Config, 如 user_svr 为 UserSvrConfig
+func findConfigMsg(PD *ProtoDetect, msgs []*PbMsg) *PbMsg {
+	want := strings.ToLower(strings.Replace(PD.SvrName, "_", "", -1)) + "config"
+	for _, m := range msgs {
+		if m.FullName == m.Name && strings.ToLower(m.Name) == want {
+			return m
+		}
+	}
+	return nil
+}
+
+// 配置区域可能用到的 import, 由 fixImports 按实际引用增删
+var configImports = []string{"brick/log", "errors", "fmt", "os", "regexp", "strconv", "strings", "sync", "sync/atomic",
+	"time", "unicode/utf8", "github.com/BurntSushi/toml"}
+
+// GenerateLogicConfig 由 message <Svr>Config 生成配置结构和加载函数, 作为生成区域 config 写入
+// GenerateLogicCfg 生成的 impl/<svr>cfg.go, 区域之外的代码不变; 同时生成 server 中的 initConfig.
+// conf 中还没有 [config] 时追加默认配置, 已有时提示缺少的字段
+func GenerateLogicConfig(PD *ProtoDetect, msgs []*PbMsg, rootDir string) error {
+	fn := GetTargetFileName(*PD, "logic_cfg", rootDir)
+	implDir := filepath.Dir(fn)
+
+	var src []byte
+	if FileExists(fn) {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		src = b
+	}
+
+	m := findConfigMsg(PD, msgs)
+	if m == nil {
+		if src != nil {
+			if err := writeConfigRegion(fn, src, nil); err != nil {
+				return err
+			}
+		}
+		return generateServerConfig(PD, rootDir, nil, "")
+	}
+
+	w := &configWriter{seen: make(map[*PbMsg]bool)}
+	if err := w.check(m, nil); err != nil {
+		return err
+	}
+	for _, x := range w.msgs {
+		w.writeType(x)
+	}
+
+	body := w.buf.String()
+	if len(w.patterns) > 0 {
+		body = "var (\n\t" + strings.Join(w.patterns, "\n\t") + "\n)\n\n" + body
+	}
+
+	typ := GoMsgName(m)
+	r := strings.NewReplacer(
+		"{{Svr}}", PD.SvrName,
+		"{{ENV}}", envName(PD.SvrName),
+		"{{Type}}", typ,
+		"{{Var}}", lowerFirst(typ),
+		"{{Types}}", body,
+	)
+	if src == nil {
+		src = []byte(fmt.Sprintf("package %s\n", implPackageName(implDir)))
+	}
+	err := writeConfigRegion(fn, src, &GenRegion{Name: "config", Body: r.Replace(configTemp)})
+	if err != nil {
+		return err
+	}
+
+	err = appendConfigToml(GetTargetFileName(*PD, "conf", rootDir), m)
+	if err != nil {
+		return err
+	}
+	return generateServerConfig(PD, rootDir, m, implDir)
+}
+
+// writeConfigRegion 更新 cfg.go 中的生成区域 config, region 为 nil 时删除这个区域
+func writeConfigRegion(fn string, src []byte, region *GenRegion) error {
+	var out []byte
+	var conflicts []string
+	var err error
+	if region != nil {
+		out, conflicts, err = MergeGenRegions(src, []*GenRegion{region}, true)
+	} else {
+		out, conflicts, err = RemoveGenRegion(src, "config")
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	reportGenRegionConflicts(fn, conflicts)
+
+	out, err = fixImports(fn, out, configImports)
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+	return ioutil.WriteFile(fn, out, 0644)
+}
+
+func appendConfigToml(fn string, m *PbMsg) error {
+	keys, err := tomlKeys(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if keys["config"] {
+		for _, k := range missingConfigKeys(m, "config", keys) {
+			log.Warnf("%s: %s not set, default used", fn, k)
+		}
+		return nil
+	}
+
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, configToml(m, "config"))
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		log.Infof("append [config] to %s", fn)
+	}
+	return err
+}
+
+func generateServerConfig(PD *ProtoDetect, rootDir string, m *PbMsg, implDir string) error {
+	fn := GetTargetFileName(*PD, "server_config", rootDir)
+
+	imp, body := "", "return nil"
+	if m != nil {
+		pkg := implPackageName(implDir)
+		imp = strconv.Quote(PD.GoPackageName + "/impl")
+		if pkg != "impl" {
+			imp = pkg + " " + imp
+		}
+		body = fmt.Sprintf("return %s.Init%s(fn, reload)", pkg, GoMsgName(m))
+	}
+
+	r := strings.NewReplacer("{{Import}}", imp, "{{Body}}", body)
+	context := r.Replace(serverConfigTemp)
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+	return writeGenRegionFile(fn, src, "server.config")
+}
@@ -0,0 +1,147 @@
+package logic
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emicklei/proto"
+)
+
+func TestTomlQuote(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"", `""`},
+		{"a b", `"a b"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\tmp`, `"C:\\tmp"`},
+		{"a\tb\nc\r", `"a\tb\nc\r"`},
+		{"\x00\x1b\x7f", `"\u0000\u001B\u007F"`},
+		{"中文", `"中文"`},
+	}
+
+	for _, c := range cases {
+		if got := tomlQuote(c.in); got != c.want {
+			t.Errorf("tomlQuote(%q) = %s, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestConfigLiteral(t *testing.T) {
+	cases := []struct {
+		typ      string
+		repeated bool
+		def      string
+		goLit    string
+		tomlLit  string
+		err      bool
+	}{
+		{typ: "string", def: "abc", goLit: `"abc"`, tomlLit: `"abc"`},
+		{typ: "string", def: `"a\x1bb"`, goLit: `"a\x1bb"`, tomlLit: `"a\u001Bb"`},
+		{typ: "bool", def: "1", goLit: "true", tomlLit: "true"},
+		{typ: "int32", def: "007", goLit: "7", tomlLit: "7"},
+		{typ: "int64", def: "-12", goLit: "-12", tomlLit: "-12"},
+		{typ: "uint32", def: "-1", err: true},
+		{typ: "float64", def: ".5", goLit: "0.5", tomlLit: "0.5"},
+		{typ: "float32", def: "3", goLit: "3.0", tomlLit: "3.0"},
+		{typ: "float64", def: "inf", err: true},
+		{typ: "[]string", repeated: true, def: `a, "b,c`, goLit: `[]string{"a", "\"b", "c"}`, tomlLit: `["a", "\"b", "c"]`},
+		{typ: "[]int32", repeated: true, def: "1, 02,", goLit: "[]int32{1, 2}", tomlLit: "[1, 2]"},
+	}
+
+	for _, c := range cases {
+		f := &PbField{NormalField: &proto.NormalField{Field: &proto.Field{Name: "f"}, Repeated: c.repeated}}
+		g, tl, err := configLiteral(f, c.typ, c.def)
+		if c.err {
+			if err == nil {
+				t.Errorf("configLiteral(%s, %q) want err, got %s %s", c.typ, c.def, g, tl)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("configLiteral(%s, %q) err %v", c.typ, c.def, err)
+			continue
+		}
+		if g != c.goLit || tl != c.tomlLit {
+			t.Errorf("configLiteral(%s, %q) = %s %s, want %s %s", c.typ, c.def, g, tl, c.goLit, c.tomlLit)
+		}
+	}
+}
+
+const testConfigProto = `syntax = "proto3";
+package shop;
+
+message Upstream {
+  string name = 1 [(ext.rules).required = true];
+  // @default: 3
+  uint32 retry = 2;
+}
+
+message ShopConfig {
+  // 监听地址
+  // @default: "0.0.0.0:8080"
+  string listen = 1;
+  // @default: 0.5
+  float ratio = 2;
+  // @default: a,b
+  repeated string tags = 3;
+  Upstream upstream = 4;
+}
+`
+
+const testConfigCfg = `package impl
+
+import "fmt"
+
+// Hello 用户代码
+func Hello() string {
+	return fmt.Sprint("hello")
+}
+`
+
+func TestGenerateLogicConfigGolden(t *testing.T) {
+	snap := parseTestMsgs(t, testConfigProto)
+	PD := snap.PD
+	PD.GoPackageName = "shop"
+	root := t.TempDir()
+
+	cfg := GetTargetFileName(*PD, "logic_cfg", root)
+	if err := ioutil.WriteFile(cfg, []byte(testConfigCfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := GetTargetFileName(*PD, "conf", root)
+	if err := ioutil.WriteFile(conf, []byte("[server]\naddr = \":8080\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := GenerateLogicConfig(PD, snap.Msgs, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := readGenerated(t, cfg)
+	checkGolden(t, "logic_config", got)
+	if !strings.Contains(string(got), "func Hello() string") {
+		t.Error("user code in cfg.go lost")
+	}
+	if svr := string(readGenerated(t, GetTargetFileName(*PD, "server_config", root))); !strings.Contains(svr, "impl.InitShopConfig(fn, reload)") {
+		t.Errorf("initConfig not calling impl\n%s", svr)
+	}
+	toml := string(readGenerated(t, conf))
+	if n := strings.Count(toml, "[config]"); n != 1 || !strings.Contains(toml, `listen = "0.0.0.0:8080"`) {
+		t.Errorf("unexpected [config] in conf\n%s", toml)
+	}
+
+	// 去掉配置 message 后删除生成区域, 只留下用户代码
+	if err := GenerateLogicConfig(PD, nil, root); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(testConfigCfg, `import "fmt"`, "import (\n\t\"fmt\"\n)", 1)
+	if got := string(readGenerated(t, cfg)); got != want {
+		t.Errorf("config region not removed:\n%s", lineDiff(want, got))
+	}
+	if svr := string(readGenerated(t, GetTargetFileName(*PD, "server_config", root))); strings.Contains(svr, "impl.") {
+		t.Errorf("initConfig still calling impl\n%s", svr)
+	}
+}
@@ -3,13 +3,158 @@ package logic
 import (
 	"brick/log"
 	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/importer"
+	"go/token"
+	"go/types"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// AllowDefChange 为 true 时, 允许 proto 修改已有 rpc 的 CmdID 或 url
+var AllowDefChange bool
+
+const defCmdIDSuffix = ".CmdID"
+
+// parseDefFile 读取已有 def 文件中的常量和 Path2CmdID, 结果放到 PD.SvrDef:
+//
+//	XxxCMDPath       -> "\"/pkg/Xxx\""
+//	XxxCMDPath.CmdID -> "3"
+//
+// 常量通过 go/types 求值, iota/表达式/带类型的常量都支持, 求不出值的 CmdID 记为空字符串
+func parseDefFile(PD *ProtoDetect, fSet *token.FileSet, f *ast.File) {
+	conf := types.Config{
+		Importer: importer.Default(),
+		// def 文件可能引用包内其它文件的符号, 忽略类型错误, 能求值的常量照样拿到
+		Error: func(err error) {},
+	}
+	info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+	pkg, _ := conf.Check(f.Name.Name, fSet, []*ast.File{f}, info)
+	if pkg == nil {
+		return
+	}
+
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		if c, ok := scope.Lookup(name).(*types.Const); ok && c.Val().Kind() != constant.Unknown {
+			PD.SvrDef[name] = c.Val().ExactString()
+		}
+	}
+
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			vs, ok := spec.(*ast.ValueSpec)
+			if !ok {
+				continue
+			}
+			for i, id := range vs.Names {
+				if id.Name != "Path2CmdID" || i >= len(vs.Values) {
+					continue
+				}
+				lit, ok := vs.Values[i].(*ast.CompositeLit)
+				if !ok {
+					continue
+				}
+				for _, elt := range lit.Elts {
+					kv, ok := elt.(*ast.KeyValueExpr)
+					if !ok {
+						continue
+					}
+					key, ok := kv.Key.(*ast.Ident)
+					if !ok {
+						log.Warnf("%s: Path2CmdID key %s is not a CMDPath constant, skip it",
+							fSet.Position(kv.Pos()), types.ExprString(kv.Key))
+						continue
+					}
+					// 求不出值时记为空, 由 checkDefCompat 报告, 不能当作没有这个 rpc
+					v := ""
+					if tv := info.Types[kv.Value]; tv.Value != nil && tv.Value.Kind() != constant.Unknown {
+						v = tv.Value.ExactString()
+					}
+					PD.SvrDef[key.Name+defCmdIDSuffix] = v
+				}
+			}
+		}
+	}
+}
+
+func rpcPath(PD ProtoDetect, node *RpcNode) string {
+	url := node.Url
+	if url == "" {
+		return fmt.Sprintf("/%s/%s", PD.PackageName, node.MethodName)
+	}
+	if !strings.HasPrefix(url, "/") {
+		url = "/" + url
+	}
+	return url
+}
+
+// checkDefCompat 对比已有 def 文件, 找出会被悄悄改号或改路径的 rpc
+func checkDefCompat(PD ProtoDetect) []string {
+	var problems []string
+
+	oldCmdID2Path := make(map[string]string)
+	for k, v := range PD.SvrDef {
+		if !strings.HasSuffix(k, defCmdIDSuffix) {
+			continue
+		}
+		if v == "" {
+			problems = append(problems, fmt.Sprintf(
+				"CmdID of `%s` is not a constant, can not check it", strings.TrimSuffix(k, defCmdIDSuffix)))
+			continue
+		}
+		oldCmdID2Path[v] = strings.TrimSuffix(k, defCmdIDSuffix)
+	}
+
+	for _, v := range PD.RpcList {
+		name := v.MethodName + "CMDPath"
+
+		if old, ok := PD.SvrDef[name]; ok {
+			oldPath, err := strconv.Unquote(old)
+			if err == nil && oldPath != rpcPath(PD, v) {
+				problems = append(problems, fmt.Sprintf(
+					"rpc `%s` path changed from %s to %s", v.MethodName, oldPath, rpcPath(PD, v)))
+			}
+		}
+
+		if old, ok := PD.SvrDef[name+defCmdIDSuffix]; ok && old != "" && old != v.CmdID {
+			problems = append(problems, fmt.Sprintf(
+				"rpc `%s` CmdID changed from %s to %s", v.MethodName, old, v.CmdID))
+		}
+
+		if owner, ok := oldCmdID2Path[v.CmdID]; ok && owner != name && v.CmdID != "0" {
+			problems = append(problems, fmt.Sprintf(
+				"rpc `%s` reuses CmdID %s which belonged to %s", v.MethodName, v.CmdID, owner))
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
+
 func GenerateDef(PD ProtoDetect, rootDir string) error {
 	fn := GetTargetFileName(PD, "def", rootDir)
 
+	if FileExists(fn) {
+		ParseGoCode(&PD, fn, "def")
+		problems := checkDefCompat(PD)
+		for _, p := range problems {
+			log.Warnf("%s: %s", fn, p)
+		}
+		if len(problems) > 0 && !AllowDefChange {
+			return fmt.Errorf(
+				"%d change(s) would renumber or re-path existing rpc, use -allow_def_change 1 if intended",
+				len(problems))
+		}
+	}
+
 	var cmdList []string
 	var path2CmdIDList []string
 	var cmdID2PathList []string
@@ -18,18 +163,9 @@ func GenerateDef(PD ProtoDetect, rootDir string) error {
 		methodName := PD.RpcList[i].MethodName
 		cmdID := PD.RpcList[i].CmdID
 		path := methodName + "CMDPath"
-		url := PD.RpcList[i].Url
 		flags := PD.RpcList[i].Flags
-		var cmd string
 
-		if url == "" {
-			cmd = fmt.Sprintf("\t%s = \"/%s/%s\"", path, PD.PackageName, methodName)
-		} else {
-			if !strings.HasPrefix(url, "/") {
-				url = "/" + url
-			}
-			cmd = fmt.Sprintf("\t%s = \"%s\"", path, url)
-		}
+		cmd := fmt.Sprintf("\t%s = \"%s\"", path, rpcPath(PD, PD.RpcList[i]))
 		cmdList = append(cmdList, cmd)
 
 		path2CmdId := fmt.Sprintf("\t%s: %s,", path, cmdID)
@@ -59,11 +195,15 @@ var CmdID2Path = map[int]string{
 %s
 }
 
+var Path2Flags = map[string]uint32{
+%s
+}
 `
 	context := fmt.Sprintf(
 		temp, PD.PackageName, PD.SvrName, rpcDef,
 		strings.Join(path2CmdIDList, "\n"),
-		strings.Join(cmdID2PathList, "\n"))
+		strings.Join(cmdID2PathList, "\n"),
+		strings.Join(path2FlagsList, "\n"))
 
 	f, err := os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
@@ -0,0 +1,85 @@
+package logic
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDefFile = `package shop
+
+const (
+	SvrName = "shop"
+	LoginCMDPath  = "/shop/Login"
+	LogoutCMDPath = "/shop/Logout"
+)
+
+const (
+	Base = 10
+	Next = iota + Base
+)
+
+var Path2CmdID = map[string]int{
+	LoginCMDPath:  %s,
+	LogoutCMDPath: %s,
+}
+`
+
+func TestCheckDefCompat(t *testing.T) {
+	cases := []struct {
+		name     string
+		login    string
+		logout   string
+		rpc      []*RpcNode
+		problems []string
+	}{
+		{
+			name: "unchanged", login: "1", logout: "2",
+			rpc: []*RpcNode{{MethodName: "Login", CmdID: "1"}, {MethodName: "Logout", CmdID: "2"}},
+		},
+		{
+			name: "cmd id changed", login: "1", logout: "2",
+			rpc:      []*RpcNode{{MethodName: "Login", CmdID: "3"}, {MethodName: "Logout", CmdID: "2"}},
+			problems: []string{"rpc `Login` CmdID changed from 1 to 3"},
+		},
+		{
+			name: "path changed", login: "1", logout: "2",
+			rpc:      []*RpcNode{{MethodName: "Login", CmdID: "1", Url: "v2/login"}, {MethodName: "Logout", CmdID: "2"}},
+			problems: []string{"rpc `Login` path changed from /shop/Login to /v2/login"},
+		},
+		{
+			name: "cmd id reused", login: "1", logout: "2",
+			rpc:      []*RpcNode{{MethodName: "Logout", CmdID: "2"}, {MethodName: "Register", CmdID: "1"}},
+			problems: []string{"rpc `Register` reuses CmdID 1 which belonged to LoginCMDPath"},
+		},
+		{
+			name: "expressions", login: "Base + 2", logout: "int(Next)",
+			rpc:      []*RpcNode{{MethodName: "Login", CmdID: "12"}, {MethodName: "Logout", CmdID: "13"}},
+			problems: []string{"rpc `Logout` CmdID changed from 11 to 13"},
+		},
+		{
+			name: "not constant", login: "1", logout: "len(SvrName) + undefined",
+			rpc:      []*RpcNode{{MethodName: "Login", CmdID: "1"}, {MethodName: "Logout", CmdID: "2"}},
+			problems: []string{"CmdID of `LogoutCMDPath` is not a constant, can not check it"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "def.go")
+			src := strings.Replace(strings.Replace(testDefFile, "%s", c.login, 1), "%s", c.logout, 1)
+			if err := ioutil.WriteFile(fn, []byte(src), 0644); err != nil {
+				t.Fatal(err)
+			}
+			PD := testClientPD()
+			PD.RpcList = c.rpc
+			ParseGoCode(PD, fn, "def")
+
+			got := checkDefCompat(*PD)
+			if strings.Join(got, "\n") != strings.Join(c.problems, "\n") {
+				t.Errorf("got problems\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(c.problems, "\n"))
+			}
+		})
+	}
+}
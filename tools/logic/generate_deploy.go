@@ -0,0 +1,350 @@
+package logic
+
+import (
+	"brick/log"
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 部署方式
+const (
+	DeploySupervisor = "supervisor"
+	DeploySystemd    = "systemd"
+	DeployDocker     = "docker"
+	DeployK8s        = "k8s"
+)
+
+var deployFiles = map[string]string{
+	DeploySupervisor: "supervisor_conf",
+	DeploySystemd:    "systemd",
+	DeployDocker:     "dockerfile",
+	DeployK8s:        "k8s",
+}
+
+// deployHeader 生成的部署文件第一行, 没有这一行的是手写的, 不会覆盖, 选择或删除
+const deployHeader = "# Code generated by rpc_gen"
+
+// bootstrap 中 grpc 和 admin 没有默认地址, 不设置时不监听, 部署文件通过环境变量指定这两个端口;
+// 退出等待时间和 bootstrap 中 DRAIN_SECONDS, STOP_SECONDS 的默认值一致
+const (
+	deployGrpcPort     = 50051
+	deployAdminPort    = 9100
+	deployDrainSeconds = 5
+	deployStopSeconds  = 30
+)
+
+var systemdTemp = `# Code generated by rpc_gen. DO NOT EDIT.
+# 把可执行文件和 {{Svr}}.toml 放到 /opt/{{Svr}}, 复制本文件到 /etc/systemd/system/{{Svr}}.service, 然后
+#   systemctl daemon-reload && systemctl enable --now {{Svr}}
+[Unit]
+Description={{Svr}} rpc server
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+WorkingDirectory=/opt/{{Svr}}
+ExecStart=/opt/{{Svr}}/{{Svr}}
+Environment={{ENV}}_CONF=/opt/{{Svr}}/{{Svr}}.toml
+Environment={{ENV}}_ADMIN_ADDR=127.0.0.1:{{AdminPort}}
+Environment={{ENV}}_GRPC_ADDR=0.0.0.0:{{GrpcPort}}
+# 收到 SIGTERM 后先等待摘除流量再停止, 超时时间要大于 DRAIN_SECONDS + STOP_SECONDS
+KillSignal=SIGTERM
+TimeoutStopSec={{StopTimeout}}
+Restart=always
+RestartSec=3
+LimitNOFILE=65536
+
+[Install]
+WantedBy=multi-user.target
+`
+
+var dockerfileTemp = `# Code generated by rpc_gen. DO NOT EDIT.
+# 在项目根目录 (包含 src 的目录) 构建:
+#   docker build -f src/{{GoPkg}}/server/Dockerfile -t {{Name}} .
+ARG GO_VERSION=1.21
+
+FROM golang:${GO_VERSION} AS build
+ENV GOPATH=/go GO111MODULE=off CGO_ENABLED=0
+COPY src /go/src
+RUN go build -o /out/{{Svr}} {{GoPkg}}/server
+
+FROM alpine:3.19
+RUN apk add --no-cache ca-certificates tzdata
+WORKDIR /app
+COPY --from=build /out/{{Svr}} /app/{{Svr}}
+# 配置中有 db, redis 的地址和密码, 不打进镜像, 运行时挂载到 /app/conf:
+#   docker run -v $PWD/src/{{GoPkg}}/server/{{Svr}}.toml:/app/conf/{{Svr}}.toml {{Name}}
+ENV {{ENV}}_CONF=/app/conf/{{Svr}}.toml \
+    {{ENV}}_ADMIN_ADDR=0.0.0.0:{{AdminPort}} \
+    {{ENV}}_GRPC_ADDR=0.0.0.0:{{GrpcPort}}
+EXPOSE {{Ports}}
+HEALTHCHECK --interval=10s --timeout=3s CMD wget -q -O /dev/null http://127.0.0.1:{{AdminPort}}/healthz || exit 1
+STOPSIGNAL SIGTERM
+ENTRYPOINT ["/app/{{Svr}}"]
+`
+
+var k8sTemp = `# Code generated by rpc_gen. DO NOT EDIT.
+# 镜像由 server/Dockerfile 构建, 配置中有 db, redis 的地址和密码, 由使用者创建 Secret 挂载到 /app/conf:
+#   kubectl create secret generic {{Name}}-conf --from-file=server/{{Svr}}.toml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{Name}}
+  labels:
+    app: {{Name}}
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: {{Name}}
+  template:
+    metadata:
+      labels:
+        app: {{Name}}
+    spec:
+      # 大于 DRAIN_SECONDS + STOP_SECONDS, 保证处理中的请求能结束
+      terminationGracePeriodSeconds: {{StopTimeout}}
+      containers:
+        - name: {{Name}}
+          image: {{Name}}:latest
+          env:
+            - name: {{ENV}}_CONF
+              value: /app/conf/{{Svr}}.toml
+            - name: {{ENV}}_ADMIN_ADDR
+              value: 0.0.0.0:{{AdminPort}}
+            - name: {{ENV}}_GRPC_ADDR
+              value: 0.0.0.0:{{GrpcPort}}
+          ports:
+{{ContainerPorts}}
+          livenessProbe:
+            httpGet:
+              path: /healthz
+              port: admin
+            initialDelaySeconds: 5
+            periodSeconds: 10
+          # 由 server main 中的 runServer 在 brick/rpc 开始监听后报告就绪
+          readinessProbe:
+            httpGet:
+              path: /readyz
+              port: admin
+            periodSeconds: 5
+          volumeMounts:
+            - name: conf
+              mountPath: /app/conf
+      volumes:
+        - name: conf
+          secret:
+            secretName: {{Name}}-conf
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{Name}}
+spec:
+  selector:
+    app: {{Name}}
+  ports:
+{{ServicePorts}}
+`
+
+// deployGenerated 文件第一行是 deployHeader 时返回 true, 存在但不是生成的文件时提示
+func deployGenerated(fn string) bool {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	if s.Scan() && strings.HasPrefix(s.Text(), deployHeader) {
+		return true
+	}
+	log.Warnf("%s was not generated by rpc_gen, leave it alone", fn)
+	return false
+}
+
+// DeployTargets 解析 -deploy 参数, 没有指定时使用已经生成过的部署文件, 都没有时为 supervisor
+func DeployTargets(PD ProtoDetect, rootDir string, opt string) ([]string, error) {
+	var list []string
+	if opt == "" {
+		for _, x := range []string{DeploySupervisor, DeploySystemd, DeployDocker, DeployK8s} {
+			if deployGenerated(GetTargetFileName(PD, deployFiles[x], rootDir)) {
+				list = append(list, x)
+			}
+		}
+		if len(list) == 0 {
+			list = append(list, DeploySupervisor)
+		}
+		return list, nil
+	}
+
+	for _, x := range strings.Split(opt, ",") {
+		x = strings.TrimSpace(x)
+		if deployFiles[x] == "" {
+			return nil, fmt.Errorf("unknown deploy %s, should be %s, %s, %s or %s",
+				x, DeploySupervisor, DeploySystemd, DeployDocker, DeployK8s)
+		}
+		list = append(list, x)
+	}
+	return list, nil
+}
+
+// RemoveDeploy 删除没有选择的部署方式之前生成的文件, 在所选的部署文件都生成之后调用, 手写的文件保留
+func RemoveDeploy(PD ProtoDetect, rootDir string, targets []string) error {
+	for _, x := range []string{DeploySupervisor, DeploySystemd, DeployDocker, DeployK8s} {
+		fn := GetTargetFileName(PD, deployFiles[x], rootDir)
+		if inList(targets, x) || !deployGenerated(fn) {
+			continue
+		}
+		if err := os.Remove(fn); err != nil {
+			return err
+		}
+		log.Infof("deploy %s not selected, remove %s", x, fn)
+	}
+	return nil
+}
+
+func inList(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// confRpcPort 从 conf 的 [server] 中找 brick/rpc 的监听端口: port = 8081 或 addr/listen = "host:8081",
+// 和 bootstrap 的 rpcAddr 一样按 key 排序取第一个, 其它 table 中的 redis, db 地址不是 server 的端口
+func confRpcPort(fn string) (int, string) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, ""
+	}
+	defer f.Close()
+
+	type addr struct {
+		port int
+		host string
+	}
+	found := make(map[string]addr)
+	table := ""
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "[") {
+			table = strings.Trim(line, "[] ")
+			continue
+		}
+		i := strings.Index(line, "=")
+		if table != "server" || i <= 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		val := strings.TrimSpace(line[i+1:])
+		if j := strings.Index(val, "#"); j >= 0 {
+			val = strings.TrimSpace(val[:j])
+		}
+
+		switch {
+		case key == "port" || strings.HasSuffix(key, "_port"):
+			if n, err := strconv.Atoi(val); err == nil && n > 0 {
+				found[key] = addr{n, ""}
+			}
+		case strings.Contains(key, "addr") || key == "listen":
+			val = strings.Trim(val, `"'`)
+			if j := strings.LastIndex(val, ":"); j >= 0 {
+				if n, err := strconv.Atoi(val[j+1:]); err == nil && n > 0 {
+					found[key] = addr{n, strings.Trim(val[:j], "[]")}
+				}
+			}
+		}
+	}
+
+	var keys []string
+	for k := range found {
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return 0, ""
+	}
+	sort.Strings(keys)
+	return found[keys[0]].port, found[keys[0]].host
+}
+
+// k8sName 服务名转成 k8s 的资源名: user_svr -> user-svr
+func k8sName(s string) string {
+	return strings.Replace(strings.ToLower(s), "_", "-", -1)
+}
+
+// GenerateDeploy 生成 systemd, Dockerfile 或 k8s 的部署文件, 端口和健康检查来自 conf 和 server bootstrap,
+// conf 的内容不写入部署文件; 已有手写的同名文件时不覆盖
+func GenerateDeploy(PD ProtoDetect, rootDir string, target string) error {
+	conf := GetTargetFileName(PD, "conf", rootDir)
+	rpcPort, host := confRpcPort(conf)
+	if rpcPort == 0 {
+		log.Warnf("rpc port not found in [server] of %s, only grpc and admin ports exposed, /readyz does not wait for brick/rpc", conf)
+	} else {
+		log.Infof("deploy %s with rpc port %d from %s", target, rpcPort, conf)
+	}
+	if host == "127.0.0.1" || host == "localhost" {
+		log.Warnf("%s listens on %s, not reachable from other hosts or containers", conf, host)
+	}
+
+	type port struct {
+		name string
+		port int
+	}
+	var ports []port
+	if rpcPort > 0 {
+		ports = append(ports, port{"rpc", rpcPort})
+	}
+	ports = append(ports, port{"grpc", deployGrpcPort}, port{"admin", deployAdminPort})
+
+	var expose, containerPorts, servicePorts []string
+	for _, p := range ports {
+		expose = append(expose, strconv.Itoa(p.port))
+		containerPorts = append(containerPorts,
+			fmt.Sprintf("            - name: %s\n              containerPort: %d", p.name, p.port))
+		// admin 只给探针使用, 不放到 Service 中
+		if p.name != "admin" {
+			servicePorts = append(servicePorts,
+				fmt.Sprintf("    - name: %s\n      port: %d\n      targetPort: %s", p.name, p.port, p.name))
+		}
+	}
+
+	r := strings.NewReplacer(
+		"{{Svr}}", PD.SvrName,
+		"{{Name}}", k8sName(PD.SvrName),
+		"{{ENV}}", envName(PD.SvrName),
+		"{{GoPkg}}", PD.GoPackageName,
+		"{{GrpcPort}}", strconv.Itoa(deployGrpcPort),
+		"{{AdminPort}}", strconv.Itoa(deployAdminPort),
+		"{{StopTimeout}}", strconv.Itoa(deployDrainSeconds+deployStopSeconds+5),
+		"{{Ports}}", strings.Join(expose, " "),
+		"{{ContainerPorts}}", strings.Join(containerPorts, "\n"),
+		"{{ServicePorts}}", strings.Join(servicePorts, "\n"),
+	)
+
+	var temp string
+	switch target {
+	case DeploySystemd:
+		temp = systemdTemp
+	case DeployDocker:
+		temp = dockerfileTemp
+	case DeployK8s:
+		temp = k8sTemp
+	default:
+		return fmt.Errorf("unknown deploy %s", target)
+	}
+	fn := GetTargetFileName(PD, deployFiles[target], rootDir)
+	if FileExists(fn) && !deployGenerated(fn) {
+		return nil
+	}
+	return ioutil.WriteFile(fn, []byte(r.Replace(temp)), 0644)
+}
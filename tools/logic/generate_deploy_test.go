@@ -0,0 +1,123 @@
+package logic
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfRpcPort(t *testing.T) {
+	cases := []struct {
+		name string
+		conf string
+		port int
+		host string
+	}{
+		{"addr", "[server]\naddr = \"0.0.0.0:8081\"\n", 8081, "0.0.0.0"},
+		{"port", "[server]\nport = 8082 # rpc\n", 8082, ""},
+		{"ipv6", "[server]\nlisten = \"[::]:8083\"\n", 8083, "::"},
+		{"sorted keys", "[server]\nlisten = \":8085\"\naddr = \":8084\"\n", 8084, ""},
+		{"other tables", "[redis.session]\naddr = \"127.0.0.1:6379\"\n[mysql.default]\nport = 3306\n[server]\nname = \"shop\"\n", 0, ""},
+		{"top level", "addr = \":8086\"\n[server]\n", 0, ""},
+		{"sub table", "[server.admin]\naddr = \":8087\"\n", 0, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "shop.toml")
+			if err := ioutil.WriteFile(fn, []byte(c.conf), 0644); err != nil {
+				t.Fatal(err)
+			}
+			port, host := confRpcPort(fn)
+			if port != c.port || host != c.host {
+				t.Errorf("confRpcPort = %d %q, want %d %q", port, host, c.port, c.host)
+			}
+		})
+	}
+}
+
+func TestDeployTargets(t *testing.T) {
+	PD := testClientPD()
+	root := t.TempDir()
+
+	list, err := DeployTargets(*PD, root, "")
+	if err != nil || len(list) != 1 || list[0] != DeploySupervisor {
+		t.Fatalf("want supervisor by default, got %v %v", list, err)
+	}
+	if _, err := DeployTargets(*PD, root, "docker,nomad"); err == nil {
+		t.Error("unknown deploy accepted")
+	}
+
+	for _, x := range []string{DeploySupervisor, DeployK8s} {
+		if err := ioutil.WriteFile(GetTargetFileName(*PD, deployFiles[x], root), []byte(deployHeader+". DO NOT EDIT.\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 手写的 Dockerfile 不当作之前选择的部署方式
+	docker := GetTargetFileName(*PD, deployFiles[DeployDocker], root)
+	if err := ioutil.WriteFile(docker, []byte("FROM alpine\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	list, err = DeployTargets(*PD, root, "")
+	if err != nil || len(list) != 2 || list[0] != DeploySupervisor || list[1] != DeployK8s {
+		t.Fatalf("want generated deploy files, got %v %v", list, err)
+	}
+
+	// 只选择 systemd 时删除之前生成的 supervisor 和 k8s 文件, 手写的 Dockerfile 保留
+	list, err = DeployTargets(*PD, root, "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveDeploy(*PD, root, list); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []string{DeploySupervisor, DeployK8s} {
+		if FileExists(GetTargetFileName(*PD, deployFiles[x], root)) {
+			t.Errorf("%s deploy file kept", x)
+		}
+	}
+	if !FileExists(docker) {
+		t.Error("hand-written Dockerfile removed")
+	}
+}
+
+func TestGenerateDeployKeepHandWritten(t *testing.T) {
+	PD := testClientPD()
+	root := t.TempDir()
+	fn := GetTargetFileName(*PD, deployFiles[DeployDocker], root)
+	if err := ioutil.WriteFile(fn, []byte("FROM alpine\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GenerateDeploy(*PD, root, DeployDocker); err != nil {
+		t.Fatal(err)
+	}
+	if string(readGenerated(t, fn)) != "FROM alpine\n" {
+		t.Error("hand-written Dockerfile overwritten")
+	}
+}
+
+func TestGenerateDeployGolden(t *testing.T) {
+	PD := testClientPD()
+	root := t.TempDir()
+	conf := GetTargetFileName(*PD, "conf", root)
+	err := ioutil.WriteFile(conf, []byte("[server]\naddr = \"0.0.0.0:8081\"\n\n[redis.session]\naddr = \"127.0.0.1:6379\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, x := range []string{DeploySystemd, DeployDocker, DeployK8s} {
+		if err := GenerateDeploy(*PD, root, x); err != nil {
+			t.Fatal(err)
+		}
+		got := readGenerated(t, GetTargetFileName(*PD, deployFiles[x], root))
+		checkGolden(t, "deploy_"+x, got)
+		if strings.Contains(string(got), "6379") {
+			t.Errorf("%s deploy file contains conf", x)
+		}
+	}
+	if err := GenerateDeploy(*PD, root, DeploySupervisor); err == nil {
+		t.Error("supervisor is generated by GenerateSupervisorConf")
+	}
+}
@@ -0,0 +1,347 @@
+package logic
+
+import (
+	"brick/log"
+	"fmt"
+	"github.com/emicklei/proto"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errorsTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package %s
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CodeError 由 *ErrCode 枚举生成的错误, errors.Is 按错误码比较
+type CodeError struct {
+	code       uint32
+	msg        string
+	httpStatus int
+	cause      error
+}
+
+func (e *CodeError) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%%d: %%s: %%v", e.code, e.msg, e.cause)
+	}
+	return fmt.Sprintf("%%d: %%s", e.code, e.msg)
+}
+
+func (e *CodeError) Code() uint32 {
+	return e.code
+}
+
+func (e *CodeError) Message() string {
+	return e.msg
+}
+
+// HTTPStatus 由枚举值的 option(ext.HttpStatus) 指定, 0 表示未指定
+func (e *CodeError) HTTPStatus() int {
+	return e.httpStatus
+}
+
+func (e *CodeError) Unwrap() error {
+	return e.cause
+}
+
+func (e *CodeError) Is(target error) bool {
+	t, ok := target.(*CodeError)
+	return ok && t.code == e.code
+}
+
+// Wrap 返回带有底层原因的拷贝, 原错误不变
+func (e *CodeError) Wrap(cause error) *CodeError {
+	x := *e
+	x.cause = cause
+	return &x
+}
+
+var (
+%s
+)
+
+%s
+
+var code2Err = map[uint32]*CodeError{
+%s
+}
+
+// ErrByCode 按错误码查找, 未定义时返回 nil
+func ErrByCode(code uint32) *CodeError {
+	return code2Err[code]
+}
+
+// 错误码 -> locale -> 提示信息, "" 为默认提示. 和 TS 的 ErrMsgs 是同一张表
+var code2Msgs = map[uint32]map[string]string{
+%s
+}
+
+// ErrMsg 返回错误码在 locale 下的提示, 找不到时依次回退到语言前缀 (zh-CN -> zh) 和默认提示
+func ErrMsg(code uint32, locale string) string {
+	m := code2Msgs[code]
+	if m == nil {
+		return ""
+	}
+	l := strings.ToLower(locale)
+	if s, ok := m[l]; ok {
+		return s
+	}
+	if i := strings.IndexAny(l, "-_"); i > 0 {
+		if s, ok := m[l[:i]]; ok {
+			return s
+		}
+	}
+	return m[""]
+}
+
+// LocalMessage 返回 locale 下的提示
+func (e *CodeError) LocalMessage(locale string) string {
+	return ErrMsg(e.code, locale)
+}
+`
+
+// DefaultErrLocale 注释中没有普通文字时, 使用该语言的提示作为默认提示
+var DefaultErrLocale = "zh"
+
+var errMsgTagRe = regexp.MustCompile(`@msg\.([A-Za-z][A-Za-z0-9_-]*):`)
+
+func errCodeCommentText(f *proto.EnumField) string {
+	var lines []string
+	if f.Comment != nil {
+		lines = append(lines, f.Comment.Lines...)
+	}
+	if f.InlineComment != nil {
+		lines = append(lines, f.InlineComment.Lines...)
+	}
+
+	var parts []string
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l != "" {
+			parts = append(parts, l)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// splitErrMsgTags 拆出注释中的 `@msg.zh: ... @msg.en: ...`, 返回其余的普通文字和各语言提示
+func splitErrMsgTags(text string) (string, map[string]string) {
+	msgs := make(map[string]string)
+
+	locs := errMsgTagRe.FindAllStringSubmatchIndex(text, -1)
+	if len(locs) == 0 {
+		return text, msgs
+	}
+
+	plain := text[:locs[0][0]]
+	for i, loc := range locs {
+		end := len(text)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		locale := strings.ToLower(text[loc[2]:loc[3]])
+		msgs[locale] = strings.TrimSpace(text[loc[1]:end])
+	}
+
+	return strings.TrimSpace(plain), msgs
+}
+
+// ParseErrCodeMsgs 收集每个枚举值的多语言提示, 注释和 [(ext.msg).en = "..."] 选项都支持, 选项优先
+func ParseErrCodeMsgs(fields []*proto.EnumField) map[string]map[string]string {
+	res := make(map[string]map[string]string)
+	for _, f := range fields {
+		_, msgs := splitErrMsgTags(errCodeCommentText(f))
+
+		opts := make([]*proto.Option, 0, len(f.Elements)+1)
+		for _, e := range f.Elements {
+			if o, ok := e.(*proto.Option); ok {
+				opts = append(opts, o)
+			}
+		}
+		if len(opts) == 0 && f.ValueOption != nil {
+			opts = append(opts, f.ValueOption)
+		}
+		for _, o := range opts {
+			if strings.HasPrefix(o.Name, "(ext.msg).") {
+				msgs[strings.ToLower(strings.TrimPrefix(o.Name, "(ext.msg)."))] = o.Constant.Source
+			}
+		}
+
+		if len(msgs) > 0 {
+			res[f.Name] = msgs
+		}
+	}
+	return res
+}
+
+func errCodeMsg(f *proto.EnumField, msgs map[string]string) string {
+	plain, _ := splitErrMsgTags(errCodeCommentText(f))
+	if plain != "" {
+		return plain
+	}
+	if m := msgs[DefaultErrLocale]; m != "" {
+		return m
+	}
+	if keys := sortedKeys(msgs); len(keys) > 0 {
+		return msgs[keys[0]]
+	}
+	return f.Name
+}
+
+// errMsgTable 错误码的提示表, Go 和 TS 都由它生成: locale -> 提示, "" 为默认提示,
+// 即注释中的普通文字, 没有时依次使用 DefaultErrLocale 的提示和枚举名
+func errMsgTable(f *proto.EnumField, msgs map[string]string) map[string]string {
+	m := map[string]string{"": errCodeMsg(f, msgs)}
+	for l, s := range msgs {
+		m[l] = s
+	}
+	return m
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func goLocaleMap(msgs map[string]string) string {
+	var list []string
+	for _, l := range sortedKeys(msgs) {
+		list = append(list, fmt.Sprintf("%s: %s", strconv.Quote(l), strconv.Quote(msgs[l])))
+	}
+	return "{" + strings.Join(list, ", ") + "}"
+}
+
+func enumFieldOption(f *proto.EnumField, name string) *proto.Option {
+	for _, e := range f.Elements {
+		if o, ok := e.(*proto.Option); ok && o.Name == name {
+			return o
+		}
+	}
+	if f.ValueOption != nil && f.ValueOption.Name == name {
+		return f.ValueOption
+	}
+	return nil
+}
+
+// packageIdents 返回目录下其它 go 文件中声明的顶层标识符, 用于避免生成重名的变量
+func packageIdents(dir string, skip string) map[string]bool {
+	idents := make(map[string]bool)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, fn := range files {
+		if filepath.Base(fn) == filepath.Base(skip) {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), fn, nil, 0)
+		if err != nil {
+			continue
+		}
+		for name, obj := range f.Scope.Objects {
+			if obj.Kind != ast.Pkg {
+				idents[name] = true
+			}
+		}
+	}
+	return idents
+}
+
+func errVarName(enumName string, f *proto.EnumField, taken map[string]bool) string {
+	name := f.Name
+	if !strings.HasPrefix(name, "Err") {
+		name = "Err" + name
+	}
+	if taken[name] {
+		name = "Err" + strings.TrimSuffix(enumName, "ErrCode") + strings.TrimPrefix(f.Name, "Err")
+	}
+	return name
+}
+
+// checkErrCodeValues 错误码在 Go 中是 uint32, 负数无法表示, 生成前拒绝
+func checkErrCodeValues(defs []ErrCodeDef) error {
+	for _, def := range defs {
+		for _, f := range def.ErrCodeEnums {
+			if f.Integer < 0 {
+				return fmt.Errorf("%s.%s = %d, error code must not be negative",
+					def.ErrCodeSetName, f.Name, f.Integer)
+			}
+		}
+	}
+	return nil
+}
+
+func GenerateErrors(PD ProtoDetect, rootDir string) error {
+	if len(PD.ErrCodes) == 0 {
+		return nil
+	}
+	if err := checkErrCodeValues(PD.ErrCodes); err != nil {
+		return err
+	}
+
+	fn := GetTargetFileName(PD, "errors", rootDir)
+	taken := packageIdents(filepath.Dir(fn), fn)
+
+	var varList []string
+	var ctorList []string
+	var codeList []string
+	var msgList []string
+	for _, def := range PD.ErrCodes {
+		for _, f := range def.ErrCodeEnums {
+			if f.Integer == 0 {
+				continue
+			}
+
+			msgList = append(msgList, fmt.Sprintf("\t%d: %s,", f.Integer, goLocaleMap(errMsgTable(f, def.Msgs[f.Name]))))
+
+			name := errVarName(def.ErrCodeSetName, f, taken)
+			if taken[name] {
+				log.Warnf("skip error %s.%s, name %s already declared", def.ErrCodeSetName, f.Name, name)
+				continue
+			}
+			taken[name] = true
+
+			httpStatus := 0
+			if o := enumFieldOption(f, "(ext.HttpStatus)"); o != nil {
+				httpStatus, _ = strconv.Atoi(o.Constant.Source)
+			}
+
+			msg := errCodeMsg(f, def.Msgs[f.Name])
+			varList = append(varList, fmt.Sprintf(
+				"\t// %s\n\t%s = &CodeError{code: %d, msg: %s, httpStatus: %d}",
+				msg, name, f.Integer, strconv.Quote(msg), httpStatus))
+			ctorList = append(ctorList, fmt.Sprintf(
+				"func New%s(cause error) error {\n\treturn %s.Wrap(cause)\n}",
+				name, name))
+			codeList = append(codeList, fmt.Sprintf("\t%d: %s,", f.Integer, name))
+		}
+	}
+
+	context := fmt.Sprintf(
+		errorsTemp, PD.PackageName,
+		strings.Join(varList, "\n"),
+		strings.Join(ctorList, "\n\n"),
+		strings.Join(codeList, "\n"),
+		strings.Join(msgList, "\n"))
+
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+
+	return ioutil.WriteFile(fn, src, 0644)
+}
@@ -0,0 +1,113 @@
+package logic
+
+import (
+	"github.com/emicklei/proto"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parseTestErrCodes 解析 proto 中的 *ErrCode 枚举, 和 walkPb 中 handleEnum 的结果一致
+func parseTestErrCodes(t *testing.T, src string) *ProtoDetect {
+	t.Helper()
+
+	def, err := proto.NewParser(strings.NewReader(src)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	PD := NewProtoDetect()
+	PD.PackageName = "user"
+	PD.SvrName = "user"
+	PD.GoPackageName = "user"
+	proto.Walk(def, proto.WithEnum(func(e *proto.Enum) {
+		PD.EnumList = append(PD.EnumList, e)
+		if !strings.HasSuffix(e.Name, "ErrCode") {
+			return
+		}
+		fs := enumValues(e)
+		PD.ErrCodes = append(PD.ErrCodes, ErrCodeDef{
+			ErrCodeSetName: e.Name, ErrCodeEnums: fs, Msgs: ParseErrCodeMsgs(fs)})
+	}))
+	return PD
+}
+
+func TestErrCodeRejectNegative(t *testing.T) {
+	PD := parseTestErrCodes(t, `syntax = "proto3";
+enum UserErrCode {
+  Success = 0;
+  Bad = -1;
+}`)
+	root := t.TempDir()
+
+	err := GenerateErrors(*PD, root)
+	if err == nil || !strings.Contains(err.Error(), "UserErrCode.Bad = -1") {
+		t.Fatalf("GenerateErrors want negative error, got %v", err)
+	}
+	err = GenerateTsErrCode(PD, root)
+	if err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Fatalf("GenerateTsErrCode want negative error, got %v", err)
+	}
+	if FileExists(filepath.Join(root, "user.errcode.ts")) {
+		t.Error("ts file written for negative error code")
+	}
+
+	dir := writeProtos(t, map[string]string{
+		"user.proto": `syntax = "proto3"; package user; enum UserErrCode { Success = 0; Bad = -1; }`,
+	})
+	if _, err := LoadErrCodeRegistry(filepath.Join(dir, "user.proto"), nil); err == nil {
+		t.Error("registry accepted negative error code")
+	}
+}
+
+const testErrCodeProto = `syntax = "proto3";
+enum UserErrCode {
+  Success = 0;
+  // 密码错误
+  PasswordWrong = 20001 [(ext.HttpStatus) = 401]; // @msg.zh: 密码错误 @msg.en: wrong password
+  NotFound = 20002; // 用户不存在
+  Plain = 20003;
+  OnlyEn = 20004; // 余额不足 @msg.en: insufficient balance
+  Option = 20005 [(ext.msg).en = "by option"]; // @msg.zh: 选项
+}`
+
+func TestErrMsgTable(t *testing.T) {
+	PD := parseTestErrCodes(t, testErrCodeProto)
+	def := PD.ErrCodes[0]
+
+	cases := []struct {
+		name string
+		want map[string]string
+	}{
+		{"PasswordWrong", map[string]string{"": "密码错误", "zh": "密码错误", "en": "wrong password"}},
+		{"NotFound", map[string]string{"": "用户不存在"}},
+		{"Plain", map[string]string{"": "Plain"}},
+		// 只有 @msg.en 时默认提示仍然是普通文字, Go 和 TS 对 zh 都返回它
+		{"OnlyEn", map[string]string{"": "余额不足", "en": "insufficient balance"}},
+		{"Option", map[string]string{"": "选项", "zh": "选项", "en": "by option"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var f *proto.EnumField
+			for _, x := range def.ErrCodeEnums {
+				if x.Name == c.name {
+					f = x
+				}
+			}
+			got := errMsgTable(f, def.Msgs[f.Name])
+			if goLocaleMap(got) != goLocaleMap(c.want) {
+				t.Errorf("got %s, want %s", goLocaleMap(got), goLocaleMap(c.want))
+			}
+		})
+	}
+}
+
+func TestGenerateErrorsGolden(t *testing.T) {
+	PD := parseTestErrCodes(t, testErrCodeProto)
+	root := t.TempDir()
+
+	if err := GenerateErrors(*PD, root); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "errors", readGenerated(t, GetTargetFileName(*PD, "errors", root)))
+}
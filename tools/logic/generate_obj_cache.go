@@ -0,0 +1,650 @@
+package logic
+
+import (
+	"brick/log"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var objCacheTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package %s
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+	"sync"
+	"sync/atomic"
+	"time"
+	%s
+)
+
+// ObjCacheOptions 对象缓存的配置, 零值使用默认值
+type ObjCacheOptions struct {
+	Size        int           // 进程内 LRU 的最大对象数, 默认 10000
+	TTL         time.Duration // 进程内缓存的有效期, 默认 1 分钟, 其它进程的写入最多延迟这么久可见
+	Redis       redis.Cmdable // 可选的第二级缓存
+	RedisTTL    time.Duration // 默认 10 分钟
+	RedisPrefix string        // redis key 前缀, 默认 "%s"
+	LoadTimeout time.Duration // 共享的 load 不随调用方取消, 用这个超时, 默认 5 秒
+}
+
+const (
+	defaultObjCacheSize        = 10000
+	defaultObjCacheTTL         = time.Minute
+	defaultObjCacheRedisTTL    = 10 * time.Minute
+	defaultObjCacheLoadTimeout = 5 * time.Second
+)
+
+func (p ObjCacheOptions) withDefault() ObjCacheOptions {
+	if p.Size <= 0 {
+		p.Size = defaultObjCacheSize
+	}
+	if p.TTL <= 0 {
+		p.TTL = defaultObjCacheTTL
+	}
+	if p.RedisTTL <= 0 {
+		p.RedisTTL = defaultObjCacheRedisTTL
+	}
+	if p.RedisPrefix == "" {
+		p.RedisPrefix = %q
+	}
+	if p.LoadTimeout <= 0 {
+		p.LoadTimeout = defaultObjCacheLoadTimeout
+	}
+	return p
+}
+
+// ObjCacheStats 命中统计, Loads 为实际查询数据库的次数
+type ObjCacheStats struct {
+	Hits       uint64
+	RedisHits  uint64
+	Misses     uint64
+	Loads      uint64
+	LoadErrors uint64
+	Evictions  uint64
+	Size       int
+}
+
+type objCacheCounter struct {
+	hits, redisHits, misses, loads, loadErrors, evictions uint64
+}
+
+type objCacheEntry struct {
+	key    string
+	val    proto.Message
+	expire time.Time
+}
+
+// objLRU 带过期时间的 LRU
+type objLRU struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+	cnt   *objCacheCounter
+}
+
+func newObjLRU(size int, ttl time.Duration, cnt *objCacheCounter) *objLRU {
+	return &objLRU{size: size, ttl: ttl, ll: list.New(), items: make(map[string]*list.Element), cnt: cnt}
+}
+
+func (p *objLRU) get(key string) proto.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.items[key]
+	if !ok {
+		return nil
+	}
+	x := e.Value.(*objCacheEntry)
+	if time.Now().After(x.expire) {
+		p.ll.Remove(e)
+		delete(p.items, key)
+		return nil
+	}
+	p.ll.MoveToFront(e)
+	return x.val
+}
+
+func (p *objLRU) set(key string, val proto.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expire := time.Now().Add(p.ttl)
+	if e, ok := p.items[key]; ok {
+		x := e.Value.(*objCacheEntry)
+		x.val, x.expire = val, expire
+		p.ll.MoveToFront(e)
+		return
+	}
+	p.items[key] = p.ll.PushFront(&objCacheEntry{key: key, val: val, expire: expire})
+	for p.ll.Len() > p.size {
+		e := p.ll.Back()
+		p.ll.Remove(e)
+		delete(p.items, e.Value.(*objCacheEntry).key)
+		atomic.AddUint64(&p.cnt.evictions, 1)
+	}
+}
+
+func (p *objLRU) del(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.items[key]; ok {
+		p.ll.Remove(e)
+		delete(p.items, key)
+	}
+}
+
+func (p *objLRU) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ll.Len()
+}
+
+// objDetachedCtx 保留 ctx 中的值, 但不随 ctx 取消
+type objDetachedCtx struct {
+	context.Context
+}
+
+func (objDetachedCtx) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (objDetachedCtx) Done() <-chan struct{} {
+	return nil
+}
+
+func (objDetachedCtx) Err() error {
+	return nil
+}
+
+// objFlight 一次进行中的 load, 期间 invalidate 了同一个 key 时标记为 stale, 结果不再写入缓存
+type objFlight struct {
+	stale bool
+}
+
+// objCache 各模型缓存共用的部分, 缓存中的对象不会被修改, 返回给调用方的是副本
+type objCache struct {
+	opt   ObjCacheOptions
+	table string
+	lru   *objLRU
+	group singleflight.Group
+	cnt   objCacheCounter
+
+	mu      sync.Mutex
+	flights map[string][]*objFlight
+}
+
+func newObjCache(table string, opt ObjCacheOptions) *objCache {
+	c := &objCache{opt: opt.withDefault(), table: table, flights: make(map[string][]*objFlight)}
+	c.lru = newObjLRU(c.opt.Size, c.opt.TTL, &c.cnt)
+	return c
+}
+
+func (c *objCache) redisKey(key string) string {
+	return c.opt.RedisPrefix + c.table + ":" + key
+}
+
+func (c *objCache) startFlight(key string) *objFlight {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := &objFlight{}
+	c.flights[key] = append(c.flights[key], f)
+	return f
+}
+
+func (c *objCache) endFlight(key string, f *objFlight) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := c.flights[key]
+	for i, x := range list {
+		if x == f {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(c.flights, key)
+	} else {
+		c.flights[key] = list
+	}
+}
+
+// fill 把 load 的结果放入 LRU, load 期间被 invalidate 时返回 false
+func (c *objCache) fill(key string, f *objFlight, v proto.Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.stale {
+		return false
+	}
+	c.lru.set(key, v)
+	return true
+}
+
+// fillRedis 写入 redis 之后再检查一次, 写入期间被 invalidate 时删除刚写入的旧值
+func (c *objCache) fillRedis(ctx context.Context, key string, f *objFlight, v proto.Message) {
+	b, err := proto.Marshal(v)
+	if err != nil {
+		return
+	}
+	c.opt.Redis.Set(ctx, c.redisKey(key), b, c.opt.RedisTTL)
+
+	c.mu.Lock()
+	stale := f.stale
+	c.mu.Unlock()
+	if stale {
+		c.opt.Redis.Del(ctx, c.redisKey(key))
+	}
+}
+
+// load 在 singleflight 中执行, 使用不随调用方取消的 ctx, 一个调用方取消不会让其它等待者失败
+func (c *objCache) load(ctx context.Context, key string, newObj func() proto.Message,
+	load func(ctx context.Context) (proto.Message, error)) (proto.Message, error) {
+	ctx, cancel := context.WithTimeout(objDetachedCtx{ctx}, c.opt.LoadTimeout)
+	defer cancel()
+
+	f := c.startFlight(key)
+	defer c.endFlight(key, f)
+
+	if c.opt.Redis != nil {
+		b, err := c.opt.Redis.Get(ctx, c.redisKey(key)).Bytes()
+		if err == nil {
+			v := newObj()
+			if proto.Unmarshal(b, v) == nil {
+				atomic.AddUint64(&c.cnt.redisHits, 1)
+				c.fill(key, f, v)
+				return v, nil
+			}
+		}
+	}
+
+	atomic.AddUint64(&c.cnt.loads, 1)
+	v, err := load(ctx)
+	if err != nil {
+		atomic.AddUint64(&c.cnt.loadErrors, 1)
+		return nil, err
+	}
+	if v == nil {
+		return nil, nil
+	}
+	if c.fill(key, f, v) && c.opt.Redis != nil {
+		c.fillRedis(ctx, key, f, v)
+	}
+	return v, nil
+}
+
+// get 依次查询 LRU, redis 和 load, 同一个 key 并发的 load 只执行一次. 不存在时返回 nil, nil.
+// ctx 取消时直接返回, 不影响进行中的 load
+func (c *objCache) get(ctx context.Context, key string, newObj func() proto.Message,
+	load func(ctx context.Context) (proto.Message, error)) (proto.Message, error) {
+	if v := c.lru.get(key); v != nil {
+		atomic.AddUint64(&c.cnt.hits, 1)
+		return proto.Clone(v), nil
+	}
+	atomic.AddUint64(&c.cnt.misses, 1)
+
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		return c.load(ctx, key, newObj, load)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil || res.Val == nil {
+			return nil, res.Err
+		}
+		v, _ := res.Val.(proto.Message)
+		if v == nil {
+			return nil, nil
+		}
+		return proto.Clone(v), nil
+	}
+}
+
+// invalidate 写数据库之后删除两级缓存, 进行中的 load 结果不再写入缓存, 其它进程的 LRU 在 TTL 之后失效
+func (c *objCache) invalidate(ctx context.Context, key string) error {
+	c.mu.Lock()
+	for _, f := range c.flights[key] {
+		f.stale = true
+	}
+	c.lru.del(key)
+	c.mu.Unlock()
+
+	c.group.Forget(key)
+	if c.opt.Redis != nil {
+		return c.opt.Redis.Del(ctx, c.redisKey(key)).Err()
+	}
+	return nil
+}
+
+func (c *objCache) stats() ObjCacheStats {
+	return ObjCacheStats{
+		Hits:       atomic.LoadUint64(&c.cnt.hits),
+		RedisHits:  atomic.LoadUint64(&c.cnt.redisHits),
+		Misses:     atomic.LoadUint64(&c.cnt.misses),
+		Loads:      atomic.LoadUint64(&c.cnt.loads),
+		LoadErrors: atomic.LoadUint64(&c.cnt.loadErrors),
+		Evictions:  atomic.LoadUint64(&c.cnt.evictions),
+		Size:       c.lru.len(),
+	}
+}
+%s`
+
+var objCacheModelTemp = `
+// {{Cache}} 表 {{Table}} 的对象缓存, 按主键读取时先查缓存, 通过它写入时删除缓存
+type {{Cache}} struct {
+	repo *{{Repo}}
+	c    *objCache
+}
+
+func New{{Cache}}(repo *{{Repo}}, opt ObjCacheOptions) *{{Cache}} {
+	return &{{Cache}}{repo: repo, c: newObjCache({{TableQ}}, opt)}
+}
+
+func {{keyFunc}}({{PKParams}}) string {
+	return fmt.Sprintf({{KeyFormat}}, {{PKArgs}})
+}
+
+// Get 按主键查询, 不存在时返回 nil, nil
+func (p *{{Cache}}) Get(ctx context.Context, {{PKParams}}) (*{{Model}}, error) {
+	v, err := p.c.get(ctx, {{keyFunc}}({{PKArgs}}), func() proto.Message {
+		return &{{Model}}{}
+	}, func(ctx context.Context) (proto.Message, error) {
+		m, err := p.repo.Get(ctx, {{PKArgs}})
+		if m == nil {
+			return nil, err
+		}
+		return m, err
+	})
+	if v == nil {
+		return nil, err
+	}
+	return v.(*{{Model}}), err
+}
+
+func (p *{{Cache}}) Create(ctx context.Context, m *{{Model}}) error {
+	if err := p.repo.Create(ctx, m); err != nil {
+		return err
+	}
+	return p.c.invalidate(ctx, {{keyFunc}}({{PKArgsM}}))
+}
+
+func (p *{{Cache}}) Update(ctx context.Context, m *{{Model}}) error {
+	if err := p.repo.Update(ctx, m); err != nil {
+		return err
+	}
+	return p.c.invalidate(ctx, {{keyFunc}}({{PKArgsM}}))
+}
+
+func (p *{{Cache}}) Upsert(ctx context.Context, m *{{Model}}) error {
+	if err := p.repo.Upsert(ctx, m); err != nil {
+		return err
+	}
+	return p.c.invalidate(ctx, {{keyFunc}}({{PKArgsM}}))
+}
+
+func (p *{{Cache}}) Delete(ctx context.Context, {{PKParams}}) error {
+	if err := p.repo.Delete(ctx, {{PKArgs}}); err != nil {
+		return err
+	}
+	return p.c.invalidate(ctx, {{keyFunc}}({{PKArgs}}))
+}
+
+// Invalidate 不通过缓存修改了数据库时 (如事务中或 List 之后的批量更新) 调用
+func (p *{{Cache}}) Invalidate(ctx context.Context, {{PKParams}}) error {
+	return p.c.invalidate(ctx, {{keyFunc}}({{PKArgs}}))
+}
+
+// Repo 返回底层的 repo, 用于 List 等不经过缓存的查询
+func (p *{{Cache}}) Repo() *{{Repo}} {
+	return p.repo
+}
+
+func (p *{{Cache}}) Stats() ObjCacheStats {
+	return p.c.stats()
+}
+`
+
+var objCacheTestTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package %s
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	%s
+)
+
+// 测试生成的 LRU 和 singleflight, 不需要数据库和 redis
+
+func newObjCacheTestObj() proto.Message {
+	return &%s{}
+}
+
+func TestObjCacheLRU(t *testing.T) {
+	var cnt objCacheCounter
+	l := newObjLRU(2, time.Hour, &cnt)
+	a, b := newObjCacheTestObj(), newObjCacheTestObj()
+	l.set("a", a)
+	l.set("b", b)
+	if l.get("a") != a {
+		t.Fatal("a missed")
+	}
+	l.set("c", newObjCacheTestObj())
+	if l.get("b") != nil {
+		t.Error("least recently used b not evicted")
+	}
+	if l.get("a") == nil || l.get("c") == nil || cnt.evictions != 1 {
+		t.Errorf("want only b evicted, evictions %%d", cnt.evictions)
+	}
+
+	l = newObjLRU(2, time.Millisecond, &cnt)
+	l.set("a", a)
+	time.Sleep(5 * time.Millisecond)
+	if l.get("a") != nil || l.len() != 0 {
+		t.Error("expired a returned")
+	}
+}
+
+func TestObjCacheSingleflight(t *testing.T) {
+	c := newObjCache("test", ObjCacheOptions{})
+	var loads int32
+	release := make(chan struct{})
+	load := func(ctx context.Context) (proto.Message, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return newObjCacheTestObj(), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.get(context.Background(), "k", newObjCacheTestObj, load); v == nil || err != nil {
+				t.Errorf("get = %%v, %%v", v, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if _, err := c.get(context.Background(), "k", newObjCacheTestObj, load); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("want 1 load, got %%d", n)
+	}
+	if s := c.stats(); s.Hits != 1 || s.Loads != 1 {
+		t.Errorf("unexpected stats %%+v", s)
+	}
+}
+
+func TestObjCacheInvalidateDuringLoad(t *testing.T) {
+	c := newObjCache("test", ObjCacheOptions{})
+	started, release := make(chan struct{}), make(chan struct{})
+	load := func(ctx context.Context) (proto.Message, error) {
+		close(started)
+		<-release
+		return newObjCacheTestObj(), nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.get(context.Background(), "k", newObjCacheTestObj, load)
+	}()
+	<-started
+	if err := c.invalidate(context.Background(), "k"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	<-done
+
+	if c.lru.get("k") != nil {
+		t.Error("value loaded before invalidate was cached")
+	}
+}
+
+func TestObjCacheCallerCancel(t *testing.T) {
+	c := newObjCache("test", ObjCacheOptions{})
+	started, release := make(chan struct{}), make(chan struct{})
+	load := func(ctx context.Context) (proto.Message, error) {
+		close(started)
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return newObjCacheTestObj(), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := c.get(ctx, "k", newObjCacheTestObj, load)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan error, 1)
+	go func() {
+		v, err := c.get(context.Background(), "k", newObjCacheTestObj, load)
+		if err == nil && v == nil {
+			err = errors.New("nil value")
+		}
+		second <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled caller want context.Canceled, got %%v", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("other caller failed with the cancelled one: %%v", err)
+	}
+}
+`
+
+// GenerateLogicStateObjCacheRepo 为每个模型生成 <Msg>Cache, 包装 GenerateLogicStateDbRepo 生成的 <Msg>Repo.
+// conf 为 "1" 时生成, "0" 时删除; isGenAll 时保持原来的选择
+func GenerateLogicStateObjCacheRepo(PD *ProtoDetect, msgs []*PbMsg, rootDir string, conf string, isGenAll bool) error {
+	fn := GetTargetFileName(*PD, "logic_state_obj_cache_repo", rootDir)
+
+	enable := conf == "1"
+	if isGenAll && conf == "" {
+		enable = FileExists(fn)
+	}
+
+	tables, err := BuildDbSchema(msgs)
+	if err != nil {
+		return err
+	}
+	testFn := GetTargetFileName(*PD, "logic_state_obj_cache_test", rootDir)
+	if !enable || len(tables) == 0 {
+		for _, x := range []string{fn, testFn} {
+			if FileExists(x) {
+				if err := os.Remove(x); err != nil {
+					return err
+				}
+			}
+		}
+		if enable {
+			log.Warnf("no gorm model declared, skip object cache")
+		}
+		return nil
+	}
+
+	pbPath := PD.GoPackageName
+	pbPkg := pbPath[strings.LastIndex(pbPath, "/")+1:]
+
+	var body []string
+	for _, t := range tables {
+		var params, args, argsM, verbs []string
+		for _, c := range t.PKColumns() {
+			name := lowerFirst(c.Field)
+			if repoReservedNames[name] || name == "p" || name == "v" {
+				name += "Arg"
+			}
+			params = append(params, fmt.Sprintf("%s %s", name, pbGoType(c)))
+			args = append(args, name)
+			argsM = append(argsM, "m."+c.Field)
+			// 字符串加引号, 联合主键中包含 : 时不会混淆
+			if c.PbType == "string" {
+				verbs = append(verbs, "%q")
+			} else {
+				verbs = append(verbs, "%v")
+			}
+		}
+
+		r := strings.NewReplacer(
+			"{{Cache}}", t.Msg+"Cache",
+			"{{Repo}}", t.Msg+"Repo",
+			"{{Table}}", t.Name,
+			"{{TableQ}}", strconv.Quote(t.Name),
+			"{{Model}}", pbPkg+"."+t.Msg,
+			"{{keyFunc}}", lowerFirst(t.Msg)+"CacheKey",
+			"{{KeyFormat}}", strconv.Quote(strings.Join(verbs, ":")),
+			"{{PKParams}}", strings.Join(params, ", "),
+			"{{PKArgs}}", strings.Join(args, ", "),
+			"{{PKArgsM}}", strings.Join(argsM, ", "),
+		)
+		body = append(body, r.Replace(objCacheModelTemp))
+	}
+
+	pkg := implPackageName(filepath.Dir(fn))
+	prefix := PD.SvrName + ":"
+	context := fmt.Sprintf(objCacheTemp, pkg, strconv.Quote(pbPath), prefix, prefix, strings.Join(body, ""))
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+	err = ioutil.WriteFile(fn, src, 0644)
+	if err != nil {
+		return err
+	}
+
+	context = fmt.Sprintf(objCacheTestTemp, pkg, strconv.Quote(pbPath), pbPkg+"."+tables[0].Msg)
+	src, err = format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", testFn, err)
+		return err
+	}
+
+	return ioutil.WriteFile(testFn, src, 0644)
+}
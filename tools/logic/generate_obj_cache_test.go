@@ -0,0 +1,39 @@
+package logic
+
+import (
+	"testing"
+)
+
+func TestGenerateLogicStateObjCacheRepoGolden(t *testing.T) {
+	snap := parseTestModels(t, testModelProto, testModelPbGo)
+	snap.PD.GoPackageName = "brick/user"
+	root := t.TempDir()
+
+	if err := GenerateLogicStateObjCacheRepo(snap.PD, snap.Msgs, root, "1", false); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "stateobjcache_repo", readGenerated(t, GetTargetFileName(*snap.PD, "logic_state_obj_cache_repo", root)))
+	checkGolden(t, "stateobjcache_test", readGenerated(t, GetTargetFileName(*snap.PD, "logic_state_obj_cache_test", root)))
+
+	cases := []struct {
+		name     string
+		conf     string
+		isGenAll bool
+		want     bool
+	}{
+		{"keep on GenAll", "", true, true},
+		{"disable", "0", false, false},
+		{"stay disabled on GenAll", "", true, false},
+		{"enable", "1", false, true},
+	}
+	for _, c := range cases {
+		if err := GenerateLogicStateObjCacheRepo(snap.PD, snap.Msgs, root, c.conf, c.isGenAll); err != nil {
+			t.Fatal(err)
+		}
+		for _, x := range []string{"logic_state_obj_cache_repo", "logic_state_obj_cache_test"} {
+			if got := FileExists(GetTargetFileName(*snap.PD, x, root)); got != c.want {
+				t.Errorf("%s: %s exists %v, want %v", c.name, x, got, c.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,650 @@
+package logic
+
+import (
+	"brick/log"
+	"fmt"
+	"github.com/emicklei/proto"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redis 缓存, 在 message 的注释中声明, 一个 message 可以声明多个:
+//
+//	// @cache: name=UserSession key=session:{uid} ttl=1h type=string codec=pb
+//	message Session {
+//	    uint64 uid = 1;
+//	}
+//
+// key 中的 {param} 是访问函数的参数, 类型与 message 中同名字段一致,
+// 没有同名字段时用 {param:type} 指定, 默认为 string.
+// ttl 为秒数或 1h30m 的格式, 0 表示不过期; type 为 string/hash/list/zset; codec 为 pb/json
+var cacheRe = regexp.MustCompile(`@cache:\s*(.*)$`)
+
+var cacheParamRe = regexp.MustCompile(`\{(\w+)(?::(\w+))?\}`)
+
+const (
+	CacheTypeString = "string"
+	CacheTypeHash   = "hash"
+	CacheTypeList   = "list"
+	CacheTypeZset   = "zset"
+
+	CacheCodecPb   = "pb"
+	CacheCodecJson = "json"
+)
+
+type CacheSchema struct {
+	Name  string
+	Key   string
+	TTL   time.Duration
+	Type  string
+	Codec string
+}
+
+// ParseMsgCaches 解析 message 注释中的 @cache
+func ParseMsgCaches(m *proto.Message) ([]*CacheSchema, error) {
+	if m.Comment == nil {
+		return nil, nil
+	}
+
+	var list []*CacheSchema
+	for _, l := range m.Comment.Lines {
+		x := cacheRe.FindStringSubmatch(l)
+		if x == nil {
+			continue
+		}
+
+		c := &CacheSchema{Name: m.Name, Type: CacheTypeString, Codec: CacheCodecPb}
+		for _, kv := range strings.Fields(x[1]) {
+			i := strings.Index(kv, "=")
+			if i <= 0 {
+				return nil, fmt.Errorf("bad @cache item `%s`, want key=value", kv)
+			}
+			k, v := kv[:i], kv[i+1:]
+			switch k {
+			case "name":
+				c.Name = v
+			case "key":
+				c.Key = v
+			case "ttl":
+				if n, err := strconv.Atoi(v); err == nil {
+					c.TTL = time.Duration(n) * time.Second
+				} else if d, err := time.ParseDuration(v); err == nil {
+					c.TTL = d
+				} else {
+					return nil, fmt.Errorf("bad @cache ttl `%s`", v)
+				}
+				if c.TTL < 0 || c.TTL%time.Second != 0 {
+					return nil, fmt.Errorf("@cache ttl `%s` must be whole seconds", v)
+				}
+			case "type":
+				switch v {
+				case CacheTypeString, CacheTypeHash, CacheTypeList, CacheTypeZset:
+				default:
+					return nil, fmt.Errorf("unknown @cache type `%s`", v)
+				}
+				c.Type = v
+			case "codec":
+				if v != CacheCodecPb && v != CacheCodecJson {
+					return nil, fmt.Errorf("unknown @cache codec `%s`", v)
+				}
+				c.Codec = v
+			default:
+				return nil, fmt.Errorf("unknown @cache item `%s`", k)
+			}
+		}
+		if c.Key == "" {
+			return nil, fmt.Errorf("@cache %s missed key", c.Name)
+		}
+		if !isGoIdent(c.Name) {
+			return nil, fmt.Errorf("@cache name `%s` is not a valid identifier", c.Name)
+		}
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+func isGoIdent(s string) bool {
+	for i, r := range s {
+		if !(r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || (i > 0 && '0' <= r && r <= '9')) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+type cacheKeyParam struct {
+	Name   string // 参数名
+	GoType string
+}
+
+// 参数名不能与生成代码中的变量重名
+var cacheReservedNames = map[string]bool{
+	"ctx": true, "c": true, "v": true, "vs": true, "ttl": true, "field": true, "fields": true,
+	"start": true, "stop": true, "score": true, "min": true, "max": true, "key": true,
+	"b": true, "s": true, "err": true, "res": true, "list": true, "pipe": true,
+}
+
+// cacheKey 返回 key 的 fmt 格式和参数
+func cacheKey(m *PbMsg, c *CacheSchema) (string, []*cacheKeyParam, error) {
+	var params []*cacheKeyParam
+	seen := make(map[string]bool)
+
+	var format strings.Builder
+	last := 0
+	for _, x := range cacheParamRe.FindAllStringSubmatchIndex(c.Key, -1) {
+		format.WriteString(strings.Replace(c.Key[last:x[0]], "%", "%%", -1))
+		last = x[1]
+
+		name := c.Key[x[2]:x[3]]
+		typ := ""
+		if x[4] >= 0 {
+			typ = c.Key[x[4]:x[5]]
+		} else {
+			typ = "string"
+			for _, f := range m.Fields {
+				if f.GetName() != name {
+					continue
+				}
+				kind := f.kind()
+				if f.IsRepeated() || kind == fieldKindMsg || kind == fieldKindBytes {
+					return "", nil, fmt.Errorf("@cache %s: field %s can not be used in key", c.Name, name)
+				}
+				typ = pbGoType(&DbColumn{PbType: f.GetType()})
+				if kind == fieldKindEnum {
+					typ = "int32"
+				}
+			}
+		}
+		if seen[name] {
+			return "", nil, fmt.Errorf("@cache %s: key param %s used twice", c.Name, name)
+		}
+		seen[name] = true
+
+		arg := lowerFirst(goCamelCase(name))
+		if cacheReservedNames[arg] || repoReservedNames[arg] {
+			arg += "Arg"
+		}
+		params = append(params, &cacheKeyParam{Name: arg, GoType: typ})
+		format.WriteString("%v")
+	}
+	format.WriteString(strings.Replace(c.Key[last:], "%", "%%", -1))
+	return format.String(), params, nil
+}
+
+var redisCacheTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package %s
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"time"
+	%s
+)
+
+// RedisCache 由 message 注释中的 @cache 生成的 redis 访问函数
+type RedisCache struct {
+	c redis.Cmdable
+}
+
+func NewRedisCache(c redis.Cmdable) *RedisCache {
+	return &RedisCache{c: c}
+}
+
+// cacheTTL ttl 为 0 时使用声明的 ttl
+func cacheTTL(ttl, def time.Duration) time.Duration {
+	if ttl == 0 {
+		return def
+	}
+	return ttl
+}
+
+// cacheExpire ttl 为 0 表示不过期
+func cacheExpire(ctx context.Context, pipe redis.Pipeliner, key string, ttl time.Duration) {
+	if ttl > 0 {
+		pipe.Expire(ctx, key, ttl)
+	}
+}
+%s`
+
+var redisCacheKeyTemp = `
+// {{Name}}Key 缓存 {{Name}} 的 key: {{Key}}
+func {{Name}}Key({{Params}}) string {
+	return fmt.Sprintf({{Format}}, {{Args}})
+}
+
+const {{ttl}} = {{TTL}}
+`
+
+var redisCacheKeyNoArgTemp = `
+// {{Name}}Key 缓存 {{Name}} 的 key
+const {{Name}}Key = {{Format}}
+
+const {{ttl}} = {{TTL}}
+`
+
+var redisCacheStringTemp = `
+// Get{{Name}} 不存在时返回 nil, nil
+func (c *RedisCache) Get{{Name}}(ctx context.Context, {{Params}}) (*{{Value}}, error) {
+	b, err := c.c.Get(ctx, {{KeyExpr}}).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v {{Value}}
+	if err := {{Unmarshal}}(b, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Set{{Name}} ttl 为 0 时使用声明的 ttl
+func (c *RedisCache) Set{{Name}}(ctx context.Context, {{Params}}, v *{{Value}}, ttl time.Duration) error {
+	b, err := {{Marshal}}(v)
+	if err != nil {
+		return err
+	}
+	return c.c.Set(ctx, {{KeyExpr}}, b, cacheTTL(ttl, {{ttl}})).Err()
+}
+
+func (c *RedisCache) Del{{Name}}(ctx context.Context, {{Params}}) error {
+	return c.c.Del(ctx, {{KeyExpr}}).Err()
+}
+`
+
+var redisCacheHashTemp = `
+// Get{{Name}} 不存在时返回 nil, nil
+func (c *RedisCache) Get{{Name}}(ctx context.Context, {{Params}}, field string) (*{{Value}}, error) {
+	b, err := c.c.HGet(ctx, {{KeyExpr}}, field).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v {{Value}}
+	if err := {{Unmarshal}}(b, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (c *RedisCache) GetAll{{Name}}(ctx context.Context, {{Params}}) (map[string]*{{Value}}, error) {
+	res, err := c.c.HGetAll(ctx, {{KeyExpr}}).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string]*{{Value}}, len(res))
+	for field, s := range res {
+		var v {{Value}}
+		if err := {{Unmarshal}}([]byte(s), &v); err != nil {
+			return nil, err
+		}
+		list[field] = &v
+	}
+	return list, nil
+}
+
+// Set{{Name}} ttl 为 0 时使用声明的 ttl, 作用于整个 hash
+func (c *RedisCache) Set{{Name}}(ctx context.Context, {{Params}}, field string, v *{{Value}}, ttl time.Duration) error {
+	b, err := {{Marshal}}(v)
+	if err != nil {
+		return err
+	}
+	key := {{KeyExpr}}
+	_, err = c.c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, field, b)
+		cacheExpire(ctx, pipe, key, cacheTTL(ttl, {{ttl}}))
+		return nil
+	})
+	return err
+}
+
+// Del{{Name}} 删除指定的 field, 没有指定时删除整个 hash
+func (c *RedisCache) Del{{Name}}(ctx context.Context, {{Params}}, fields ...string) error {
+	if len(fields) == 0 {
+		return c.c.Del(ctx, {{KeyExpr}}).Err()
+	}
+	return c.c.HDel(ctx, {{KeyExpr}}, fields...).Err()
+}
+`
+
+var redisCacheListTemp = `
+// Push{{Name}} 添加到列表末尾, ttl 为 0 时使用声明的 ttl
+func (c *RedisCache) Push{{Name}}(ctx context.Context, {{Params}}, ttl time.Duration, vs ...*{{Value}}) error {
+	if len(vs) == 0 {
+		return nil
+	}
+	list := make([]interface{}, 0, len(vs))
+	for _, v := range vs {
+		b, err := {{Marshal}}(v)
+		if err != nil {
+			return err
+		}
+		list = append(list, b)
+	}
+	key := {{KeyExpr}}
+	_, err := c.c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, list...)
+		cacheExpire(ctx, pipe, key, cacheTTL(ttl, {{ttl}}))
+		return nil
+	})
+	return err
+}
+
+// Range{{Name}} 与 LRANGE 相同, stop 为 -1 时到列表末尾
+func (c *RedisCache) Range{{Name}}(ctx context.Context, {{Params}}, start, stop int64) ([]*{{Value}}, error) {
+	res, err := c.c.LRange(ctx, {{KeyExpr}}, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*{{Value}}, 0, len(res))
+	for _, s := range res {
+		var v {{Value}}
+		if err := {{Unmarshal}}([]byte(s), &v); err != nil {
+			return nil, err
+		}
+		list = append(list, &v)
+	}
+	return list, nil
+}
+
+func (c *RedisCache) Len{{Name}}(ctx context.Context, {{Params}}) (int64, error) {
+	return c.c.LLen(ctx, {{KeyExpr}}).Result()
+}
+
+func (c *RedisCache) Del{{Name}}(ctx context.Context, {{Params}}) error {
+	return c.c.Del(ctx, {{KeyExpr}}).Err()
+}
+`
+
+var redisCacheZsetTemp = `
+// Add{{Name}} 以编码后的 v 为成员, ttl 为 0 时使用声明的 ttl
+func (c *RedisCache) Add{{Name}}(ctx context.Context, {{Params}}, score float64, v *{{Value}}, ttl time.Duration) error {
+	b, err := {{Marshal}}(v)
+	if err != nil {
+		return err
+	}
+	key := {{KeyExpr}}
+	_, err = c.c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, redis.Z{Score: score, Member: b})
+		cacheExpire(ctx, pipe, key, cacheTTL(ttl, {{ttl}}))
+		return nil
+	})
+	return err
+}
+
+func (c *RedisCache) decode{{Name}}(res []string) ([]*{{Value}}, error) {
+	list := make([]*{{Value}}, 0, len(res))
+	for _, s := range res {
+		var v {{Value}}
+		if err := {{Unmarshal}}([]byte(s), &v); err != nil {
+			return nil, err
+		}
+		list = append(list, &v)
+	}
+	return list, nil
+}
+
+// Range{{Name}} 按 score 从小到大, 与 ZRANGE 相同
+func (c *RedisCache) Range{{Name}}(ctx context.Context, {{Params}}, start, stop int64) ([]*{{Value}}, error) {
+	res, err := c.c.ZRange(ctx, {{KeyExpr}}, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	return c.decode{{Name}}(res)
+}
+
+// RangeByScore{{Name}} 返回 score 在 [min, max] 之间的成员
+func (c *RedisCache) RangeByScore{{Name}}(ctx context.Context, {{Params}}, min, max float64) ([]*{{Value}}, error) {
+	res, err := c.c.ZRangeByScore(ctx, {{KeyExpr}}, &redis.ZRangeBy{
+		Min: strconv.FormatFloat(min, 'g', -1, 64),
+		Max: strconv.FormatFloat(max, 'g', -1, 64),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return c.decode{{Name}}(res)
+}
+
+// Rem{{Name}} 成员按编码后的内容比较
+func (c *RedisCache) Rem{{Name}}(ctx context.Context, {{Params}}, v *{{Value}}) error {
+	b, err := {{Marshal}}(v)
+	if err != nil {
+		return err
+	}
+	return c.c.ZRem(ctx, {{KeyExpr}}, b).Err()
+}
+
+func (c *RedisCache) Del{{Name}}(ctx context.Context, {{Params}}) error {
+	return c.c.Del(ctx, {{KeyExpr}}).Err()
+}
+`
+
+func cacheTTLExpr(d time.Duration) string {
+	s := int64(d / time.Second)
+	switch {
+	case s == 0:
+		return "time.Duration(0)"
+	case s%3600 == 0:
+		return fmt.Sprintf("%d * time.Hour", s/3600)
+	case s%60 == 0:
+		return fmt.Sprintf("%d * time.Minute", s/60)
+	}
+	return fmt.Sprintf("%d * time.Second", s)
+}
+
+var redisCacheDefaultTemp = `
+// DefaultRedisCache 使用 SetStateRedis -redis %s 记录的连接 %s, 连接不是 go-redis 的客户端时返回错误
+func DefaultRedisCache() (*RedisCache, error) {
+	h := %s
+	c, ok := interface{}(h).(redis.Cmdable)
+	if !ok {
+		return nil, fmt.Errorf("redis handle %s of %s is %%T, not redis.Cmdable", h)
+	}
+	return NewRedisCache(c), nil
+}
+`
+
+// litMatchConf 字符串字面量是 conf 或者以 .conf 结尾, 如 $dispatch.redis.redis4session
+func litMatchConf(n ast.Node, conf string) bool {
+	lit, ok := n.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return false
+	}
+	v, err := strconv.Unquote(lit.Value)
+	return err == nil && (v == conf || strings.HasSuffix(v, "."+conf))
+}
+
+// stateRedisHandle 在 SetStateRedis 生成的文件中找引用了 conf 的包级变量或无参函数,
+// 返回取得连接的表达式, 找不到时返回空
+func stateRedisHandle(fn, conf string) (string, error) {
+	if conf == "" || !FileExists(fn) {
+		return "", nil
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), fn, nil, 0)
+	if err != nil {
+		return "", err
+	}
+
+	// const redisConf = "redis4session" 之后通过常量引用
+	consts := make(map[string]bool)
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, v := range vs.Values {
+				if i < len(vs.Names) && litMatchConf(v, conf) {
+					consts[vs.Names[i].Name] = true
+				}
+			}
+		}
+	}
+	refers := func(n ast.Node) bool {
+		found := false
+		ast.Inspect(n, func(x ast.Node) bool {
+			if id, ok := x.(*ast.Ident); ok && consts[id.Name] {
+				found = true
+			}
+			if litMatchConf(x, conf) {
+				found = true
+			}
+			return !found
+		})
+		return found
+	}
+
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.GenDecl:
+			if d.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range d.Specs {
+				vs := spec.(*ast.ValueSpec)
+				if len(vs.Names) == 1 && len(vs.Values) == 1 && refers(vs.Values[0]) {
+					return vs.Names[0].Name, nil
+				}
+			}
+		case *ast.FuncDecl:
+			ft := d.Type
+			if d.Recv != nil || d.Body == nil || len(ft.Params.List) > 0 ||
+				ft.Results == nil || ft.Results.NumFields() != 1 {
+				continue
+			}
+			if refers(d.Body) {
+				return d.Name.Name + "()", nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// GenerateLogicStateRedisCache 为 message 上声明的 @cache 生成类型安全的 redis 访问函数,
+// conf 为 SetStateRedis 的 -redis, 用它在 stateredis 文件中找到连接生成 DefaultRedisCache
+func GenerateLogicStateRedisCache(PD *ProtoDetect, msgs []*PbMsg, rootDir, conf string) error {
+	fn := GetTargetFileName(*PD, "logic_state_redis_cache", rootDir)
+
+	pbPath := PD.GoPackageName
+	pbPkg := pbPath[strings.LastIndex(pbPath, "/")+1:]
+
+	var body []string
+	imports := []string{strconv.Quote(pbPath)}
+	used := make(map[string]bool)
+	use := func(pkg string) {
+		if !used[pkg] {
+			used[pkg] = true
+			imports = append(imports, strconv.Quote(pkg))
+		}
+	}
+	names := make(map[string]string)
+	for _, m := range msgs {
+		for _, c := range m.Caches {
+			if other, ok := names[c.Name]; ok {
+				return fmt.Errorf("@cache %s declared by both %s and %s", c.Name, other, m.FullName)
+			}
+			names[c.Name] = m.FullName
+
+			keyFmt, params, err := cacheKey(m, c)
+			if err != nil {
+				return err
+			}
+			var ps, args []string
+			for _, p := range params {
+				ps = append(ps, fmt.Sprintf("%s %s", p.Name, p.GoType))
+				args = append(args, p.Name)
+			}
+
+			marshal, unmarshal := "proto.Marshal", "proto.Unmarshal"
+			if c.Codec == CacheCodecJson {
+				marshal, unmarshal = "json.Marshal", "json.Unmarshal"
+				use("encoding/json")
+			} else {
+				use("github.com/golang/protobuf/proto")
+			}
+
+			keyTemp, keyExpr := redisCacheKeyTemp, fmt.Sprintf("%sKey(%s)", c.Name, strings.Join(args, ", "))
+			if len(params) == 0 {
+				// 常量 key 不经过 Sprintf, 不需要转义 %
+				keyTemp, keyExpr, keyFmt = redisCacheKeyNoArgTemp, c.Name+"Key", c.Key
+			} else {
+				use("fmt")
+			}
+
+			temp := redisCacheStringTemp
+			switch c.Type {
+			case CacheTypeHash:
+				temp = redisCacheHashTemp
+			case CacheTypeList:
+				temp = redisCacheListTemp
+			case CacheTypeZset:
+				temp = redisCacheZsetTemp
+				use("strconv")
+			}
+			if c.Type == CacheTypeString || c.Type == CacheTypeHash {
+				use("errors")
+			}
+			// 没有 key 参数时去掉参数列表中多余的逗号
+			if len(params) == 0 {
+				temp = strings.Replace(temp, "ctx context.Context, {{Params}})", "ctx context.Context)", -1)
+				temp = strings.Replace(temp, "{{Params}}, ", "", -1)
+			}
+
+			r := strings.NewReplacer(
+				"{{Name}}", c.Name,
+				"{{Key}}", c.Key,
+				"{{Format}}", strconv.Quote(keyFmt),
+				"{{Args}}", strings.Join(args, ", "),
+				"{{ttl}}", lowerFirst(c.Name)+"TTL",
+				"{{TTL}}", cacheTTLExpr(c.TTL),
+				"{{Value}}", pbPkg+"."+GoMsgName(m),
+				"{{Marshal}}", marshal,
+				"{{Unmarshal}}", unmarshal,
+				"{{KeyExpr}}", keyExpr,
+				"{{Params}}", strings.Join(ps, ", "),
+			)
+			body = append(body, r.Replace(keyTemp), r.Replace(temp))
+		}
+	}
+
+	if len(body) == 0 {
+		if FileExists(fn) {
+			return os.Remove(fn)
+		}
+		return nil
+	}
+
+	handle, err := stateRedisHandle(GetTargetFileName(*PD, "logic_state_redis", rootDir), conf)
+	if err != nil {
+		return err
+	}
+	if handle != "" {
+		use("fmt")
+		body = append(body, fmt.Sprintf(redisCacheDefaultTemp, conf, handle, handle, handle, conf))
+	} else {
+		log.Warnf("no redis handle of `%s` found, create the cache by NewRedisCache", conf)
+	}
+
+	context := fmt.Sprintf(redisCacheTemp, implPackageName(filepath.Dir(fn)),
+		strings.Join(imports, "\n\t"), strings.Join(body, ""))
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+
+	return ioutil.WriteFile(fn, src, 0644)
+}
@@ -0,0 +1,200 @@
+package logic
+
+import (
+	"github.com/emicklei/proto"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCacheProto = `syntax = "proto3";
+package user;
+
+// @cache: name=UserSession key=session:{uid} ttl=1h
+message Session {
+  uint64 uid = 1;
+  string token = 2;
+}
+
+// @cache: name=Online key=online:100% type=zset ttl=90 codec=json
+// @cache: name=CorpMembers key=corp:{corp_id:uint32}:{type} type=hash
+message Member {
+  uint64 uid = 1;
+  int32 type = 2;
+}
+`
+
+// parseTestCaches 解析 proto 并和 walkPb 一样填好 Caches
+func parseTestCaches(t *testing.T, src string) *ProtoSnapshot {
+	t.Helper()
+
+	snap := parseTestMsgs(t, src)
+	def, err := proto.NewParser(strings.NewReader(src)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caches := make(map[string][]*CacheSchema)
+	proto.Walk(def, proto.WithMessage(func(m *proto.Message) {
+		list, err := ParseMsgCaches(m)
+		if err != nil {
+			t.Fatalf("%s: %v", m.Name, err)
+		}
+		caches[m.Name] = list
+	}))
+	for _, m := range snap.Msgs {
+		m.Caches = caches[m.FullName]
+	}
+	return snap
+}
+
+func TestParseMsgCaches(t *testing.T) {
+	cases := []struct {
+		name    string
+		comment string
+		err     string
+	}{
+		{"default", "@cache: key=a:{uid}", ""},
+		{"no key", "@cache: name=A ttl=1", "missed key"},
+		{"bad item", "@cache: key=a ttl", "want key=value"},
+		{"bad ttl", "@cache: key=a ttl=1ms", "whole seconds"},
+		{"bad type", "@cache: key=a type=set", "unknown @cache type"},
+		{"bad codec", "@cache: key=a codec=xml", "unknown @cache codec"},
+		{"bad name", "@cache: key=a name=a-b", "not a valid identifier"},
+		{"unknown", "@cache: key=a size=1", "unknown @cache item"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			def, err := proto.NewParser(strings.NewReader(
+				"syntax = \"proto3\";\n// " + c.comment + "\nmessage M { uint64 uid = 1; }\n")).Parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var list []*CacheSchema
+			proto.Walk(def, proto.WithMessage(func(m *proto.Message) {
+				list, err = ParseMsgCaches(m)
+			}))
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want err containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != 1 || list[0].Name != "M" || list[0].Type != CacheTypeString || list[0].Codec != CacheCodecPb {
+				t.Fatalf("unexpected defaults %+v", list)
+			}
+		})
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	snap := parseTestCaches(t, testCacheProto)
+	member := snap.Msgs[1]
+
+	cases := []struct {
+		key    string
+		format string
+		params string
+		err    string
+	}{
+		{"online:100%", "online:100%%", "", ""},
+		{"m:{uid}:{type}", "m:%v:%v", "uid uint64, typeArg int32", ""},
+		{"m:{name}", "m:%v", "name string", ""},
+		{"m:{ctx:int64}", "m:%v", "ctxArg int64", ""},
+		{"m:{uid}:{uid}", "", "", "used twice"},
+	}
+
+	for _, c := range cases {
+		format, params, err := cacheKey(member, &CacheSchema{Name: "X", Key: c.key})
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("cacheKey(%s) want err %q, got %v", c.key, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cacheKey(%s) err %v", c.key, err)
+			continue
+		}
+		var ps []string
+		for _, p := range params {
+			ps = append(ps, p.Name+" "+p.GoType)
+		}
+		if format != c.format || strings.Join(ps, ", ") != c.params {
+			t.Errorf("cacheKey(%s) = %s (%s), want %s (%s)", c.key, format, strings.Join(ps, ", "), c.format, c.params)
+		}
+	}
+}
+
+func TestStateRedisHandle(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "var",
+			src:  "var other = newClient(\"x\")\nvar redisCli = newClient(\"redis4session\")\n",
+			want: "redisCli",
+		},
+		{
+			name: "dispatch path by const",
+			src:  "const redisConf = \"$dispatch.redis.redis4session\"\nvar cli = newClient(redisConf)\n",
+			want: "cli",
+		},
+		{
+			name: "func",
+			src:  "func StateRedis() *Client {\n\treturn getClient(\"redis4session\")\n}\n",
+			want: "StateRedis()",
+		},
+		{
+			name: "func with error",
+			src:  "func StateRedis() (*Client, error) {\n\treturn getClient(\"redis4session\")\n}\n",
+		},
+		{
+			name: "other conf",
+			src:  "var cli = newClient(\"redis4cache\")\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "userstateredis_autogen.go")
+			if err := ioutil.WriteFile(fn, []byte("package impl\n\n"+c.src), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := stateRedisHandle(fn, "redis4session")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("stateRedisHandle = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestGenerateLogicStateRedisCacheGolden(t *testing.T) {
+	snap := parseTestCaches(t, testCacheProto)
+	snap.PD.GoPackageName = "brick/user"
+	root := t.TempDir()
+
+	fn := GetTargetFileName(*snap.PD, "logic_state_redis", root)
+	err := ioutil.WriteFile(fn, []byte("package impl\n\nvar redisCli = newClient(\"redis4session\")\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GenerateLogicStateRedisCache(snap.PD, snap.Msgs, root, "redis4session"); err != nil {
+		t.Fatal(err)
+	}
+	got := readGenerated(t, GetTargetFileName(*snap.PD, "logic_state_redis_cache", root))
+	if !strings.Contains(string(got), `const OnlineKey = "online:100%"`) {
+		t.Error("constant key must not be escaped for Sprintf")
+	}
+	checkGolden(t, "stateredis_cache", got)
+}
@@ -0,0 +1,385 @@
+package logic
+
+import (
+	"brick/log"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var repoTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package %s
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	%s
+)
+
+// WithTx 在事务中执行 fn, fn 返回错误或 panic 时回滚, 用 repo.WithTx(tx) 得到事务中的 repo
+func WithTx(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return db.WithContext(ctx).Transaction(fn)
+}
+
+// Page 分页参数, Page 从 1 开始, Size 为 0 时使用默认值
+type Page struct {
+	Page int
+	Size int
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 1000
+)
+
+func (p Page) limit() (int, int) {
+	size := p.Size
+	if size <= 0 {
+		size = defaultPageSize
+	} else if size > maxPageSize {
+		size = maxPageSize
+	}
+	page := p.Page
+	if page < 1 {
+		page = 1
+	}
+	return (page - 1) * size, size
+}
+
+func applyWhere(db *gorm.DB, conds []interface{}) *gorm.DB {
+	if len(conds) > 0 {
+		db = db.Where(conds[0], conds[1:]...)
+	}
+	return db
+}
+%s`
+
+var repoModelTemp = `
+// {{Repo}} 表 {{Table}} 的增删改查
+type {{Repo}} struct {
+	db *gorm.DB
+}
+
+func New{{Repo}}(db *gorm.DB) *{{Repo}} {
+	return &{{Repo}}{db: db}
+}
+
+// WithTx 返回在事务 tx 中执行的 repo
+func (r *{{Repo}}) WithTx(tx *gorm.DB) *{{Repo}} {
+	return &{{Repo}}{db: tx}
+}
+
+// Get 按主键查询, 不存在时返回 nil, nil
+func (r *{{Repo}}) Get(ctx context.Context, {{PKParams}}) (*{{Model}}, error) {
+	var m {{Model}}
+	err := r.db.WithContext(ctx).Where(map[string]interface{}{ {{PKMap}} }).Take(&m).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// List 分页查询, conds 与 gorm 的 Where 参数相同, 返回当前页和总数
+func (r *{{Repo}}) List(ctx context.Context, page Page, conds ...interface{}) ([]*{{Model}}, int64, error) {
+	var total int64
+	err := applyWhere(r.db.WithContext(ctx).Model(&{{Model}}{}), conds).Count(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var list []*{{Model}}
+	offset, limit := page.limit()
+	err = applyWhere(r.db.WithContext(ctx), conds).
+		Order("{{OrderBy}}").Offset(offset).Limit(limit).Find(&list).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return list, total, nil
+}
+
+func (r *{{Repo}}) Create(ctx context.Context, m *{{Model}}) error {
+	return r.db.WithContext(ctx).Create(m).Error
+}
+
+// Update 按主键更新所有列, 包括零值, 记录不存在时返回 gorm.ErrRecordNotFound
+func (r *{{Repo}}) Update(ctx context.Context, m *{{Model}}) error {
+	res := r.db.WithContext(ctx).Model(m).Select("*").Omit({{PKOmit}}).Updates(m)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		var n int64
+		err := r.db.WithContext(ctx).Model(&{{Model}}{}).Where(map[string]interface{}{ {{PKMapM}} }).Count(&n).Error
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return gorm.ErrRecordNotFound
+		}
+	}
+	return nil
+}
+
+func (r *{{Repo}}) Delete(ctx context.Context, {{PKParams}}) error {
+	return r.db.WithContext(ctx).Where(map[string]interface{}{ {{PKMap}} }).Delete(&{{Model}}{}).Error
+}
+
+// Upsert 主键冲突时更新所有列. postgres/sqlite 的 ON CONFLICT 只处理主键冲突,
+// 唯一索引冲突仍然返回错误, 需要时用 UpsertBy<唯一索引列>
+func (r *{{Repo}}) Upsert(ctx context.Context, m *{{Model}}) error {
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{ {{PKColumns}} },
+		UpdateAll: true,
+	}).Create(m).Error
+}
+`
+
+var repoUpsertByTemp = `
+// {{Method}} 唯一索引 {{Index}} 冲突时更新除主键外的所有列
+func (r *{{Repo}}) {{Method}}(ctx context.Context, m *{{Model}}) error {
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{ {{Columns}} },
+		DoUpdates: clause.AssignmentColumns([]string{ {{Updates}} }),
+	}).Create(m).Error
+}
+`
+
+var repoTestTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package %s
+
+import (
+	"fmt"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"sync/atomic"
+	"testing"
+)
+
+// 建表语句, 与 GenMigration -driver sqlite 生成的一致
+var testDbSchema = []string{
+%s
+}
+
+var testDbSeq int64
+
+// newTestDb 打开一个建好表的内存 sqlite, 每次调用得到独立的库, 测试结束时关闭.
+// 用法: repo := NewUserRepo(newTestDb(t))
+func newTestDb(tb testing.TB) *gorm.DB {
+	tb.Helper()
+	dsn := fmt.Sprintf("file:testdb%%d?mode=memory&cache=shared", atomic.AddInt64(&testDbSeq, 1))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		tb.Fatalf("open sqlite err %%v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		tb.Fatalf("open sqlite err %%v", err)
+	}
+	tb.Cleanup(func() {
+		sqlDB.Close()
+	})
+
+	for _, s := range testDbSchema {
+		if err := db.Exec(s).Error; err != nil {
+			tb.Fatalf("create table err %%v\n%%s", err, s)
+		}
+	}
+	return db
+}
+`
+
+func pbGoType(c *DbColumn) string {
+	switch c.PbType {
+	case "string":
+		return "string"
+	case "bytes":
+		return "[]byte"
+	case "int32", "sint32", "sfixed32", "enum":
+		return "int32"
+	case "uint32", "fixed32":
+		return "uint32"
+	case "int64", "sint64", "sfixed64":
+		return "int64"
+	case "uint64", "fixed64":
+		return "uint64"
+	case "bool":
+		return "bool"
+	case "float":
+		return "float32"
+	case "double":
+		return "float64"
+	}
+	return "interface{}"
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	// ID -> id, UserID -> userID
+	i := 0
+	for i < len(s) && 'A' <= s[i] && s[i] <= 'Z' {
+		i++
+	}
+	if i > 1 && i < len(s) {
+		i--
+	}
+	return strings.ToLower(s[:i]) + s[i:]
+}
+
+// 参数名不能与 go 关键字和生成代码中的变量重名
+var repoReservedNames = map[string]bool{
+	"break": true, "case": true, "chan": true, "const": true, "continue": true, "default": true,
+	"defer": true, "else": true, "fallthrough": true, "for": true, "func": true, "go": true,
+	"goto": true, "if": true, "import": true, "interface": true, "map": true, "package": true,
+	"range": true, "return": true, "select": true, "struct": true, "switch": true, "type": true,
+	"var": true, "ctx": true, "m": true, "r": true,
+}
+
+// implPackageName 取目录下已有 go 文件的包名, 没有时为 impl
+func implPackageName(dir string) string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, fn := range files {
+		if strings.HasSuffix(fn, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), fn, nil, parser.PackageClauseOnly)
+		if err == nil {
+			return f.Name.Name
+		}
+	}
+	return "impl"
+}
+
+// GenerateLogicStateDbRepo 为每个 gorm 模型生成 <Msg>Repo, 使用 gorm 访问数据库
+func GenerateLogicStateDbRepo(PD *ProtoDetect, msgs []*PbMsg, rootDir string) error {
+	tables, err := BuildDbSchema(msgs)
+	if err != nil {
+		return err
+	}
+
+	fn := GetTargetFileName(*PD, "logic_state_db_repo", rootDir)
+	if len(tables) == 0 {
+		for _, x := range []string{fn, GetTargetFileName(*PD, "logic_state_db_test", rootDir)} {
+			if FileExists(x) {
+				if err := os.Remove(x); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	pbPath := PD.GoPackageName
+	pbPkg := pbPath[strings.LastIndex(pbPath, "/")+1:]
+
+	var body []string
+	for _, t := range tables {
+		var params, pkMap, pkMapM, pkOmit, pkCols, order []string
+		for _, c := range t.PKColumns() {
+			name := lowerFirst(c.Field)
+			if repoReservedNames[name] {
+				name += "Arg"
+			}
+			params = append(params, fmt.Sprintf("%s %s", name, pbGoType(c)))
+			pkMap = append(pkMap, fmt.Sprintf("%q: %s", c.Name, name))
+			pkMapM = append(pkMapM, fmt.Sprintf("%q: m.%s", c.Name, c.Field))
+			pkOmit = append(pkOmit, fmt.Sprintf("%q", c.Name))
+			pkCols = append(pkCols, fmt.Sprintf("{Name: %q}", c.Name))
+			order = append(order, c.Name)
+		}
+
+		r := strings.NewReplacer(
+			"{{Repo}}", t.Msg+"Repo",
+			"{{Table}}", t.Name,
+			"{{Model}}", pbPkg+"."+t.Msg,
+			"{{PKParams}}", strings.Join(params, ", "),
+			"{{PKMap}}", strings.Join(pkMap, ", "),
+			"{{PKMapM}}", strings.Join(pkMapM, ", "),
+			"{{PKOmit}}", strings.Join(pkOmit, ", "),
+			"{{PKColumns}}", strings.Join(pkCols, ", "),
+			"{{OrderBy}}", strings.Join(order, ", "),
+		)
+		body = append(body, r.Replace(repoModelTemp))
+
+		for _, x := range t.Indexes {
+			if !x.Unique {
+				continue
+			}
+			var method, cols, updates []string
+			for _, name := range x.Columns {
+				method = append(method, t.Column(name).Field)
+				cols = append(cols, fmt.Sprintf("{Name: %q}", name))
+			}
+			for _, c := range t.Columns {
+				if !c.PK && !inList(x.Columns, c.Name) {
+					updates = append(updates, fmt.Sprintf("%q", c.Name))
+				}
+			}
+			if len(updates) == 0 {
+				continue
+			}
+			body = append(body, strings.NewReplacer(
+				"{{Repo}}", t.Msg+"Repo",
+				"{{Model}}", pbPkg+"."+t.Msg,
+				"{{Method}}", "UpsertBy"+strings.Join(method, "And"),
+				"{{Index}}", x.Name,
+				"{{Columns}}", strings.Join(cols, ", "),
+				"{{Updates}}", strings.Join(updates, ", "),
+			).Replace(repoUpsertByTemp))
+		}
+	}
+
+	context := fmt.Sprintf(repoTemp, implPackageName(filepath.Dir(fn)),
+		fmt.Sprintf("%q", pbPath), strings.Join(body, ""))
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+
+	err = ioutil.WriteFile(fn, src, 0644)
+	if err != nil {
+		return err
+	}
+
+	return generateLogicStateDbTest(PD, tables, rootDir)
+}
+
+// generateLogicStateDbTest 生成 impl 包测试用的 newTestDb, 不需要数据库服务
+func generateLogicStateDbTest(PD *ProtoDetect, tables []*DbTable, rootDir string) error {
+	fn := GetTargetFileName(*PD, "logic_state_db_test", rootDir)
+
+	var list []string
+	for _, t := range tables {
+		for _, s := range (sqliteDialect{}).CreateTable(t) {
+			if strings.Contains(s, "`") {
+				s = strconv.Quote(s)
+			} else {
+				s = "`" + s + "`"
+			}
+			list = append(list, "\t"+s+",")
+		}
+	}
+
+	context := fmt.Sprintf(repoTestTemp, implPackageName(filepath.Dir(fn)), strings.Join(list, "\n"))
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+
+	return ioutil.WriteFile(fn, src, 0644)
+}
@@ -0,0 +1,94 @@
+package logic
+
+import (
+	"testing"
+)
+
+func TestLowerFirst(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"Id", "id"},
+		{"ID", "id"},
+		{"UserID", "userID"},
+		{"HTTPCode", "httpCode"},
+		{"corpId", "corpId"},
+	}
+
+	for _, c := range cases {
+		if got := lowerFirst(c.in); got != c.want {
+			t.Errorf("lowerFirst(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestGenerateLogicStateDbRepoGolden(t *testing.T) {
+	src := testModelProto + `
+message Member {
+  uint32 corp_id = 1 [(ext.db).pk = true];
+  uint64 user_id = 2 [(ext.db).pk = true];
+  string type = 3;
+}
+`
+	pbGo := testModelPbGo + "\nfunc (*Member) TableName() string {\n\treturn \"members\"\n}\n"
+	snap := parseTestModels(t, src, pbGo)
+	snap.PD.GoPackageName = "brick/user"
+	root := t.TempDir()
+
+	if err := GenerateLogicStateDbRepo(snap.PD, snap.Msgs, root); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "statedb_repo", readGenerated(t, GetTargetFileName(*snap.PD, "logic_state_db_repo", root)))
+	checkGolden(t, "statedb_test", readGenerated(t, GetTargetFileName(*snap.PD, "logic_state_db_test", root)))
+
+	// 没有模型时删除之前生成的文件
+	SetMsgTables(snap.Msgs, nil)
+	if err := GenerateLogicStateDbRepo(snap.PD, snap.Msgs, root); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []string{"logic_state_db_repo", "logic_state_db_test"} {
+		if FileExists(GetTargetFileName(*snap.PD, x, root)) {
+			t.Errorf("%s not removed without models", x)
+		}
+	}
+}
+
+func TestCheckStateDbConf(t *testing.T) {
+	cases := []struct {
+		conf, driver string
+		ok           bool
+	}{
+		{"", DriverPostgres, true},
+		{"$dispatch.postgres.default", DriverPostgres, true},
+		{"$dispatch.mysql.default", DriverPostgres, false},
+		{"$dispatch.sqlite.default", DriverMysql, false},
+		{"$dispatch.custom.default", DriverMysql, true},
+	}
+
+	for _, c := range cases {
+		err := CheckStateDbConf(c.conf, c.driver)
+		if (err == nil) != c.ok {
+			t.Errorf("CheckStateDbConf(%q, %q) = %v, want ok %v", c.conf, c.driver, err, c.ok)
+		}
+	}
+}
+
+func TestGenerateLogicStateDbDriverGolden(t *testing.T) {
+	PD := NewProtoDetect()
+	PD.PackageName = "user"
+	PD.SvrName = "user"
+	PD.GoPackageName = "brick/user"
+	root := t.TempDir()
+
+	err := GenerateLogicStateDbDriver(PD, root, "$dispatch.postgres.default", DriverPostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "statedb_driver", readGenerated(t, GetTargetFileName(*PD, "logic_state_db_driver", root)))
+
+	err = GenerateLogicStateDbDriver(PD, root, "$dispatch.mysql.default", DriverPostgres)
+	if err == nil {
+		t.Error("conf of another driver accepted")
+	}
+}
@@ -0,0 +1,554 @@
+package logic
+
+import (
+	"brick/log"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var serverBootstrapTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package main
+
+import (
+	"brick/log"
+	"context"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"google.golang.org/grpc"
+	{{Import}}
+)
+
+// 启动参数由环境变量设置:
+//
+//	{{ENV}}_CONF           配置文件路径, 默认 {{Svr}}.toml
+//	{{ENV}}_CONF_RELOAD_SECONDS  检查配置文件修改的间隔, 修改后重新加载 [config], 默认 10, 0 表示不检查
+//	{{ENV}}_ADMIN_ADDR     健康检查, /metrics 和 pprof 的监听地址, 如 127.0.0.1:9100, 为空时不监听
+//	{{ENV}}_GRPC_ADDR      gRPC 监听地址, 和 brick/rpc 使用同一份 impl, 为空时不监听
+//	{{ENV}}_RPC_ADDR       brick/rpc 的监听地址, 可以连接后才报告就绪, 默认取 [server] 中的 addr/listen/port
+//	{{ENV}}_PPROF          为 1 时开启 /debug/pprof, 运行中可以用 /debug/pprof/enable?on=0|1 切换
+//	{{ENV}}_DRAIN_SECONDS  收到退出信号后先报告未就绪, 等待负载均衡摘除的时间, 默认 5
+//	{{ENV}}_STOP_SECONDS   等待处理中的请求结束的最长时间, 默认 30
+//
+// /healthz 进程存活时返回 200, /readyz 在 brick/rpc 开始监听之后, 收到退出信号之前返回 200
+const (
+	envConf         = "{{ENV}}_CONF"
+	envConfReload   = "{{ENV}}_CONF_RELOAD_SECONDS"
+	envAdminAddr    = "{{ENV}}_ADMIN_ADDR"
+	envRpcAddr      = "{{ENV}}_RPC_ADDR"
+	envPprof        = "{{ENV}}_PPROF"
+	envDrainSeconds = "{{ENV}}_DRAIN_SECONDS"
+	envStopSeconds  = "{{ENV}}_STOP_SECONDS"
+)
+
+// cmdPaths 服务注册的所有 rpc
+var cmdPaths = []string{
+{{Paths}}
+}
+
+var (
+	serverReady  int32
+	pprofEnabled int32
+)
+
+func envSeconds(name string, def int) time.Duration {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second
+	}
+	return time.Duration(def) * time.Second
+}
+
+func confFile() string {
+	if fn := os.Getenv(envConf); fn != "" {
+		return fn
+	}
+	return "{{Svr}}.toml"
+}
+
+// rpcAddr brick/rpc 的监听地址, 用于就绪检查, 监听所有地址时检查本机
+func rpcAddr() string {
+	if addr := os.Getenv(envRpcAddr); addr != "" {
+		return addr
+	}
+
+	var conf struct {
+		Server map[string]interface{} ` + "`toml:\"server\"`" + `
+	}
+	if _, err := toml.DecodeFile(confFile(), &conf); err != nil {
+		return ""
+	}
+	var keys []string
+	for k := range conf.Server {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key := strings.ToLower(k)
+		switch v := conf.Server[k].(type) {
+		case int64:
+			if key == "port" || strings.HasSuffix(key, "_port") {
+				return net.JoinHostPort("127.0.0.1", strconv.FormatInt(v, 10))
+			}
+		case string:
+			if !strings.Contains(key, "addr") && key != "listen" {
+				continue
+			}
+			host, port, err := net.SplitHostPort(v)
+			if err != nil {
+				continue
+			}
+			if host == "" || host == "0.0.0.0" || host == "::" {
+				host = "127.0.0.1"
+			}
+			return net.JoinHostPort(host, port)
+		}
+	}
+	return ""
+}
+
+// waitListening 返回的 chan 在 addr 可以连接后关闭, addr 为空时立即关闭
+func waitListening(addr string) <-chan struct{} {
+	ready := make(chan struct{})
+	if addr == "" {
+		log.Warnf("rpc addr not found in [server] of %s, set %s to report ready after listening", confFile(), envRpcAddr)
+		close(ready)
+		return ready
+	}
+	go func() {
+		for {
+			c, err := net.DialTimeout("tcp", addr, time.Second)
+			if err == nil {
+				c.Close()
+				close(ready)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	return ready
+}
+
+func pprofGate(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&pprofEnabled) == 0 {
+			http.Error(w, "pprof disabled", http.StatusNotFound)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func startAdmin() *http.Server {
+	addr := os.Getenv(envAdminAddr)
+	if addr == "" {
+		log.Infof("%s not set, health endpoints disabled", envAdminAddr)
+		return nil
+	}
+	if os.Getenv(envPprof) == "1" {
+		atomic.StoreInt32(&pprofEnabled, 1)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&serverReady) == 0 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/debug/pprof/enable", func(w http.ResponseWriter, r *http.Request) {
+		on := r.URL.Query().Get("on") != "0"
+		var v int32
+		if on {
+			v = 1
+		}
+		atomic.StoreInt32(&pprofEnabled, v)
+		log.Infof("pprof enabled=%v", on)
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/debug/pprof/", pprofGate(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", pprofGate(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", pprofGate(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", pprofGate(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", pprofGate(pprof.Trace))
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("listen admin addr %s err %v", addr, err)
+	}
+	s := &http.Server{Handler: mux}
+	go s.Serve(ln)
+	log.Infof("admin listen=%s pprof=%v", ln.Addr(), atomic.LoadInt32(&pprofEnabled) == 1)
+	return s
+}
+
+// runServer 启动服务并处理退出信号, 生成代码时 main 中的 Serve 调用会被改写为:
+//
+//	runServer(func() error { return svr.Serve() }, stopServer(svr))
+//
+// serve 阻塞直到服务停止; stop 停止接收新请求并等待处理中的请求结束, ctx 超时后应立即返回.
+// 收到 SIGINT/SIGTERM 后依次: 报告未就绪, 等待摘除, stop, onShutdown. 再次收到信号时立即退出
+func runServer(serve func() error, stop func(ctx context.Context) error) {
+	log.Infof("server starting svr=%s pid=%d rpc=%d", {{Pkg}}.SvrName, os.Getpid(), len(cmdPaths))
+	for _, path := range cmdPaths {
+		log.Infof("rpc path=%s cmd_id=%d", path, {{Pkg}}.Path2CmdID[path])
+	}
+
+	admin := startAdmin()
+
+	err := initConfig(confFile(), envSeconds(envConfReload, 10))
+	if err != nil {
+		log.Fatalf("server load config err %v", err)
+	}
+	err = onInit(context.Background())
+	if err != nil {
+		log.Fatalf("server init err %v", err)
+	}
+	err = initInterceptors(confFile())
+	if err != nil {
+		log.Fatalf("server init interceptors err %v", err)
+	}
+	grpcSvr, err := startGrpc()
+	if err != nil {
+		log.Fatalf("server start grpc err %v", err)
+	}
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serve()
+	}()
+
+	ready := waitListening(rpcAddr())
+	var s os.Signal
+	for s == nil {
+		select {
+		case <-ready:
+			ready = nil
+			atomic.StoreInt32(&serverReady, 1)
+			log.Infof("server ready svr=%s", {{Pkg}}.SvrName)
+		case err := <-done:
+			atomic.StoreInt32(&serverReady, 0)
+			if err != nil {
+				log.Errorf("server stopped err %v", err)
+			}
+			shutdown(admin, grpcSvr, nil, 0)
+			if err != nil {
+				os.Exit(1)
+			}
+			return
+		case s = <-sig:
+		}
+	}
+	atomic.StoreInt32(&serverReady, 0)
+	log.Infof("server got signal %v, draining", s)
+
+	go func() {
+		s := <-sig
+		log.Errorf("server got signal %v again, exit now", s)
+		os.Exit(1)
+	}()
+
+	time.Sleep(envSeconds(envDrainSeconds, 5))
+	shutdown(admin, grpcSvr, stop, envSeconds(envStopSeconds, 30))
+}
+
+// stopServer 用 svr 的 Shutdown, Stop 或 Close 停止接收请求, 不接受 ctx 的方法在 ctx 超时后不再等待
+func stopServer(svr interface{}) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		switch s := svr.(type) {
+		case interface{ Shutdown(context.Context) error }:
+			return s.Shutdown(ctx)
+		case interface{ Stop(context.Context) error }:
+			return s.Stop(ctx)
+		case interface{ Stop() error }:
+			return waitStop(ctx, s.Stop)
+		case interface{ Stop() }:
+			return waitStop(ctx, func() error {
+				s.Stop()
+				return nil
+			})
+		case interface{ Close() error }:
+			return waitStop(ctx, s.Close)
+		}
+		log.Warnf("server %T has no Shutdown, Stop or Close, exit without waiting requests", svr)
+		return nil
+	}
+}
+
+func waitStop(ctx context.Context, stop func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- stop()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func shutdown(admin *http.Server, grpcSvr *grpc.Server, stop func(ctx context.Context) error, timeout time.Duration) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stopGrpc(ctx, grpcSvr)
+	if stop != nil {
+		if err := stop(ctx); err != nil {
+			log.Errorf("server stop err %v", err)
+		}
+	}
+	if err := onShutdown(ctx); err != nil {
+		log.Errorf("server shutdown hook err %v", err)
+	}
+	if admin != nil {
+		admin.Shutdown(ctx)
+	}
+	log.Infof("server exit svr=%s", {{Pkg}}.SvrName)
+}
+`
+
+var serverHooksTemp = `package main
+
+import (
+	"context"
+)
+
+// 这个文件只在不存在时生成, 重新生成代码不会覆盖
+
+// onInit 在服务开始接收请求之前调用, 用于初始化连接池, 加载配置等, 返回错误时进程退出
+func onInit(ctx context.Context) error {
+	return nil
+}
+
+// onShutdown 在服务停止接收请求并且处理中的请求结束之后调用, 用于关闭连接, 刷新缓冲等
+func onShutdown(ctx context.Context) error {
+	return nil
+}
+`
+
+// envName 服务名转成环境变量前缀: user_svr -> USER_SVR
+func envName(s string) string {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z':
+			c -= 'a' - 'A'
+		case ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9'):
+		default:
+			c = '_'
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
+
+// GenerateServerBootstrap 生成 server 的启动和退出流程, 以及只生成一次的用户 hook 文件
+func GenerateServerBootstrap(PD ProtoDetect, rootDir string) error {
+	fn := GetTargetFileName(PD, "server_bootstrap", rootDir)
+
+	pbPath := PD.GoPackageName
+	imp := strconv.Quote(pbPath)
+	if pbPath[strings.LastIndex(pbPath, "/")+1:] != PD.PackageName {
+		imp = PD.PackageName + " " + imp
+	}
+
+	var paths []string
+	for _, v := range PD.RpcList {
+		paths = append(paths, fmt.Sprintf("\t%s.%sCMDPath,", PD.PackageName, v.MethodName))
+	}
+
+	r := strings.NewReplacer(
+		"{{ENV}}", envName(PD.SvrName),
+		"{{Svr}}", PD.SvrName,
+		"{{Pkg}}", PD.PackageName,
+		"{{Import}}", imp,
+		"{{Paths}}", strings.Join(paths, "\n"),
+	)
+	context := r.Replace(serverBootstrapTemp)
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+	err = writeGenRegionFile(fn, src, "server.bootstrap")
+	if err != nil {
+		return err
+	}
+
+	// GenerateServer 每次都会重新生成 main, 在它之后改写
+	if svr := GetTargetFileName(PD, "server", rootDir); FileExists(svr) {
+		if err := wireServerMain(svr); err != nil {
+			return err
+		}
+	}
+
+	hooks := GetTargetFileName(PD, "server_hooks", rootDir)
+	if FileExists(hooks) {
+		return nil
+	}
+	return ioutil.WriteFile(hooks, []byte(serverHooksTemp), 0644)
+}
+
+// 阻塞运行 brick/rpc server 的方法
+var serveMethods = map[string]bool{"Serve": true, "ListenAndServe": true, "Run": true, "Start": true}
+
+// wireServerMain 把 main 中最后一个 Serve 调用所在的语句改写为 runServer, 已经调用 runServer 时不修改
+func wireServerMain(fn string) error {
+	src, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	fSet := token.NewFileSet()
+	f, err := parser.ParseFile(fSet, fn, src, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+
+	var main *ast.FuncDecl
+	for _, decl := range f.Decls {
+		if t, ok := decl.(*ast.FuncDecl); ok && t.Recv == nil && t.Name.Name == "main" && t.Body != nil {
+			main = t
+		}
+	}
+	if main == nil {
+		return fmt.Errorf("%s has no func main", fn)
+	}
+	if callsFunc(main.Body, "runServer") {
+		return nil
+	}
+
+	// 改写后不再使用的 import 由 fixImports 删除
+	var managed []string
+	pkgs := make(map[string]bool)
+	for _, spec := range f.Imports {
+		pkgs[importName(spec)] = true
+		if spec.Name != nil {
+			managed = append(managed, spec.Name.Name+" "+spec.Path.Value)
+		} else {
+			managed = append(managed, spec.Path.Value)
+		}
+	}
+
+	text := func(n ast.Node) string {
+		return string(src[fSet.Position(n.Pos()).Offset:fSet.Position(n.End()).Offset])
+	}
+	for i := len(main.Body.List) - 1; i >= 0; i-- {
+		stmt := main.Body.List[i]
+		call := findServeCall(stmt)
+		if call == nil {
+			continue
+		}
+
+		// 语句直接调用时忽略返回值, 和原来一致; 否则把调用的结果当作 error
+		serve := "func() error { return " + text(call) + " }"
+		if x, ok := stmt.(*ast.ExprStmt); ok && x.X == call {
+			serve = "func() error {\n" + text(call) + "\nreturn nil\n}"
+		}
+		stop := "nil"
+		sel := call.Fun.(*ast.SelectorExpr)
+		if recv := serveReceiver(sel.X, pkgs); recv != nil {
+			stop = "stopServer(" + text(recv) + ")"
+		} else {
+			log.Warnf("%s: %s is not called on a server value, requests are not drained on exit", fn, text(call.Fun))
+		}
+		repl := fmt.Sprintf("runServer(%s, %s)", serve, stop)
+
+		// err := svr.Serve() 之后的语句可能还在使用 err
+		if x, ok := stmt.(*ast.AssignStmt); ok && x.Tok == token.DEFINE {
+			var names []string
+			for _, v := range x.Lhs {
+				if id, ok := v.(*ast.Ident); ok && id.Name != "_" {
+					names = append(names, id.Name)
+				}
+			}
+			if len(names) > 0 {
+				repl = "var " + strings.Join(names, ", ") + " error\n" + repl
+			}
+		}
+
+		out := string(src[:fSet.Position(stmt.Pos()).Offset]) + repl + string(src[fSet.Position(stmt.End()).Offset:])
+		b, err := fixImports(fn, []byte(out), managed)
+		if err != nil {
+			log.Errorf("format %s err %v", fn, err)
+			return err
+		}
+		log.Infof("%s: main serves through runServer", fn)
+		return ioutil.WriteFile(fn, b, 0644)
+	}
+	return fmt.Errorf("%s: no Serve or Run call found in main, call runServer(serve, stop) from main", fn)
+}
+
+func callsFunc(n ast.Node, name string) bool {
+	found := false
+	ast.Inspect(n, func(n ast.Node) bool {
+		if c, ok := n.(*ast.CallExpr); ok {
+			if id, ok := c.Fun.(*ast.Ident); ok && id.Name == name {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// findServeCall 查找语句中同步执行的 Serve 调用, 不看 go, defer 和函数字面量
+func findServeCall(stmt ast.Stmt) *ast.CallExpr {
+	var found *ast.CallExpr
+	ast.Inspect(stmt, func(n ast.Node) bool {
+		switch t := n.(type) {
+		case *ast.FuncLit, *ast.GoStmt, *ast.DeferStmt:
+			return false
+		case *ast.CallExpr:
+			if sel, ok := t.Fun.(*ast.SelectorExpr); ok && serveMethods[sel.Sel.Name] {
+				found = t
+			}
+		}
+		return found == nil
+	})
+	return found
+}
+
+// serveReceiver 返回 svr.Serve 中的 svr, 包函数或者需要调用才能得到的值返回 nil
+func serveReceiver(x ast.Expr, pkgs map[string]bool) ast.Expr {
+	switch t := x.(type) {
+	case *ast.Ident:
+		if pkgs[t.Name] {
+			return nil
+		}
+		return t
+	case *ast.SelectorExpr:
+		if serveReceiver(t.X, nil) != nil {
+			return t
+		}
+	}
+	return nil
+}
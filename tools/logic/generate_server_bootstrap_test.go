@@ -0,0 +1,131 @@
+package logic
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"user", "USER"},
+		{"user_svr", "USER_SVR"},
+		{"shop-v2", "SHOP_V2"},
+	}
+
+	for _, c := range cases {
+		if got := envName(c.in); got != c.want {
+			t.Errorf("envName(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestWireServerMain(t *testing.T) {
+	cases := []struct {
+		name string
+		main string
+		want []string // 改写后 main 中应有的片段
+		err  string
+	}{
+		{
+			name: "bare call",
+			main: "import (\n\t\"brick/rpc\"\n)\n\nfunc main() {\n\tsvr := rpc.NewServer()\n\tsvr.Serve()\n}\n",
+			want: []string{"runServer(func() error {\n\t\tsvr.Serve()\n\t\treturn nil\n\t}, stopServer(svr))"},
+		},
+		{
+			name: "fatal wrapper",
+			main: "import (\n\t\"brick/log\"\n\t\"brick/rpc\"\n)\n\nfunc main() {\n\tsvr := rpc.NewServer()\n\tlog.Fatal(svr.Serve())\n}\n",
+			want: []string{"runServer(func() error { return svr.Serve() }, stopServer(svr))"},
+		},
+		{
+			name: "err used later",
+			main: "import (\n\t\"brick/log\"\n\t\"brick/rpc\"\n)\n\nfunc main() {\n\tsvr := rpc.NewServer()\n\terr := svr.Serve()\n\tif err != nil {\n\t\tlog.Fatal(err)\n\t}\n}\n",
+			want: []string{"var err error\n\trunServer(func() error { return svr.Serve() }, stopServer(svr))", "\"brick/log\""},
+		},
+		{
+			name: "package func",
+			main: "import \"brick/rpc\"\n\nfunc main() {\n\trpc.Serve(\":8080\")\n\tgo rpc.Start()\n}\n",
+			want: []string{"runServer(func() error {\n\t\trpc.Serve(\":8080\")\n\t\treturn nil\n\t}, nil)"},
+		},
+		{
+			name: "already wired",
+			main: "func main() {\n\trunServer(serve, nil)\n}\n",
+			want: []string{"runServer(serve, nil)"},
+		},
+		{
+			name: "no serve",
+			main: "func main() {\n\tgo serve()\n}\n",
+			err:  "no Serve or Run call",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "shop.go")
+			if err := ioutil.WriteFile(fn, []byte("package main\n\n"+c.main), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := wireServerMain(fn)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want err containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := string(readGenerated(t, fn))
+			for _, w := range c.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("want %q in\n%s", w, got)
+				}
+			}
+			if strings.Contains(c.name, "fatal") && strings.Contains(got, "brick/log") {
+				t.Errorf("unused import left in\n%s", got)
+			}
+
+			// 再次生成时不重复改写
+			if err := wireServerMain(fn); err != nil {
+				t.Fatal(err)
+			}
+			if again := string(readGenerated(t, fn)); again != got {
+				t.Errorf("second run changed main:\n%s", lineDiff(got, again))
+			}
+		})
+	}
+}
+
+func TestGenerateServerBootstrapGolden(t *testing.T) {
+	PD := testClientPD()
+	root := t.TempDir()
+	svr := GetTargetFileName(*PD, "server", root)
+	err := ioutil.WriteFile(svr, []byte("package main\n\nfunc main() {\n\tsvr := newServer()\n\tsvr.Serve()\n}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GenerateServerBootstrap(*PD, root); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "server_bootstrap", readGenerated(t, GetTargetFileName(*PD, "server_bootstrap", root)))
+	if !strings.Contains(string(readGenerated(t, svr)), "runServer(") {
+		t.Error("main not wired to runServer")
+	}
+
+	// hook 文件只生成一次
+	hooks := GetTargetFileName(*PD, "server_hooks", root)
+	if err := ioutil.WriteFile(hooks, []byte("package main\n// user code\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateServerBootstrap(*PD, root); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(readGenerated(t, hooks)), "user code") {
+		t.Error("hooks file overwritten")
+	}
+}
@@ -0,0 +1,444 @@
+package logic
+
+import (
+	"brick/log"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var serverGrpcTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package main
+
+import (
+	"brick/log"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	{{Import}}
+)
+
+// {{ENV}}_GRPC_ADDR gRPC 监听地址, 如 0.0.0.0:8081, 为空时不启动.
+// 服务名 {{Service}}, 方法名和 proto 中的一致, gateway 可以直接按 {{Service}}.<method> 调用
+const envGrpcAddr = "{{ENV}}_GRPC_ADDR"
+
+// gRPC 方法 -> CMDPath, 拦截器按 CMDPath 配置
+var grpcMethod2Path = map[string]string{
+{{Paths}}
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: "{{Service}}",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+{{Methods}}
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "{{Proto}}",
+}
+
+{{Handlers}}
+
+// grpcInterceptor 让 gRPC 请求经过和 brick/rpc 相同的拦截器链
+func grpcInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	path, ok := grpcMethod2Path[info.FullMethod]
+	if !ok {
+		rsp, err := handler(ctx, req)
+		return rsp, grpcError(ctx, err)
+	}
+	rsp, err := intercept(ctx, path, req, rpcHandler(handler))
+	return rsp, grpcError(ctx, err)
+}
+
+// grpcError 把 impl 返回的错误转成 gRPC status, 错误码放在 trailer 的 err-code 中.
+// 状态码依次取: 错误码的 HTTPStatus, 拦截器指定的状态码, 有错误码时 FailedPrecondition, 其它 Internal
+func grpcError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+
+	code, msg := codes.Internal, err.Error()
+	var re *rpcError
+	if errors.As(err, &re) {
+		code = re.code
+	}
+	var e interface{ Code() uint32 }
+	if errors.As(err, &e) {
+		grpc.SetTrailer(ctx, metadata.Pairs("err-code", strconv.FormatUint(uint64(e.Code()), 10)))
+		if m, ok := e.(interface{ Message() string }); ok {
+			msg = m.Message()
+		}
+		if re == nil {
+			code = codes.FailedPrecondition
+		}
+		if h, ok := e.(interface{ HTTPStatus() int }); ok && h.HTTPStatus() != 0 {
+			code = httpGrpcCode(h.HTTPStatus())
+		}
+	}
+	return status.Error(code, msg)
+}
+
+// httpGrpcCode 错误码 option(ext.HttpStatus) 对应的 gRPC 状态码
+func httpGrpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	if httpStatus >= 500 {
+		return codes.Internal
+	}
+	return codes.FailedPrecondition
+}
+
+func startGrpc() (*grpc.Server, error) {
+	addr := os.Getenv(envGrpcAddr)
+	if addr == "" {
+		log.Infof("%s not set, grpc disabled", envGrpcAddr)
+		return nil, nil
+	}
+{{Check}}	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen grpc addr %s err %v", addr, err)
+	}
+	s := grpc.NewServer(grpc.UnaryInterceptor(grpcInterceptor))
+	s.RegisterService(&grpcServiceDesc, nil)
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			log.Errorf("grpc serve err %v", err)
+		}
+	}()
+	log.Infof("grpc listen=%s service=%s", ln.Addr(), grpcServiceDesc.ServiceName)
+	return s, nil
+}
+
+// stopGrpc 等待处理中的 gRPC 请求结束, ctx 超时后强制关闭连接
+func stopGrpc(ctx context.Context, s *grpc.Server) {
+	if s == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.Stop()
+	}
+}
+`
+
+var grpcHandlerTemp = `
+func grpc{{Method}}(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := &{{Req}}{}
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		{{Call}}
+	}
+	if interceptor == nil {
+		rsp, err := handler(ctx, in)
+		return rsp, grpcError(ctx, err)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/{{Service}}/{{Method}}"}
+	return interceptor(ctx, in, info, handler)
+}
+`
+
+var grpcCtxTemp = `package main
+
+import (
+%s
+)
+
+// 这个文件只在不存在时生成, 重新生成代码不会覆盖
+
+// grpcContext 把 gRPC 请求的 ctx 转成 impl 使用的 ctx, 可以在这里从 metadata 中取出调用方信息
+func grpcContext(ctx context.Context) %s {
+	%s
+}
+
+// checkGrpcContext 设置了 {{ENV}}_GRPC_ADDR 时在启动 gRPC 前调用, 返回错误时启动失败
+func checkGrpcContext() error {
+	%s
+}
+`
+
+// grpcCheckTemp startGrpc 中检查 grpcContext 已经实现
+const grpcCheckTemp = `	if err := checkGrpcContext(); err != nil {
+		return nil, err
+	}
+`
+
+// implFunc impl 中 rpc 的实现函数, 支持两种写法:
+//
+//	func Method(ctx, req *Req) (*Rsp, error)
+//	func Method(ctx, req *Req, rsp *Rsp) error
+type implFunc struct {
+	fillRsp bool
+	ctxType string
+	ctxPkg  string // ctxType 引用的 import path
+}
+
+func exprString(fSet *token.FileSet, x ast.Expr) string {
+	var buf bytes.Buffer
+	printer.Fprint(&buf, fSet, x)
+	return buf.String()
+}
+
+// parseImplFuncs 找出 impl 目录中所有包级函数的参数形式
+func parseImplFuncs(dir string) map[string]*implFunc {
+	m := make(map[string]*implFunc)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, fn := range files {
+		if strings.HasSuffix(fn, "_test.go") {
+			continue
+		}
+		fSet := token.NewFileSet()
+		f, err := parser.ParseFile(fSet, fn, nil, 0)
+		if err != nil {
+			log.Warnf("parse %s err %v", fn, err)
+			continue
+		}
+		imports := make(map[string]string)
+		for _, x := range f.Imports {
+			path, _ := strconv.Unquote(x.Path.Value)
+			name := path[strings.LastIndex(path, "/")+1:]
+			if x.Name != nil {
+				name = x.Name.Name
+			}
+			imports[name] = path
+		}
+
+		for _, decl := range f.Decls {
+			t, ok := decl.(*ast.FuncDecl)
+			if !ok || t.Recv != nil {
+				continue
+			}
+			var params []ast.Expr
+			for _, p := range t.Type.Params.List {
+				n := len(p.Names)
+				if n == 0 {
+					n = 1
+				}
+				for i := 0; i < n; i++ {
+					params = append(params, p.Type)
+				}
+			}
+			results := 0
+			if t.Type.Results != nil {
+				results = t.Type.Results.NumFields()
+			}
+
+			x := &implFunc{}
+			switch {
+			case len(params) == 2 && results == 2:
+			case len(params) == 3 && results == 1:
+				x.fillRsp = true
+			default:
+				continue
+			}
+			x.ctxType = exprString(fSet, params[0])
+			ast.Inspect(params[0], func(n ast.Node) bool {
+				if s, ok := n.(*ast.SelectorExpr); ok {
+					if id, ok := s.X.(*ast.Ident); ok {
+						x.ctxPkg = imports[id.Name]
+					}
+				}
+				return true
+			})
+			m[t.Name.Name] = x
+		}
+	}
+	return m
+}
+
+// implImport impl 目录的 import, 包名和目录名不同时带上包名
+func implImport(pbPath, implPkg string) string {
+	imp := strconv.Quote(pbPath + "/impl")
+	if implPkg != "impl" {
+		imp = implPkg + " " + imp
+	}
+	return imp
+}
+
+// GenerateServerGrpc 生成 gRPC 的 ServiceDesc, 把请求转给 impl 中和 rpc 同名的函数,
+// 和 brick/rpc 共用同一份实现, 由 runServer 启动. impl 由 GenerateLogic 生成, 需要在它之后调用,
+// 新加的 rpc 在同一次生成中就能注册到 gRPC
+func GenerateServerGrpc(PD ProtoDetect, rootDir string) error {
+	fn := GetTargetFileName(PD, "server_grpc", rootDir)
+
+	pbPath := PD.GoPackageName
+	imports := []string{strconv.Quote(pbPath)}
+	if pbPath[strings.LastIndex(pbPath, "/")+1:] != PD.PackageName {
+		imports[0] = PD.PackageName + " " + imports[0]
+	}
+
+	implDir := filepath.Dir(GetTargetFileName(PD, "logic", rootDir))
+	implPkg := implPackageName(implDir)
+	funcs := parseImplFuncs(implDir)
+
+	service := PD.PackageName + "." + PD.SvrName
+	var ctx *implFunc
+	var methods, paths, handlers []string
+	for _, v := range PD.RpcList {
+		// 没有注册的方法 gRPC 直接返回 Unimplemented
+		f := funcs[v.MethodName]
+		if strings.Contains(v.ReqType, ".") || strings.Contains(v.RspType, ".") {
+			log.Warnf("rpc %s uses imported message, skipped in grpc", v.MethodName)
+			continue
+		}
+		if f == nil {
+			log.Warnf("rpc %s not found in %s, skipped in grpc", v.MethodName, implDir)
+			continue
+		}
+		if ctx == nil {
+			ctx = f
+		}
+		methods = append(methods, fmt.Sprintf("\t\t{MethodName: %q, Handler: grpc%s},", v.MethodName, v.MethodName))
+		paths = append(paths, fmt.Sprintf("\t\"/%s/%s\": %s.%sCMDPath,", service, v.MethodName, PD.PackageName, v.MethodName))
+
+		req := PD.PackageName + "." + v.ReqType
+		call := fmt.Sprintf(`rsp, err := %s.%s(grpcContext(ctx), req.(*%s))
+		if err != nil {
+			return nil, err
+		}
+		return rsp, nil`, implPkg, v.MethodName, req)
+		if f.fillRsp {
+			call = fmt.Sprintf(`rsp := &%s.%s{}
+		if err := %s.%s(grpcContext(ctx), req.(*%s), rsp); err != nil {
+			return nil, err
+		}
+		return rsp, nil`, PD.PackageName, v.RspType, implPkg, v.MethodName, req)
+		}
+
+		r := strings.NewReplacer(
+			"{{Method}}", v.MethodName,
+			"{{Req}}", req,
+			"{{Call}}", call,
+			"{{Service}}", service,
+		)
+		handlers = append(handlers, r.Replace(grpcHandlerTemp))
+	}
+
+	if len(handlers) > 0 {
+		imports = append(imports, implImport(pbPath, implPkg))
+	} else {
+		// 没有方法时 pb 和 impl 包都没有用到
+		imports = nil
+	}
+
+	// 还没有实现任何 rpc 时不知道 impl 的 ctx 类型, 等有实现后再生成.
+	// 之前生成的文件可能没有 checkGrpcContext, 这时不检查
+	ctxFn := GetTargetFileName(PD, "server_grpc_ctx", rootDir)
+	if ctx != nil && !FileExists(ctxFn) {
+		if err := generateGrpcContext(ctxFn, envName(PD.SvrName), ctx); err != nil {
+			return err
+		}
+	}
+	check := ""
+	if hasFuncDecl(ctxFn, "checkGrpcContext") {
+		check = grpcCheckTemp
+	}
+
+	r := strings.NewReplacer(
+		"{{ENV}}", envName(PD.SvrName),
+		"{{Service}}", service,
+		"{{Proto}}", PD.PackageName+".proto",
+		"{{Import}}", strings.Join(imports, "\n\t"),
+		"{{Methods}}", strings.Join(methods, "\n"),
+		"{{Paths}}", strings.Join(paths, "\n"),
+		"{{Handlers}}", strings.Join(handlers, ""),
+		"{{Check}}", check,
+	)
+	context := r.Replace(serverGrpcTemp)
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+	return writeGenRegionFile(fn, src, "server.grpc")
+}
+
+// hasFuncDecl fn 中是否声明了函数 name, 文件不存在或解析失败时返回 false
+func hasFuncDecl(fn string, name string) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), fn, nil, 0)
+	if err != nil {
+		return false
+	}
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok && d.Recv == nil && d.Name.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// generateGrpcContext impl 使用 context.Context 时直接传递, 否则生成一个需要用户补充的转换函数,
+// 补充之前 checkGrpcContext 返回错误, 开启 gRPC 时启动失败, 而不是悄悄丢掉 deadline 和 metadata
+func generateGrpcContext(fn string, env string, f *implFunc) error {
+	imports := []string{`"context"`}
+	typ := "context.Context"
+	body := "return ctx"
+	check := "return nil"
+	if f.ctxType != typ {
+		typ = f.ctxType
+		imports = append(imports, `"errors"`)
+		if f.ctxPkg != "" && f.ctxPkg != "context" {
+			imports = append(imports, strconv.Quote(f.ctxPkg))
+		}
+		body = "panic(checkGrpcContext())"
+		check = fmt.Sprintf("// 实现 grpcContext 后改为 return nil\n\treturn errors.New(%q)",
+			fmt.Sprintf("grpcContext in %s is not implemented", filepath.Base(fn)))
+	}
+
+	context := fmt.Sprintf(grpcCtxTemp, "\t"+strings.Join(imports, "\n\t"), typ, body, check)
+	context = strings.Replace(context, "{{ENV}}", env, -1)
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+	return ioutil.WriteFile(fn, src, 0644)
+}
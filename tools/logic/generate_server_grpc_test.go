@@ -0,0 +1,107 @@
+package logic
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testGrpcImpl = `package impl
+
+import (
+	"context"
+
+	"shop"
+	"shop/ictx"
+)
+
+func Login(ctx *ictx.Context, req *shop.LoginReq) (*shop.LoginRsp, error) {
+	return nil, nil
+}
+
+func Logout(ctx context.Context, req *shop.LogoutReq, rsp *shop.LogoutRsp) error {
+	return nil
+}
+
+func helper(a int) int {
+	return a
+}
+`
+
+func writeTestImpl(t *testing.T, PD *ProtoDetect, root string) string {
+	t.Helper()
+
+	dir := filepath.Dir(GetTargetFileName(*PD, "logic", root))
+	if err := ioutil.WriteFile(filepath.Join(dir, "shopimpl.go"), []byte(testGrpcImpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestParseImplFuncs(t *testing.T) {
+	PD := testClientPD()
+	funcs := parseImplFuncs(writeTestImpl(t, PD, t.TempDir()))
+
+	cases := []struct {
+		name    string
+		fillRsp bool
+		ctxType string
+		ctxPkg  string
+	}{
+		{"Login", false, "*ictx.Context", "shop/ictx"},
+		{"Logout", true, "context.Context", "context"},
+	}
+	for _, c := range cases {
+		f := funcs[c.name]
+		if f == nil {
+			t.Errorf("%s not found", c.name)
+			continue
+		}
+		if f.fillRsp != c.fillRsp || f.ctxType != c.ctxType || f.ctxPkg != c.ctxPkg {
+			t.Errorf("%s = %+v, want %v %s %s", c.name, *f, c.fillRsp, c.ctxType, c.ctxPkg)
+		}
+	}
+	if funcs["helper"] != nil {
+		t.Error("helper is not an rpc implementation")
+	}
+}
+
+func TestGenerateServerGrpcGolden(t *testing.T) {
+	PD := testClientPD()
+	PD.RpcList = append(PD.RpcList, &RpcNode{MethodName: "Missing", ReqType: "LoginReq", RspType: "LoginRsp"})
+	root := t.TempDir()
+	writeTestImpl(t, PD, root)
+
+	if err := GenerateServerGrpc(*PD, root); err != nil {
+		t.Fatal(err)
+	}
+	got := readGenerated(t, GetTargetFileName(*PD, "server_grpc", root))
+	if strings.Contains(string(got), "grpcMissing") {
+		t.Error("rpc without impl registered")
+	}
+	checkGolden(t, "server_grpc", got)
+
+	// ctx 转换函数按第一个实现的 ctx 类型生成, 之后不再覆盖
+	ctxFn := GetTargetFileName(*PD, "server_grpc_ctx", root)
+	ctxSrc := string(readGenerated(t, ctxFn))
+	for _, w := range []string{
+		"func grpcContext(ctx context.Context) *ictx.Context {\n\tpanic(checkGrpcContext())",
+		`return errors.New("grpcContext in shopgrpc.go is not implemented")`,
+	} {
+		if !strings.Contains(ctxSrc, w) {
+			t.Errorf("missing %q in grpc ctx file\n%s", w, ctxSrc)
+		}
+	}
+
+	// 之前生成的 ctx 文件没有 checkGrpcContext 时不检查
+	if err := ioutil.WriteFile(ctxFn, []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateServerGrpc(*PD, root); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(readGenerated(t, GetTargetFileName(*PD, "server_grpc", root))), "checkGrpcContext") {
+		t.Error("checkGrpcContext called but not declared")
+	}
+}
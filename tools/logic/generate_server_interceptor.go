@@ -0,0 +1,709 @@
+package logic
+
+import (
+	"brick/log"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var serverInterceptorTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package main
+
+import (
+	"brick/log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	{{Import}}
+)
+
+// rpcError 拦截器拒绝请求时的错误, 带上对应的 gRPC 状态码, 不影响 errors.As 取得原来的错误
+type rpcError struct {
+	code codes.Code
+	err  error
+}
+
+func (e *rpcError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rpcError) Unwrap() error {
+	return e.err
+}
+
+// rpcInfo 一次调用的 rpc 信息
+type rpcInfo struct {
+	Path  string
+	CmdID int
+	Flags uint32
+}
+
+type rpcHandler func(ctx context.Context, req interface{}) (interface{}, error)
+
+// rpcInterceptor 调用 next 继续执行后面的拦截器和 impl, 不调用时请求到此结束
+type rpcInterceptor func(ctx context.Context, info *rpcInfo, req interface{}, next rpcHandler) (interface{}, error)
+
+// interceptorConf 对应 {{Svr}}.toml 中的 [interceptors], 没有配置的项使用默认值
+type interceptorConf struct {
+	Chain     []string ` + "`toml:\"chain\"`" + `
+	SlowMs    int      ` + "`toml:\"slow_ms\"`" + `
+	AuthFlags uint32   ` + "`toml:\"auth_flags\"`" + `
+}
+
+var interceptorCfg = interceptorConf{
+	Chain:  []string{{{Chain}}},
+	SlowMs: 500,
+}
+
+// 内置的拦截器, 在 onInit 中调用 registerInterceptor 可以添加自定义的拦截器, 然后在 chain 中引用
+var interceptors = map[string]rpcInterceptor{
+	"trace":    traceInterceptor,
+	"recovery": recoveryInterceptor,
+	"logging":  loggingInterceptor,
+	"metrics":  metricsInterceptor,
+	"auth":     authInterceptor,
+	"validate": validateInterceptor,
+}
+
+// 由 option(ext.Interceptors) 指定, -name 表示不使用, name 表示追加到链尾
+var methodInterceptors = map[string][]string{
+{{Overrides}}
+}
+
+// path -> 拦截器链, 由 runServer 中的 initInterceptors 生成, 之后不再修改
+var rpcChains map[string][]rpcInterceptor
+
+func registerInterceptor(name string, f rpcInterceptor) {
+	interceptors[name] = f
+}
+
+func methodChain(base []string, overrides []string) []string {
+	skip := make(map[string]bool)
+	for _, x := range overrides {
+		if strings.HasPrefix(x, "-") {
+			skip[x[1:]] = true
+		}
+	}
+	var names []string
+	for _, x := range base {
+		if !skip[x] {
+			names = append(names, x)
+			skip[x] = true
+		}
+	}
+	for _, x := range overrides {
+		if x = strings.TrimPrefix(x, "+"); !skip[x] && !strings.HasPrefix(x, "-") {
+			names = append(names, x)
+			skip[x] = true
+		}
+	}
+	return names
+}
+
+// initInterceptors 读取 fn 中的 [interceptors], 为每个 rpc 生成拦截器链, 引用了不存在的拦截器时返回错误
+func initInterceptors(fn string) error {
+	c := interceptorCfg
+	if _, err := os.Stat(fn); err == nil {
+		conf := struct {
+			Interceptors *interceptorConf ` + "`toml:\"interceptors\"`" + `
+		}{&c}
+		if _, err := toml.DecodeFile(fn, &conf); err != nil {
+			return fmt.Errorf("parse %s err %v", fn, err)
+		}
+	} else {
+		log.Warnf("conf %s not found, use default interceptors", fn)
+	}
+
+	chains := make(map[string][]rpcInterceptor)
+	for path := range {{Pkg}}.Path2CmdID {
+		names := methodChain(c.Chain, methodInterceptors[path])
+		var list []rpcInterceptor
+		for _, name := range names {
+			f := interceptors[name]
+			if f == nil {
+				return fmt.Errorf("unknown interceptor %s of %s", name, path)
+			}
+			list = append(list, f)
+		}
+		chains[path] = list
+		log.Infof("rpc path=%s interceptors=%s", path, strings.Join(names, ","))
+	}
+	interceptorCfg = c
+	rpcChains = chains
+	return nil
+}
+
+// intercept 按 path 的拦截器链调用 h, gRPC 和 brick/rpc 的请求都通过它进入 impl.
+// 还没有调用 initInterceptors 或者 path 不是本服务的 rpc 时拒绝请求, 不会绕过拦截器
+func intercept(ctx context.Context, path string, req interface{}, h rpcHandler) (interface{}, error) {
+	info := &rpcInfo{Path: path, CmdID: {{Pkg}}.Path2CmdID[path], Flags: {{Pkg}}.Path2Flags[path]}
+	chain, ok := rpcChains[path]
+	if !ok {
+		log.Errorf("rpc path=%s has no interceptor chain, initInterceptors not called", path)
+		return nil, &rpcError{codes.Internal, fmt.Errorf("no interceptor chain for %s", path)}
+	}
+	var call func(i int) rpcHandler
+	call = func(i int) rpcHandler {
+		if i == len(chain) {
+			return h
+		}
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			return chain[i](ctx, info, req, call(i+1))
+		}
+	}
+	return call(0)(ctx, req)
+}
+
+func recoveryInterceptor(ctx context.Context, info *rpcInfo, req interface{}, next rpcHandler) (rsp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("rpc path=%s trace=%s panic %v\n%s", info.Path, traceID(ctx), r, debug.Stack())
+			rsp, err = nil, &rpcError{codes.Internal, errors.New("internal error")}
+		}
+	}()
+	return next(ctx, req)
+}
+
+const traceHeader = "x-trace-id"
+
+type traceKey struct{}
+
+// traceID 返回请求的 trace id, 由 trace 拦截器从请求的 x-trace-id 中取出, 没有时生成一个
+func traceID(ctx context.Context) string {
+	s, _ := ctx.Value(traceKey{}).(string)
+	return s
+}
+
+func traceInterceptor(ctx context.Context, info *rpcInfo, req interface{}, next rpcHandler) (interface{}, error) {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(traceHeader); len(v) > 0 {
+			id = v[0]
+		}
+	}
+	if id == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	// 不是 gRPC 请求时返回错误, 忽略
+	grpc.SetHeader(ctx, metadata.Pairs(traceHeader, id))
+	return next(context.WithValue(ctx, traceKey{}, id), req)
+}
+
+func loggingInterceptor(ctx context.Context, info *rpcInfo, req interface{}, next rpcHandler) (interface{}, error) {
+	start := time.Now()
+	rsp, err := next(ctx, req)
+	cost := time.Since(start)
+	if err != nil {
+		log.Errorf("rpc path=%s cmd_id=%d trace=%s cost=%v err %v", info.Path, info.CmdID, traceID(ctx), cost, err)
+	} else if slow := time.Duration(interceptorCfg.SlowMs) * time.Millisecond; slow > 0 && cost > slow {
+		log.Warnf("rpc path=%s cmd_id=%d trace=%s cost=%v slow", info.Path, info.CmdID, traceID(ctx), cost)
+	}
+	return rsp, err
+}
+
+type rpcStat struct {
+	calls   uint64
+	errors  uint64
+	seconds float64
+}
+
+var (
+	rpcStatsMu sync.Mutex
+	rpcStats   = make(map[string]*rpcStat)
+)
+
+func metricsInterceptor(ctx context.Context, info *rpcInfo, req interface{}, next rpcHandler) (interface{}, error) {
+	start := time.Now()
+	rsp, err := next(ctx, req)
+	cost := time.Since(start).Seconds()
+
+	rpcStatsMu.Lock()
+	s := rpcStats[info.Path]
+	if s == nil {
+		s = &rpcStat{}
+		rpcStats[info.Path] = s
+	}
+	s.calls++
+	if err != nil {
+		s.errors++
+	}
+	s.seconds += cost
+	rpcStatsMu.Unlock()
+	return rsp, err
+}
+
+// metricsHandler 以 prometheus 的文本格式输出 rpc 统计, 挂在 admin 的 /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	rpcStatsMu.Lock()
+	stats := make(map[string]rpcStat, len(rpcStats))
+	var paths []string
+	for path, s := range rpcStats {
+		stats[path] = *s
+		paths = append(paths, path)
+	}
+	rpcStatsMu.Unlock()
+	sort.Strings(paths)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, typ string
+		value     func(s rpcStat) string
+	}{
+		{"rpc_requests_total", "counter", func(s rpcStat) string { return fmt.Sprint(s.calls) }},
+		{"rpc_errors_total", "counter", func(s rpcStat) string { return fmt.Sprint(s.errors) }},
+		{"rpc_duration_seconds_sum", "counter", func(s rpcStat) string { return fmt.Sprint(s.seconds) }},
+	} {
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+		for _, path := range paths {
+			fmt.Fprintf(w, "%s{svr=%q,path=%q} %s\n", m.name, {{Pkg}}.SvrName, path, m.value(stats[path]))
+		}
+	}
+}
+
+// authInterceptor rpc 的 Flags 和 auth_flags 有交集时调用 checkAuth
+func authInterceptor(ctx context.Context, info *rpcInfo, req interface{}, next rpcHandler) (interface{}, error) {
+	if info.Flags&interceptorCfg.AuthFlags != 0 {
+		if err := checkAuth(ctx, info, req); err != nil {
+			log.Warnf("rpc path=%s trace=%s auth err %v", info.Path, traceID(ctx), err)
+			return nil, &rpcError{codes.Unauthenticated, err}
+		}
+	}
+	return next(ctx, req)
+}
+
+{{Wrappers}}
+func validateInterceptor(ctx context.Context, info *rpcInfo, req interface{}, next rpcHandler) (interface{}, error) {
+	if v, ok := req.(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			return nil, &rpcError{codes.InvalidArgument, err}
+		}
+	}
+	return next(ctx, req)
+}
+`
+
+var serverAuthTemp = `package main
+
+import (
+	"context"
+	"errors"
+)
+
+// 这个文件只在不存在时生成, 重新生成代码不会覆盖
+
+// checkAuth 在 rpc 的 Flags 和 [interceptors] auth_flags 有交集时调用, 返回错误时拒绝请求.
+// 可以从 ctx 的 metadata 中取出 token 校验, 返回 *ErrCode 生成的错误
+func checkAuth(ctx context.Context, info *rpcInfo, req interface{}) error {
+	return errors.New("auth not implemented")
+}
+`
+
+var rpcWrapperTemp = `
+// rpc{{Method}} brick/rpc 注册的 {{Method}}, 经过拦截器链后调用 {{Impl}}.{{Method}}
+func rpc{{Method}}({{Params}}) {{Results}} {
+	{{Body}}
+}
+`
+
+var rpcStdContextTemp = `
+// rpcStdContext impl 的 ctx 实现了 context.Context 时交给拦截器, 否则拦截器使用 Background
+func rpcStdContext(ctx interface{}) context.Context {
+	if c, ok := ctx.(context.Context); ok && c != nil {
+		return c
+	}
+	return context.Background()
+}
+`
+
+var serverInterceptorTestTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	{{Import}}
+)
+
+func TestMethodChain(t *testing.T) {
+	cases := []struct {
+		base, overrides, want []string
+	}{
+		{[]string{"trace", "auth"}, nil, []string{"trace", "auth"}},
+		{[]string{"trace", "auth"}, []string{"-auth"}, []string{"trace"}},
+		{[]string{"trace"}, []string{"boom", "+boom"}, []string{"trace", "boom"}},
+		{[]string{"trace", "trace"}, nil, []string{"trace"}},
+		{[]string{"trace"}, []string{"-boom", "boom"}, []string{"trace"}},
+		{[]string{"trace"}, []string{"trace"}, []string{"trace"}},
+	}
+
+	for _, c := range cases {
+		got := strings.Join(methodChain(c.base, c.overrides), ",")
+		if want := strings.Join(c.want, ","); got != want {
+			t.Errorf("methodChain(%v, %v) = %s, want %s", c.base, c.overrides, got, want)
+		}
+	}
+}
+
+// registerTestInterceptors 注册 option(ext.Interceptors) 引用的自定义拦截器, 它们一般在 onInit 中注册
+func registerTestInterceptors() {
+	for _, list := range methodInterceptors {
+		for _, x := range list {
+			if name := strings.TrimLeft(x, "+-"); interceptors[name] == nil {
+				registerInterceptor(name, func(ctx context.Context, info *rpcInfo, req interface{}, next rpcHandler) (interface{}, error) {
+					return next(ctx, req)
+				})
+			}
+		}
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	path := {{Path}}
+	saved, savedCfg := rpcChains, interceptorCfg
+	defer func() {
+		rpcChains, interceptorCfg = saved, savedCfg
+	}()
+
+	rpcChains = nil
+	called := false
+	_, err := intercept(context.Background(), path, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	if err == nil || called {
+		t.Fatal("request passed without interceptor chain")
+	}
+
+	registerTestInterceptors()
+	fn := filepath.Join(t.TempDir(), "{{Svr}}.toml")
+	err = ioutil.WriteFile(fn, []byte("[interceptors]\nchain = [\"trace\", \"nope\"]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initInterceptors(fn); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Fatalf("want unknown interceptor err, got %v", err)
+	}
+
+	err = ioutil.WriteFile(fn, []byte("[interceptors]\nchain = [\"trace\", \"recovery\"]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initInterceptors(fn); err != nil {
+		t.Fatal(err)
+	}
+	_, err = intercept(context.Background(), path, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		if traceID(ctx) == "" {
+			t.Error("trace interceptor not run")
+		}
+		panic("boom")
+	})
+	var re *rpcError
+	if !errors.As(err, &re) {
+		t.Fatalf("want panic recovered as rpcError, got %v", err)
+	}
+}
+`
+
+// 默认的拦截器顺序, trace 在最外层, 之后的日志都能带上 trace id, recovery 捕获之后所有拦截器和 impl 的 panic
+var defaultInterceptors = []string{"trace", "recovery", "logging", "metrics", "auth", "validate"}
+
+var interceptorConfTemp = `
+[interceptors]
+# 按顺序执行, 内置 %s
+# rpc 可以用 option(ext.Interceptors) = "-auth,name" 去掉或追加
+chain = [%s]
+# 耗时超过 slow_ms 的请求打印 warn 日志, 0 表示不打印
+slow_ms = 500
+# rpc 的 Flags 和 auth_flags 有交集时需要通过 checkAuth
+auth_flags = 0
+`
+
+func quoteList(list []string) string {
+	var out []string
+	for _, x := range list {
+		out = append(out, strconv.Quote(x))
+	}
+	return strings.Join(out, ", ")
+}
+
+// GenerateServerInterceptor 生成所有 rpc 共用的拦截器链, 配置在 <svr>.toml 的 [interceptors] 中,
+// conf 中还没有这一节时追加默认配置
+func GenerateServerInterceptor(PD ProtoDetect, rootDir string) error {
+	fn := GetTargetFileName(PD, "server_interceptor", rootDir)
+
+	pbPath := PD.GoPackageName
+	imp := strconv.Quote(pbPath)
+	if pbPath[strings.LastIndex(pbPath, "/")+1:] != PD.PackageName {
+		imp = PD.PackageName + " " + imp
+	}
+
+	var overrides []string
+	for _, v := range PD.RpcList {
+		if len(v.Interceptors) == 0 {
+			continue
+		}
+		overrides = append(overrides, fmt.Sprintf("\t%s.%sCMDPath: {%s},", PD.PackageName, v.MethodName, quoteList(v.Interceptors)))
+	}
+
+	implDir := filepath.Dir(GetTargetFileName(PD, "logic", rootDir))
+	implPkg := implPackageName(implDir)
+	wrappers, wrapped, imports := rpcWrappers(PD, implPkg, parseImplFuncs(implDir))
+	if len(wrappers) > 0 {
+		imports = append([]string{imp, implImport(pbPath, implPkg)}, imports...)
+		wrappers = append(wrappers, rpcStdContextTemp)
+	} else {
+		imports = []string{imp}
+	}
+
+	r := strings.NewReplacer(
+		"{{Svr}}", PD.SvrName,
+		"{{Pkg}}", PD.PackageName,
+		"{{Import}}", strings.Join(imports, "\n\t"),
+		"{{Chain}}", quoteList(defaultInterceptors),
+		"{{Overrides}}", strings.Join(overrides, "\n"),
+		"{{Wrappers}}", strings.Join(wrappers, ""),
+	)
+	context := r.Replace(serverInterceptorTemp)
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+	err = writeGenRegionFile(fn, src, "server.interceptor")
+	if err != nil {
+		return err
+	}
+
+	err = generateServerInterceptorTest(PD, rootDir, imp)
+	if err != nil {
+		return err
+	}
+
+	// GenerateServer 生成的 main 直接注册 impl 的函数, 改为注册经过拦截器的 rpc<Method>
+	if svr := GetTargetFileName(PD, "server", rootDir); FileExists(svr) && len(wrapped) > 0 {
+		if err := wireServerImpl(svr, pbPath+"/impl", wrapped); err != nil {
+			return err
+		}
+	}
+
+	err = appendInterceptorConf(GetTargetFileName(PD, "conf", rootDir))
+	if err != nil {
+		return err
+	}
+
+	auth := GetTargetFileName(PD, "server_auth", rootDir)
+	if FileExists(auth) {
+		return nil
+	}
+	return ioutil.WriteFile(auth, []byte(serverAuthTemp), 0644)
+}
+
+func appendInterceptorConf(fn string) error {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "[interceptors]" {
+			return nil
+		}
+	}
+
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, interceptorConfTemp, strings.Join(defaultInterceptors, ", "), quoteList(defaultInterceptors))
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		log.Infof("append [interceptors] to %s", fn)
+	}
+	return err
+}
+
+// rpcWrappers 为 impl 中实现了的 rpc 生成和 impl 函数签名相同的 rpc<Method>, 返回生成的代码,
+// 方法名列表和 ctx 类型需要的 import
+func rpcWrappers(PD ProtoDetect, implPkg string, funcs map[string]*implFunc) ([]string, map[string]bool, []string) {
+	var wrappers, imports []string
+	wrapped := make(map[string]bool)
+	seen := map[string]bool{"context": true}
+	for _, v := range PD.RpcList {
+		f := funcs[v.MethodName]
+		if f == nil || strings.Contains(v.ReqType, ".") || strings.Contains(v.RspType, ".") {
+			continue
+		}
+		if f.ctxPkg != "" && !seen[f.ctxPkg] {
+			seen[f.ctxPkg] = true
+			imports = append(imports, strconv.Quote(f.ctxPkg))
+		}
+
+		req := PD.PackageName + "." + v.ReqType
+		rsp := PD.PackageName + "." + v.RspType
+		path := fmt.Sprintf("%s.%sCMDPath", PD.PackageName, v.MethodName)
+
+		// impl 使用 context.Context 时传入拦截器处理后的 ctx, 可以取到 trace id
+		ctx, implCtx := "rpcStdContext(ctx)", "ctx"
+		if f.ctxType == "context.Context" {
+			ctx, implCtx = "ctx", "c"
+		}
+
+		var params, results, body string
+		if f.fillRsp {
+			params = fmt.Sprintf("ctx %s, req *%s, rsp *%s", f.ctxType, req, rsp)
+			results = "error"
+			body = fmt.Sprintf(`_, err := intercept(%s, %s, req, func(c context.Context, req interface{}) (interface{}, error) {
+		return rsp, %s.%s(%s, req.(*%s), rsp)
+	})
+	return err`, ctx, path, implPkg, v.MethodName, implCtx, req)
+		} else {
+			params = fmt.Sprintf("ctx %s, req *%s", f.ctxType, req)
+			results = fmt.Sprintf("(*%s, error)", rsp)
+			body = fmt.Sprintf(`rsp, err := intercept(%s, %s, req, func(c context.Context, req interface{}) (interface{}, error) {
+		return %s.%s(%s, req.(*%s))
+	})
+	if err != nil {
+		return nil, err
+	}
+	x, _ := rsp.(*%s)
+	return x, nil`, ctx, path, implPkg, v.MethodName, implCtx, req, rsp)
+		}
+
+		r := strings.NewReplacer(
+			"{{Method}}", v.MethodName,
+			"{{Impl}}", implPkg,
+			"{{Params}}", params,
+			"{{Results}}", results,
+			"{{Body}}", body,
+		)
+		wrappers = append(wrappers, r.Replace(rpcWrapperTemp))
+		wrapped[v.MethodName] = true
+	}
+	return wrappers, wrapped, imports
+}
+
+// generateServerInterceptorTest 生成拦截器链的测试, 和生成的代码一起在服务中运行
+func generateServerInterceptorTest(PD ProtoDetect, rootDir, imp string) error {
+	fn := GetTargetFileName(PD, "server_interceptor_test", rootDir)
+	if len(PD.RpcList) == 0 {
+		if FileExists(fn) {
+			return os.Remove(fn)
+		}
+		return nil
+	}
+
+	r := strings.NewReplacer(
+		"{{Svr}}", PD.SvrName,
+		"{{Import}}", imp,
+		"{{Path}}", fmt.Sprintf("%s.%sCMDPath", PD.PackageName, PD.RpcList[0].MethodName),
+	)
+	src, err := format.Source([]byte(r.Replace(serverInterceptorTestTemp)))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+	return writeGenRegionFile(fn, src, "server.interceptor_test")
+}
+
+// wireServerImpl 把 main 中引用的 impl.<Method> 换成 rpc<Method>, 让 brick/rpc 的请求也经过拦截器,
+// 已经换过时不修改
+func wireServerImpl(fn string, implPath string, wrapped map[string]bool) error {
+	src, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	fSet := token.NewFileSet()
+	f, err := parser.ParseFile(fSet, fn, src, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+
+	implName := ""
+	var managed []string
+	for _, spec := range f.Imports {
+		if p, _ := strconv.Unquote(spec.Path.Value); p == implPath {
+			implName = importName(spec)
+		}
+		if spec.Name != nil {
+			managed = append(managed, spec.Name.Name+" "+spec.Path.Value)
+		} else {
+			managed = append(managed, spec.Path.Value)
+		}
+	}
+
+	var list []*ast.SelectorExpr
+	if implName != "" {
+		ast.Inspect(f, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if id, ok := sel.X.(*ast.Ident); ok && id.Name == implName && wrapped[sel.Sel.Name] {
+					list = append(list, sel)
+				}
+			}
+			return true
+		})
+	}
+	if len(list) == 0 {
+		if !refersWrapper(f, wrapped) {
+			log.Warnf("%s does not register %s functions, brick/rpc requests bypass the interceptors", fn, implPath)
+		}
+		return nil
+	}
+
+	out := string(src)
+	for i := len(list) - 1; i >= 0; i-- {
+		sel := list[i]
+		start, end := fSet.Position(sel.Pos()).Offset, fSet.Position(sel.End()).Offset
+		out = out[:start] + "rpc" + sel.Sel.Name + out[end:]
+	}
+	b, err := fixImports(fn, []byte(out), managed)
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+	log.Infof("%s: brick/rpc registers %d rpc through interceptors", fn, len(list))
+	return ioutil.WriteFile(fn, b, 0644)
+}
+
+func refersWrapper(f *ast.File, wrapped map[string]bool) bool {
+	found := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && strings.HasPrefix(id.Name, "rpc") && wrapped[id.Name[3:]] {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,99 @@
+package logic
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWireServerImpl(t *testing.T) {
+	wrapped := map[string]bool{"Login": true, "Logout": true}
+	cases := []struct {
+		name string
+		src  string
+		want string // 为空表示不修改
+	}{
+		{
+			name: "register by value",
+			src: "package main\n\nimport (\n\t\"shop\"\n\t\"shop/impl\"\n)\n\nfunc main() {\n" +
+				"\tregister(shop.LoginCMDPath, impl.Login)\n\tregister(shop.LogoutCMDPath, impl.Logout)\n\timpl.Init()\n}\n",
+			want: "package main\n\nimport (\n\t\"shop\"\n\t\"shop/impl\"\n)\n\nfunc main() {\n" +
+				"\tregister(shop.LoginCMDPath, rpcLogin)\n\tregister(shop.LogoutCMDPath, rpcLogout)\n\timpl.Init()\n}\n",
+		},
+		{
+			name: "impl import dropped",
+			src:  "package main\n\nimport (\n\tapi \"shop/impl\"\n)\n\nfunc main() {\n\tregister(api.Login)\n}\n",
+			want: "package main\n\nfunc main() {\n\tregister(rpcLogin)\n}\n",
+		},
+		{
+			name: "already wired",
+			src:  "package main\n\nfunc main() {\n\tregister(rpcLogin)\n}\n",
+		},
+		{
+			name: "other package",
+			src:  "package main\n\nimport \"other/impl\"\n\nfunc main() {\n\tregister(impl.Login)\n}\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "shop.go")
+			if err := ioutil.WriteFile(fn, []byte(c.src), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := wireServerImpl(fn, "shop/impl", wrapped); err != nil {
+				t.Fatal(err)
+			}
+			want := c.want
+			if want == "" {
+				want = c.src
+			}
+			if got := string(readGenerated(t, fn)); got != want {
+				t.Errorf("wireServerImpl:\n%s", lineDiff(want, got))
+			}
+		})
+	}
+}
+
+func TestGenerateServerInterceptorGolden(t *testing.T) {
+	PD := testClientPD()
+	PD.RpcList[0].Interceptors = []string{"-logging", "ratelimit"}
+	root := t.TempDir()
+	writeTestImpl(t, PD, root)
+
+	conf := GetTargetFileName(*PD, "conf", root)
+	if err := ioutil.WriteFile(conf, []byte("[server]\naddr = \":8080\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	svr := GetTargetFileName(*PD, "server", root)
+	err := ioutil.WriteFile(svr, []byte("package main\n\nimport (\n\t\"shop\"\n\t\"shop/impl\"\n)\n\nfunc main() {\n"+
+		"\tregister(shop.LoginCMDPath, impl.Login)\n\tregister(shop.LogoutCMDPath, impl.Logout)\n}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := GenerateServerInterceptor(*PD, root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkGolden(t, "server_interceptor", readGenerated(t, GetTargetFileName(*PD, "server_interceptor", root)))
+	checkGolden(t, "server_interceptor_test", readGenerated(t, GetTargetFileName(*PD, "server_interceptor_test", root)))
+
+	if got := string(readGenerated(t, svr)); !strings.Contains(got, "rpcLogin)") || strings.Contains(got, "impl.") {
+		t.Errorf("main not wired to the interceptors\n%s", got)
+	}
+	if n := strings.Count(string(readGenerated(t, conf)), "[interceptors]"); n != 1 {
+		t.Errorf("[interceptors] appended %d times", n)
+	}
+
+	// 没有 rpc 时删除生成的测试
+	PD.RpcList = nil
+	if err := GenerateServerInterceptor(*PD, root); err != nil {
+		t.Fatal(err)
+	}
+	if FileExists(GetTargetFileName(*PD, "server_interceptor_test", root)) {
+		t.Error("interceptor test kept without rpc")
+	}
+}
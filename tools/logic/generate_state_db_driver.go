@@ -0,0 +1,68 @@
+package logic
+
+import (
+	"brick/log"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var stateDbDriverTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package %s
+
+import (
+	%s
+	"gorm.io/gorm"
+)
+
+// StateDbDriver SetStateDb -driver 选择的数据库, 对应配置 %s
+const StateDbDriver = %q
+
+// OpenStateDb 用 StateDbDriver 的 gorm 驱动打开 dsn, 得到的连接可以传给生成的 New<Msg>Repo
+func OpenStateDb(dsn string, opts ...gorm.Option) (*gorm.DB, error) {
+	return gorm.Open(%s.Open(dsn), opts...)
+}
+`
+
+// gorm 驱动的 import 路径, sqlite 使用不需要 cgo 的实现, 与生成的测试一致
+var gormDrivers = map[string]string{
+	DriverMysql:    "gorm.io/driver/mysql",
+	DriverPostgres: "gorm.io/driver/postgres",
+	DriverSqlite:   "github.com/glebarez/sqlite",
+}
+
+// CheckStateDbConf 检查 $dispatch.<driver>.<name> 中的数据库与 -driver 一致
+func CheckStateDbConf(conf, driver string) error {
+	if !strings.HasPrefix(conf, "$dispatch.") {
+		return nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(conf, "$dispatch."), ".", 2)
+	if len(parts) == 2 && gormDrivers[parts[0]] != "" && parts[0] != driver {
+		return fmt.Errorf("db conf %s is for %s, not -driver %s", conf, parts[0], driver)
+	}
+	return nil
+}
+
+// GenerateLogicStateDbDriver 生成 -driver 对应的连接函数, 和 GenerateLogicStateDb 生成的连接配置放在一起
+func GenerateLogicStateDbDriver(PD *ProtoDetect, rootDir, conf, driver string) error {
+	if err := CheckDbDriver(driver); err != nil {
+		return err
+	}
+	if err := CheckStateDbConf(conf, driver); err != nil {
+		return err
+	}
+
+	imp := gormDrivers[driver]
+	fn := GetTargetFileName(*PD, "logic_state_db_driver", rootDir)
+	context := fmt.Sprintf(stateDbDriverTemp, implPackageName(filepath.Dir(fn)),
+		fmt.Sprintf("%q", imp), conf, driver, imp[strings.LastIndex(imp, "/")+1:])
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+
+	return ioutil.WriteFile(fn, src, 0644)
+}
@@ -0,0 +1,146 @@
+package logic
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// GenerateTsErrCode 输出 <svr>.errcode.ts, 包含错误码常量, 多语言提示和判断辅助函数,
+// 前端和网关用它判断错误并展示与后端一致的提示
+func GenerateTsErrCode(pd *ProtoDetect, outDir string) error {
+	if len(pd.ErrCodes) == 0 {
+		return nil
+	}
+	if err := checkErrCodeValues(pd.ErrCodes); err != nil {
+		return err
+	}
+
+	if outDir == "" {
+		outDir = "."
+	}
+
+	err := W.open(fmt.Sprintf("%s/%s.errcode.ts", outDir, pd.SvrName))
+	if err != nil {
+		return err
+	}
+
+	W.out("// Code generated by rpc_gen. DO NOT EDIT.")
+	W.out("")
+	W.out("export const defaultLocale = %s;", strconv.Quote(DefaultErrLocale))
+	W.out("")
+
+	// 错误码常量, 用法: isErr(rsp, UserErrCode.PasswordWrong)
+	for _, def := range pd.ErrCodes {
+		W.out("export const %s = {", def.ErrCodeSetName)
+		W.incIndent()
+		for _, f := range def.ErrCodeEnums {
+			if f.Integer != 0 {
+				W.out("// %s", errCodeMsg(f, def.Msgs[f.Name]))
+			}
+			W.out("%s: %d,", f.Name, f.Integer)
+		}
+		W.decIndent()
+		W.out("} as const;")
+		W.out("export type %s = typeof %s[keyof typeof %s];",
+			def.ErrCodeSetName, def.ErrCodeSetName, def.ErrCodeSetName)
+		W.out("")
+	}
+
+	W.out("export const ErrNames: {[code: number]: string} = {")
+	W.incIndent()
+	for _, def := range pd.ErrCodes {
+		for _, f := range def.ErrCodeEnums {
+			if f.Integer != 0 {
+				W.out("%d: %s,", f.Integer, strconv.Quote(def.ErrCodeSetName+"."+f.Name))
+			}
+		}
+	}
+	W.decIndent()
+	W.out("};")
+	W.out("")
+
+	// 错误码 -> locale -> 提示, '' 为默认提示, 和 Go 的 code2Msgs 是同一张表
+	W.out("export const ErrMsgs: {[code: number]: {[locale: string]: string}} = {")
+	W.incIndent()
+	for _, def := range pd.ErrCodes {
+		for _, f := range def.ErrCodeEnums {
+			if f.Integer == 0 {
+				continue
+			}
+
+			msgs := errMsgTable(f, def.Msgs[f.Name])
+			W.out("%d: {", f.Integer)
+			W.incIndent()
+			for _, l := range sortedKeys(msgs) {
+				W.out("%s: %s,", strconv.Quote(l), strconv.Quote(msgs[l]))
+			}
+			W.decIndent()
+			W.out("},")
+		}
+	}
+	W.decIndent()
+	W.out("};")
+	W.out("")
+
+	W.out("// 找不到时依次回退到语言前缀 (zh-CN -> zh) 和默认提示, 和 Go 的 ErrMsg 一致")
+	W.out("export function errMsg(code: number, locale: string = defaultLocale): string {")
+	W.incIndent()
+	W.out("const m = ErrMsgs[code];")
+	W.out("if (!m) {")
+	W.out("    return '';")
+	W.out("}")
+	W.out("const l = locale.toLowerCase();")
+	W.out("const lang = l.split(/[-_]/)[0];")
+	W.out("if (l in m) {")
+	W.out("    return m[l];")
+	W.out("}")
+	W.out("if (lang in m) {")
+	W.out("    return m[lang];")
+	W.out("}")
+	W.out("return m[''] || '';")
+	W.decIndent()
+	W.out("}")
+	W.out("")
+
+	// 网关返回的错误信封 { code, message }
+	W.out("export interface ErrEnvelope {")
+	W.incIndent()
+	W.out("code?: number | string;")
+	W.out("message?: string;")
+	W.decIndent()
+	W.out("}")
+	W.out("")
+
+	W.out("export function errCode(rsp?: ErrEnvelope | null): number {")
+	W.incIndent()
+	W.out("return rsp && rsp.code ? Number(rsp.code) : 0;")
+	W.decIndent()
+	W.out("}")
+	W.out("")
+
+	W.out("export function isOk(rsp?: ErrEnvelope | null): boolean {")
+	W.incIndent()
+	W.out("return !!rsp && errCode(rsp) === 0;")
+	W.decIndent()
+	W.out("}")
+	W.out("")
+
+	W.out("export function isErr(rsp: ErrEnvelope | null | undefined, code: number): boolean {")
+	W.incIndent()
+	W.out("return !!rsp && errCode(rsp) === code;")
+	W.decIndent()
+	W.out("}")
+	W.out("")
+
+	W.out("// 优先使用本地的提示, 没有定义的错误码使用服务端返回的 message")
+	W.out("export function errText(rsp: ErrEnvelope, locale: string = defaultLocale): string {")
+	W.incIndent()
+	W.out("return errMsg(errCode(rsp), locale) || rsp.message || '';")
+	W.decIndent()
+	W.out("}")
+
+	W.fp.Close()
+	W.fp = nil
+
+	return nil
+}
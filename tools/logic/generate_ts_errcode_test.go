@@ -0,0 +1,16 @@
+package logic
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateTsErrCodeGolden(t *testing.T) {
+	PD := parseTestErrCodes(t, testErrCodeProto)
+	root := t.TempDir()
+
+	if err := GenerateTsErrCode(PD, root); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "errcode_ts", readGenerated(t, filepath.Join(root, "user.errcode.ts")))
+}
@@ -0,0 +1,360 @@
+package logic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+func jsString(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSpace(buf.String())
+}
+
+func tsValidateName(m *PbMsg) string {
+	return "validate" + strings.Replace(m.FullName, ".", "_", -1)
+}
+
+// 64 位整数在 d.ts 中是 string
+func isTsInt64(f *PbField) bool {
+	switch f.GetType() {
+	case "int64", "uint64", "sint64", "fixed64", "sfixed64":
+		return true
+	}
+	return false
+}
+
+type tsValidateCtx struct {
+	need map[*PbMsg]bool
+}
+
+func tsFail(where, reason string) {
+	W.out("return %s;", jsString(fmt.Sprintf("invalid %s: %s", where, reason)))
+}
+
+// elemChecks 与 Go 的 Validate 相同的 min/max/pattern/in 检查, 提示文字也保持一致
+func (p *tsValidateCtx) elemChecks(f *PbField, expr, where string) {
+	r := f.Rules
+	kind := f.kind()
+
+	num := expr
+	if kind != fieldKindString {
+		num = fmt.Sprintf("Number(%s)", expr)
+	}
+
+	if r.Min != "" {
+		W.out("if (%s < %s) {", num, r.Min)
+		W.incIndent()
+		tsFail(where, "must be >= "+r.Min)
+		W.decIndent()
+		W.out("}")
+	}
+	if r.Max != "" {
+		W.out("if (%s > %s) {", num, r.Max)
+		W.incIndent()
+		tsFail(where, "must be <= "+r.Max)
+		W.decIndent()
+		W.out("}")
+	}
+	if r.Pattern != "" {
+		W.out("if (!new RegExp(%s).test(%s)) {", jsString(r.Pattern), expr)
+		W.incIndent()
+		tsFail(where, "must match pattern "+r.Pattern)
+		W.decIndent()
+		W.out("}")
+	}
+	if len(r.In) > 0 {
+		var list, goList []string
+		for _, x := range r.In {
+			if kind == fieldKindString {
+				list = append(list, jsString(x))
+				goList = append(goList, fmt.Sprintf("%q", x))
+			} else {
+				list = append(list, x)
+				goList = append(goList, x)
+			}
+		}
+		W.out("if ([%s].indexOf(%s) < 0) {", strings.Join(list, ", "), num)
+		W.incIndent()
+		tsFail(where, "must be one of "+strings.Join(goList, ", "))
+		W.decIndent()
+		W.out("}")
+	}
+}
+
+func (p *tsValidateCtx) lenChecks(r *FieldRules, lenExpr, where, unit string) {
+	if r.MinLen != nil {
+		W.out("if (%s < %d) {", lenExpr, *r.MinLen)
+		W.incIndent()
+		tsFail(where, fmt.Sprintf("%s must be >= %d", unit, *r.MinLen))
+		W.decIndent()
+		W.out("}")
+	}
+	if r.MaxLen != nil {
+		W.out("if (%s > %d) {", lenExpr, *r.MaxLen)
+		W.incIndent()
+		tsFail(where, fmt.Sprintf("%s must be <= %d", unit, *r.MaxLen))
+		W.decIndent()
+		W.out("}")
+	}
+}
+
+func (p *tsValidateCtx) nestedCheck(f *PbField, expr, where string) {
+	if !p.need[f.Msg] {
+		return
+	}
+	W.out("if (%s) {", expr)
+	W.incIndent()
+	W.out("const e = %s(%s);", tsValidateName(f.Msg), expr)
+	W.out("if (e) {")
+	W.incIndent()
+	W.out("return %s + e;", jsString(fmt.Sprintf("invalid %s: ", where)))
+	W.decIndent()
+	W.out("}")
+	W.decIndent()
+	W.out("}")
+}
+
+// 未赋值的字段按 proto3 的零值处理, 与服务端看到的值一致
+func tsZeroValue(f *PbField) string {
+	switch f.kind() {
+	case fieldKindString, fieldKindBytes:
+		return "''"
+	case fieldKindInt, fieldKindUint:
+		if isTsInt64(f) {
+			return "'0'"
+		}
+	}
+	return "0"
+}
+
+func (p *tsValidateCtx) field(m *PbMsg, f *PbField) {
+	expr := "m." + f.GetName()
+	where := m.FullName + "." + f.GetName()
+	kind := f.kind()
+	r := f.Rules
+
+	if f.MapField != nil {
+		if r != nil {
+			W.out("const %sKeys = Object.keys(%s || {});", f.GetName(), expr)
+			if r.Required {
+				W.out("if (%sKeys.length === 0) {", f.GetName())
+				W.incIndent()
+				tsFail(where, "is required")
+				W.decIndent()
+				W.out("}")
+			}
+			p.lenChecks(r, f.GetName()+"Keys.length", where, "count")
+		}
+		hasElemRules := r != nil && (r.Min != "" || r.Max != "" || r.Pattern != "" || len(r.In) > 0)
+		if !hasElemRules && !p.need[f.Msg] {
+			return
+		}
+		W.out("for (const k of Object.keys(%s || {})) {", expr)
+		W.incIndent()
+		W.out("const v = %s![k];", expr)
+		if hasElemRules {
+			p.elemChecks(f, "v", where)
+		}
+		if kind == fieldKindMsg {
+			p.nestedCheck(f, "v", where)
+		}
+		W.decIndent()
+		W.out("}")
+		return
+	}
+
+	if f.IsRepeated() {
+		if r != nil {
+			if r.Required {
+				W.out("if (!%s || %s.length === 0) {", expr, expr)
+				W.incIndent()
+				tsFail(where, "is required")
+				W.decIndent()
+				W.out("}")
+			}
+			p.lenChecks(r, fmt.Sprintf("(%s || []).length", expr), where, "count")
+		}
+		hasElemRules := r != nil && (r.Min != "" || r.Max != "" || r.Pattern != "" || len(r.In) > 0)
+		if !hasElemRules && !p.need[f.Msg] {
+			return
+		}
+		W.out("for (const v of %s || []) {", expr)
+		W.incIndent()
+		if hasElemRules {
+			p.elemChecks(f, "v", where)
+		}
+		if kind == fieldKindMsg {
+			p.nestedCheck(f, "v", where)
+		}
+		W.decIndent()
+		W.out("}")
+		return
+	}
+
+	// 与服务端一致, optional 字段 required 表示必须设置, 其它规则只在设置了时检查
+	if r != nil && f.isOptionalScalar() {
+		if r.Required {
+			W.out("if (%s === undefined || %s === null) {", expr, expr)
+			W.incIndent()
+			tsFail(where, "is required")
+			W.decIndent()
+			W.out("}")
+		}
+		W.out("if (%s !== undefined && %s !== null) {", expr, expr)
+		W.incIndent()
+		v := f.GetName() + "Value"
+		W.out("const %s = %s;", v, expr)
+		if kind == fieldKindString {
+			p.lenChecks(r, fmt.Sprintf("runeLen(%s)", v), where, "length")
+		}
+		p.elemChecks(f, v, where)
+		W.decIndent()
+		W.out("}")
+		return
+	}
+
+	if r != nil {
+		if r.Required {
+			switch {
+			case kind == fieldKindMsg || kind == fieldKindString || kind == fieldKindBytes:
+				W.out("if (!%s) {", expr)
+			default:
+				W.out("if (!Number(%s || 0)) {", expr)
+			}
+			W.incIndent()
+			tsFail(where, "is required")
+			W.decIndent()
+			W.out("}")
+		}
+
+		hasValueRules := r.MinLen != nil || r.MaxLen != nil ||
+			r.Min != "" || r.Max != "" || r.Pattern != "" || len(r.In) > 0
+		if kind != fieldKindMsg && hasValueRules {
+			v := f.GetName() + "Value"
+			W.out("const %s = %s || %s;", v, expr, tsZeroValue(f))
+			switch kind {
+			case fieldKindString:
+				p.lenChecks(r, fmt.Sprintf("runeLen(%s)", v), where, "length")
+			case fieldKindBytes:
+				p.lenChecks(r, fmt.Sprintf("base64Len(%s)", v), where, "length")
+			}
+			p.elemChecks(f, v, where)
+		}
+	}
+
+	if kind == fieldKindMsg {
+		p.nestedCheck(f, expr, where)
+	}
+}
+
+// GenerateTsValidate 输出 <svr>.validate.ts, 按 (ext.rules) 为请求消息生成与服务端 Validate 一致的检查,
+// 校验通过返回空字符串, 否则返回与服务端相同的错误提示
+func GenerateTsValidate(pd *ProtoDetect, msgs []*PbMsg, outDir string) error {
+	for _, m := range msgs {
+		if err := CheckOneofRules(m); err != nil {
+			return err
+		}
+	}
+	need := needValidate(msgs)
+
+	byName := make(map[string]*PbMsg)
+	for _, m := range msgs {
+		byName[m.FullName] = m
+	}
+
+	// 只输出请求消息及其引用到的 message
+	used := make(map[*PbMsg]bool)
+	var visit func(m *PbMsg)
+	visit = func(m *PbMsg) {
+		if m == nil || !need[m] || used[m] {
+			return
+		}
+		used[m] = true
+		for _, f := range m.Fields {
+			visit(f.Msg)
+		}
+	}
+	var reqList []*RpcNode
+	for _, v := range pd.RpcList {
+		if m := byName[v.ReqType]; m != nil && need[m] {
+			visit(m)
+			reqList = append(reqList, v)
+		}
+	}
+	if len(reqList) == 0 {
+		return nil
+	}
+
+	if outDir == "" {
+		outDir = "."
+	}
+
+	err := W.open(fmt.Sprintf("%s/%s.validate.ts", outDir, pd.SvrName))
+	if err != nil {
+		return err
+	}
+
+	W.out("// Code generated by rpc_gen. DO NOT EDIT.")
+	W.out("")
+	W.out("/// <reference path=\"./%s.%s.d.ts\" />", pd.SvrName, pd.SvrName)
+	W.out("")
+
+	W.out("// 按 unicode 字符计数, 与服务端的 utf8.RuneCountInString 一致")
+	W.out("function runeLen(s: string): number {")
+	W.incIndent()
+	W.out("return s.replace(/[\\uD800-\\uDBFF][\\uDC00-\\uDFFF]/g, '_').length;")
+	W.decIndent()
+	W.out("}")
+	W.out("")
+
+	W.out("// bytes 字段在 json 中是 base64, 按解码后的长度计算")
+	W.out("function base64Len(s: string): number {")
+	W.incIndent()
+	W.out("const pad = (/=*$/.exec(s) || [''])[0].length;")
+	W.out("return Math.floor(s.length * 3 / 4) - pad;")
+	W.decIndent()
+	W.out("}")
+
+	ctx := &tsValidateCtx{need: need}
+	for _, m := range msgs {
+		if !used[m] {
+			continue
+		}
+
+		tsName := strings.Replace(m.FullName, ".", "_", -1)
+		W.out("")
+		W.out("export function %s(m?: %s.%s | null): string {", tsValidateName(m), pd.SvrName, tsName)
+		W.incIndent()
+		W.out("if (!m) {")
+		W.incIndent()
+		W.out("return '';")
+		W.decIndent()
+		W.out("}")
+		for _, f := range m.Fields {
+			ctx.field(m, f)
+		}
+		W.out("return '';")
+		W.decIndent()
+		W.out("}")
+	}
+
+	W.out("")
+	W.out("// rpc 方法 -> 请求校验函数")
+	W.out("export const reqValidators: {[method: string]: (m: any) => string} = {")
+	W.incIndent()
+	for _, v := range reqList {
+		W.out("%s: %s,", v.MethodName, tsValidateName(byName[v.ReqType]))
+	}
+	W.decIndent()
+	W.out("};")
+
+	W.fp.Close()
+	W.fp = nil
+
+	return nil
+}
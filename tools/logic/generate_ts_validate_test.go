@@ -0,0 +1,28 @@
+package logic
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateTsValidateGolden(t *testing.T) {
+	snap := parseTestMsgs(t, testValidateProto)
+	dir := t.TempDir()
+
+	if err := GenerateTsValidate(snap.PD, snap.Msgs, dir); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "validate_ts", readGenerated(t, filepath.Join(dir, "user.validate.ts")))
+}
+
+func TestGenerateTsValidateNoRules(t *testing.T) {
+	snap := parseTestMsgs(t, "syntax = \"proto3\";\npackage user;\nservice user { rpc Ping(M) returns (M); }\nmessage M { string s = 1; }\n")
+	dir := t.TempDir()
+
+	if err := GenerateTsValidate(snap.PD, snap.Msgs, dir); err != nil {
+		t.Fatal(err)
+	}
+	if FileExists(filepath.Join(dir, "user.validate.ts")) {
+		t.Error("validate.ts written without any rules")
+	}
+}
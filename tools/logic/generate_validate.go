@@ -0,0 +1,284 @@
+package logic
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// goCamelCase 与 protoc-gen-go 的命名规则一致: foo_bar -> FooBar, _foo -> XFoo
+func goCamelCase(s string) string {
+	isLower := func(c byte) bool { return 'a' <= c && c <= 'z' }
+	isDigit := func(c byte) bool { return '0' <= c && c <= '9' }
+
+	var t []byte
+	i := 0
+	if len(s) > 0 && s[0] == '_' {
+		t = append(t, 'X')
+		i++
+	}
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c == '_' && i+1 < len(s) && isLower(s[i+1]) {
+			continue
+		}
+		if isDigit(c) {
+			t = append(t, c)
+			continue
+		}
+		if isLower(c) {
+			c ^= ' '
+		}
+		t = append(t, c)
+		for i+1 < len(s) && isLower(s[i+1]) {
+			i++
+			t = append(t, s[i])
+		}
+	}
+	return string(t)
+}
+
+// GoMsgName 嵌套 message 在 pb.go 中的类型名为 Outer_Inner
+func GoMsgName(m *PbMsg) string {
+	var list []string
+	for _, x := range strings.Split(m.FullName, ".") {
+		list = append(list, goCamelCase(x))
+	}
+	return strings.Join(list, "_")
+}
+
+// needValidate 计算哪些 message 需要生成 Validate: 有规则的, 以及字段引用了这些 message 的
+func needValidate(msgs []*PbMsg) map[*PbMsg]bool {
+	res := make(map[*PbMsg]bool)
+	for _, m := range msgs {
+		for _, f := range m.Fields {
+			if f.Rules != nil {
+				res[m] = true
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, m := range msgs {
+			if res[m] {
+				continue
+			}
+			for _, f := range m.Fields {
+				if f.Msg != nil && res[f.Msg] {
+					res[m] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return res
+}
+
+type validateWriter struct {
+	buf      bytes.Buffer
+	patterns []string
+}
+
+func (p *validateWriter) out(indent int, format string, args ...interface{}) {
+	p.buf.WriteString(strings.Repeat("\t", indent))
+	p.buf.WriteString(fmt.Sprintf(format, args...))
+	p.buf.WriteString("\n")
+}
+
+func (p *validateWriter) fail(indent int, where, reason string) {
+	p.out(indent, "return errors.New(%s)", strconv.Quote(fmt.Sprintf("invalid %s: %s", where, reason)))
+}
+
+// elemChecks 生成单个值的 min/max/pattern/in 检查
+func (p *validateWriter) elemChecks(indent int, msgName string, f *PbField, expr, where string) {
+	r := f.Rules
+	kind := f.kind()
+
+	if r.Min != "" {
+		p.out(indent, "if %s < %s {", expr, r.Min)
+		p.fail(indent+1, where, "must be >= "+r.Min)
+		p.out(indent, "}")
+	}
+	if r.Max != "" {
+		p.out(indent, "if %s > %s {", expr, r.Max)
+		p.fail(indent+1, where, "must be <= "+r.Max)
+		p.out(indent, "}")
+	}
+	if r.Pattern != "" {
+		v := fmt.Sprintf("_%s_%s_Pattern", msgName, goCamelCase(f.GetName()))
+		p.patterns = append(p.patterns, fmt.Sprintf("%s = regexp.MustCompile(%s)", v, strconv.Quote(r.Pattern)))
+		p.out(indent, "if !%s.MatchString(%s) {", v, expr)
+		p.fail(indent+1, where, "must match pattern "+r.Pattern)
+		p.out(indent, "}")
+	}
+	if len(r.In) > 0 {
+		var list []string
+		for _, x := range r.In {
+			if kind == fieldKindString {
+				x = strconv.Quote(x)
+			}
+			list = append(list, x)
+		}
+		p.out(indent, "switch %s {", expr)
+		p.out(indent, "case %s:", strings.Join(list, ", "))
+		p.out(indent, "default:")
+		p.fail(indent+1, where, "must be one of "+strings.Join(list, ", "))
+		p.out(indent, "}")
+	}
+}
+
+func (p *validateWriter) lenChecks(indent int, r *FieldRules, lenExpr, where, unit string) {
+	if r.MinLen != nil {
+		p.out(indent, "if %s < %d {", lenExpr, *r.MinLen)
+		p.fail(indent+1, where, fmt.Sprintf("%s must be >= %d", unit, *r.MinLen))
+		p.out(indent, "}")
+	}
+	if r.MaxLen != nil {
+		p.out(indent, "if %s > %d {", lenExpr, *r.MaxLen)
+		p.fail(indent+1, where, fmt.Sprintf("%s must be <= %d", unit, *r.MaxLen))
+		p.out(indent, "}")
+	}
+}
+
+func (p *validateWriter) nestedCheck(indent int, expr, where string) {
+	p.out(indent, "if v, ok := interface{}(%s).(interface{ Validate() error }); ok {", expr)
+	p.out(indent+1, "if err := v.Validate(); err != nil {")
+	p.out(indent+2, "return fmt.Errorf(\"invalid %s: %%v\", err)", where)
+	p.out(indent+1, "}")
+	p.out(indent, "}")
+}
+
+func (p *validateWriter) field(m *PbMsg, f *PbField) {
+	msgName := GoMsgName(m)
+	expr := "m." + goCamelCase(f.GetName())
+	where := m.FullName + "." + f.GetName()
+	kind := f.kind()
+	r := f.Rules
+
+	if f.IsRepeated() {
+		if r != nil {
+			if r.Required {
+				p.out(1, "if len(%s) == 0 {", expr)
+				p.fail(2, where, "is required")
+				p.out(1, "}")
+			}
+			p.lenChecks(1, r, "len("+expr+")", where, "count")
+		}
+		hasElemRules := r != nil && (r.Min != "" || r.Max != "" || r.Pattern != "" || len(r.In) > 0)
+		if !hasElemRules && kind != fieldKindMsg {
+			return
+		}
+		p.out(1, "for _, v := range %s {", expr)
+		if hasElemRules {
+			p.elemChecks(2, msgName, f, "v", where)
+		}
+		if kind == fieldKindMsg {
+			p.nestedCheck(2, "v", where)
+		}
+		p.out(1, "}")
+		return
+	}
+
+	// optional 字段 required 表示必须设置, 其它规则只在设置了时检查
+	if r != nil && f.isOptionalScalar() {
+		if r.Required {
+			p.out(1, "if %s == nil {", expr)
+			p.fail(2, where, "is required")
+			p.out(1, "}")
+		}
+		p.out(1, "if %s != nil {", expr)
+		if kind == fieldKindString {
+			p.lenChecks(2, r, "utf8.RuneCountInString(*"+expr+")", where, "length")
+		}
+		p.elemChecks(2, msgName, f, "*"+expr, where)
+		p.out(1, "}")
+		return
+	}
+
+	if r != nil {
+		if r.Required {
+			switch kind {
+			case fieldKindString:
+				p.out(1, "if %s == \"\" {", expr)
+			case fieldKindBytes:
+				p.out(1, "if len(%s) == 0 {", expr)
+			case fieldKindMsg:
+				p.out(1, "if %s == nil {", expr)
+			default:
+				p.out(1, "if %s == 0 {", expr)
+			}
+			p.fail(2, where, "is required")
+			p.out(1, "}")
+		}
+		switch kind {
+		case fieldKindString:
+			p.lenChecks(1, r, "utf8.RuneCountInString("+expr+")", where, "length")
+		case fieldKindBytes:
+			p.lenChecks(1, r, "len("+expr+")", where, "length")
+		}
+		p.elemChecks(1, msgName, f, expr, where)
+	}
+
+	if kind == fieldKindMsg {
+		p.nestedCheck(1, expr, where)
+	}
+}
+
+// GenerateValidate 为有校验规则的 message 生成 Validate 方法, 追加到 protoc 生成的 pb.go 中
+func GenerateValidate(fn string, msgs []*PbMsg) error {
+	for _, m := range msgs {
+		for _, f := range m.Fields {
+			if err := CheckFieldRules(f); err != nil {
+				return fmt.Errorf("%s.%s: %v", m.FullName, f.GetName(), err)
+			}
+		}
+		if err := CheckOneofRules(m); err != nil {
+			return err
+		}
+	}
+
+	need := needValidate(msgs)
+	if len(need) == 0 {
+		return nil
+	}
+
+	w := &validateWriter{}
+	for _, m := range msgs {
+		if !need[m] {
+			continue
+		}
+		w.out(0, "")
+		w.out(0, "// Validate 检查 (ext.rules) 中声明的字段规则")
+		w.out(0, "func (m *%s) Validate() error {", GoMsgName(m))
+		w.out(1, "if m == nil {")
+		w.out(2, "return nil")
+		w.out(1, "}")
+		for _, f := range m.Fields {
+			w.field(m, f)
+		}
+		w.out(1, "return nil")
+		w.out(0, "}")
+	}
+
+	src, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+
+	s := strings.TrimRight(string(src), "\n") + "\n"
+	if len(w.patterns) > 0 {
+		s += "\nvar (\n\t" + strings.Join(w.patterns, "\n\t") + "\n)\n"
+	}
+	s += w.buf.String()
+
+	out, err := fixImports(fn, []byte(s), []string{"errors", "fmt", "regexp", "unicode/utf8"})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fn, out, 0644)
+}
@@ -0,0 +1,164 @@
+package logic
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parseTestMsgs 解析 proto 中的 message, 和 walkPb + setMsgPtr 一样填好 Rules, Db 和 Msg
+func parseTestMsgs(t *testing.T, src string) *ProtoSnapshot {
+	t.Helper()
+
+	snap := parseTestSnapshot(t, src)
+	snap.PD.SvrName = snap.PD.PackageName
+	byName := make(map[string]*PbMsg)
+	for _, m := range snap.Msgs {
+		byName[m.FullName] = m
+	}
+	for _, m := range snap.Msgs {
+		for _, f := range m.Fields {
+			rules, err := ParseFieldRules(f.GetOptions())
+			if err != nil {
+				t.Fatalf("%s.%s: %v", m.FullName, f.GetName(), err)
+			}
+			f.Rules = rules
+			db, err := ParseFieldDb(f.GetOptions())
+			if err != nil {
+				t.Fatalf("%s.%s: %v", m.FullName, f.GetName(), err)
+			}
+			f.Db = db
+			f.Msg = byName[f.GetType()]
+		}
+	}
+	return snap
+}
+
+const testValidateProto = `syntax = "proto3";
+package user;
+
+service user {
+  rpc Register(RegisterReq) returns (RegisterRsp);
+  rpc Ping(PingReq) returns (PingRsp);
+}
+
+message Addr {
+  string city = 1 [(ext.rules).required = true, (ext.rules).max_len = 16];
+}
+
+message RegisterReq {
+  string name = 1 [(ext.rules) = {required: true, min_len: 2, max_len: 32}];
+  uint32 age = 2 [(ext.rules) = {min: 1, max: 150}];
+  string email = 3 [(ext.rules).pattern = "^[^@]+@[^@]+$"];
+  repeated string tags = 4 [(ext.rules) = {max_len: 3, in: ["a", "b"]}];
+  Addr addr = 5;
+  bytes avatar = 6 [(ext.rules).max_len = 1024];
+  int64 invite = 7 [(ext.rules).in = "1,2,3"];
+  optional string nick = 8 [(ext.rules) = {required: true, max_len: 8}];
+  optional uint32 level = 9 [(ext.rules).min = 1];
+}
+
+message RegisterRsp {}
+message PingReq {}
+message PingRsp {}
+`
+
+func TestCheckFieldRules(t *testing.T) {
+	cases := []struct {
+		name  string
+		field string
+		want  string // 为空表示合法
+	}{
+		{"string len", `string s = 1 [(ext.rules) = {min_len: 1, max_len: 2}];`, ""},
+		{"repeated len", `repeated uint32 s = 1 [(ext.rules).max_len = 2];`, ""},
+		{"int range", `int32 s = 1 [(ext.rules) = {min: -1, max: 10}];`, ""},
+		{"bool", `bool s = 1 [(ext.rules).required = true];`, "not supported on bool"},
+		{"len on int", `int32 s = 1 [(ext.rules).min_len = 1];`, "min_len/max_len are only"},
+		{"min_len > max_len", `string s = 1 [(ext.rules) = {min_len: 3, max_len: 2}];`, "min_len 3 > max_len 2"},
+		{"pattern on int", `int32 s = 1 [(ext.rules).pattern = "^1$"];`, "pattern is only"},
+		{"bad pattern", `string s = 1 [(ext.rules).pattern = "("];`, "invalid pattern"},
+		{"negative uint", `uint32 s = 1 [(ext.rules).min = -1];`, "min"},
+		{"float on int", `int32 s = 1 [(ext.rules).max = 1.5];`, "max"},
+		{"in on int", `int32 s = 1 [(ext.rules).in = "1,x"];`, "in"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			snap := parseTestMsgs(t, "syntax = \"proto3\";\npackage user;\nmessage M {\n"+c.field+"\n}\n")
+			err := CheckFieldRules(snap.Msgs[0].Fields[0])
+			if c.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected err %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("want err containing %q, got %v", c.want, err)
+			}
+		})
+	}
+}
+
+func TestParseFieldRulesUnknown(t *testing.T) {
+	src := "syntax = \"proto3\";\npackage user;\nmessage M {\nstring s = 1 [(ext.rules).size = 1];\n}\n"
+	snap := parseTestSnapshot(t, src)
+	_, err := ParseFieldRules(snap.Msgs[0].Fields[0].GetOptions())
+	if err == nil || !strings.Contains(err.Error(), "unknown rule `size`") {
+		t.Fatalf("want unknown rule err, got %v", err)
+	}
+}
+
+func TestNeedValidate(t *testing.T) {
+	snap := parseTestMsgs(t, testValidateProto)
+	need := needValidate(snap.Msgs)
+
+	want := map[string]bool{"Addr": true, "RegisterReq": true}
+	for _, m := range snap.Msgs {
+		if need[m] != want[m.FullName] {
+			t.Errorf("needValidate(%s) = %v, want %v", m.FullName, need[m], want[m.FullName])
+		}
+	}
+}
+
+func TestGenerateValidateGolden(t *testing.T) {
+	snap := parseTestMsgs(t, testValidateProto)
+	fn := filepath.Join(t.TempDir(), "user.pb.go")
+	if err := ioutil.WriteFile(fn, []byte("package user\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GenerateValidate(fn, snap.Msgs); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "validate", readGenerated(t, fn))
+}
+
+func TestGenerateValidateRejectBadRules(t *testing.T) {
+	snap := parseTestMsgs(t, "syntax = \"proto3\";\npackage user;\nmessage M {\nbool b = 1 [(ext.rules).required = true];\n}\n")
+	fn := filepath.Join(t.TempDir(), "user.pb.go")
+	if err := ioutil.WriteFile(fn, []byte("package user\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := GenerateValidate(fn, snap.Msgs)
+	if err == nil || !strings.HasPrefix(err.Error(), "M.b:") {
+		t.Fatalf("want M.b error, got %v", err)
+	}
+	if string(readGenerated(t, fn)) != "package user\n" {
+		t.Error("pb.go modified although rules are invalid")
+	}
+}
+
+func TestGenerateValidateRejectOneofRules(t *testing.T) {
+	snap := parseTestMsgs(t, "syntax = \"proto3\";\npackage user;\nmessage M {\noneof id {\nstring name = 1 [(ext.rules).min_len = 1];\nuint32 uid = 2;\n}\n}\n")
+	fn := filepath.Join(t.TempDir(), "user.pb.go")
+	if err := ioutil.WriteFile(fn, []byte("package user\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := GenerateValidate(fn, snap.Msgs)
+	if err == nil || !strings.HasPrefix(err.Error(), "M.name: rules are not supported on oneof field") {
+		t.Fatalf("want M.name oneof error, got %v", err)
+	}
+}
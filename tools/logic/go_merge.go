@@ -0,0 +1,236 @@
+package logic
+
+import (
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type goEdit struct {
+	start int
+	end   int
+	text  string
+}
+
+// goSource 基于 go/ast 的位置信息对源码做替换/删除/追加, 最后统一 format,
+// 这样用户手写的代码和注释可以原样保留
+type goSource struct {
+	fn    string
+	fSet  *token.FileSet
+	file  *ast.File
+	src   []byte
+	edits []goEdit
+	tail  []string
+}
+
+func parseGoSource(fn string) (*goSource, error) {
+	src, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return parseGoSourceBytes(fn, src)
+}
+
+func parseGoSourceBytes(fn string, src []byte) (*goSource, error) {
+	fSet := token.NewFileSet()
+	f, err := parser.ParseFile(fSet, fn, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	return &goSource{fn: fn, fSet: fSet, file: f, src: src}, nil
+}
+
+func (p *goSource) offset(pos token.Pos) int {
+	return p.fSet.Position(pos).Offset
+}
+
+func (p *goSource) declRange(d ast.Decl) (int, int) {
+	start := d.Pos()
+	switch t := d.(type) {
+	case *ast.FuncDecl:
+		if t.Doc != nil {
+			start = t.Doc.Pos()
+		}
+	case *ast.GenDecl:
+		if t.Doc != nil {
+			start = t.Doc.Pos()
+		}
+	}
+	return p.offset(start), p.offset(d.End())
+}
+
+func (p *goSource) nodeText(n ast.Node) string {
+	return string(p.src[p.offset(n.Pos()):p.offset(n.End())])
+}
+
+func (p *goSource) declText(d ast.Decl) string {
+	start, end := p.declRange(d)
+	return string(p.src[start:end])
+}
+
+func (p *goSource) replace(d ast.Decl, text string) {
+	start, end := p.declRange(d)
+	p.edits = append(p.edits, goEdit{start: start, end: end, text: strings.TrimSpace(text)})
+}
+
+func (p *goSource) remove(d ast.Decl) {
+	p.replace(d, "")
+}
+
+func (p *goSource) insertAt(pos token.Pos, text string) {
+	off := p.offset(pos)
+	p.edits = append(p.edits, goEdit{start: off, end: off, text: text})
+}
+
+func (p *goSource) appendText(text string) {
+	p.tail = append(p.tail, text)
+}
+
+func (p *goSource) funcDecls() map[string]*ast.FuncDecl {
+	m := make(map[string]*ast.FuncDecl)
+	for _, decl := range p.file.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv == nil {
+			m[fd.Name.Name] = fd
+		}
+	}
+	return m
+}
+
+// apply 按位置从后往前应用修改, 避免前面的修改影响后面的偏移
+func (p *goSource) apply() []byte {
+	edits := make([]goEdit, len(p.edits))
+	copy(edits, p.edits)
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].start > edits[j].start
+	})
+
+	out := p.src
+	for _, e := range edits {
+		var buf []byte
+		buf = append(buf, out[:e.start]...)
+		buf = append(buf, e.text...)
+		buf = append(buf, out[e.end:]...)
+		out = buf
+	}
+
+	if len(p.tail) > 0 {
+		s := strings.TrimRight(string(out), "\n") + "\n"
+		for _, t := range p.tail {
+			s += "\n" + strings.TrimSpace(t) + "\n"
+		}
+		out = []byte(s)
+	}
+
+	return out
+}
+
+func importName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	p, _ := strconv.Unquote(spec.Path.Value)
+	return p[strings.LastIndex(p, "/")+1:]
+}
+
+func managedImportName(imp string) (string, string) {
+	// 支持 `alias "path"` 形式
+	if i := strings.Index(imp, " "); i > 0 {
+		p := strings.Trim(strings.TrimSpace(imp[i+1:]), "\"")
+		return imp[:i], p
+	}
+	p := strings.Trim(imp, "\"")
+	return p[strings.LastIndex(p, "/")+1:], p
+}
+
+func usedPackageNames(f *ast.File) map[string]bool {
+	used := make(map[string]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if id, ok := sel.X.(*ast.Ident); ok && id.Obj == nil {
+			used[id.Name] = true
+		}
+		return true
+	})
+	return used
+}
+
+// fixImports 重建 import 块: 保留仍被引用的 import, 删除 managed 中不再引用的,
+// 补上 managed 中被引用却缺失的, 最后 gofmt
+func fixImports(fn string, src []byte, managed []string) ([]byte, error) {
+	p, err := parseGoSourceBytes(fn, src)
+	if err != nil {
+		return nil, err
+	}
+
+	used := usedPackageNames(p.file)
+
+	managedSet := make(map[string]bool)
+	for _, m := range managed {
+		_, path := managedImportName(m)
+		managedSet[path] = true
+	}
+
+	var impList []string
+	have := make(map[string]bool)
+	for _, spec := range p.file.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		name := importName(spec)
+		keep := used[name] || name == "_" || name == "." || !managedSet[path]
+		if !keep || have[path] {
+			continue
+		}
+		have[path] = true
+		if spec.Name != nil {
+			impList = append(impList, fmt.Sprintf("%s %s", spec.Name.Name, spec.Path.Value))
+		} else {
+			impList = append(impList, spec.Path.Value)
+		}
+	}
+
+	for _, m := range managed {
+		name, path := managedImportName(m)
+		if have[path] || !used[name] {
+			continue
+		}
+		have[path] = true
+		if strings.Index(m, " ") > 0 {
+			impList = append(impList, fmt.Sprintf("%s \"%s\"", name, path))
+		} else {
+			impList = append(impList, fmt.Sprintf("\"%s\"", path))
+		}
+	}
+	sort.Strings(impList)
+
+	block := ""
+	if len(impList) > 0 {
+		block = fmt.Sprintf("import (\n%s\n)", JoinImportList(impList))
+	}
+
+	first := true
+	for _, decl := range p.file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			continue
+		}
+		if first {
+			p.replace(gd, block)
+			first = false
+		} else {
+			p.remove(gd)
+		}
+	}
+	if first && block != "" {
+		p.insertAt(p.file.Name.End(), "\n\n"+block)
+	}
+
+	return format.Source(p.apply())
+}
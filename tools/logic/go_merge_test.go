@@ -0,0 +1,90 @@
+package logic
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFixImports(t *testing.T) {
+	cases := []struct {
+		name    string
+		src     string
+		managed []string
+		want    string
+	}{
+		{
+			name:    "add missing managed import",
+			src:     "package x\n\nfunc F(c *rpc.Context) {}\n",
+			managed: []string{"brick/rpc"},
+			want:    "package x\n\nimport (\n\t\"brick/rpc\"\n)\n\nfunc F(c *rpc.Context) {}\n",
+		},
+		{
+			name:    "drop unused managed import",
+			src:     "package x\n\nimport (\n\t\"brick/rpc\"\n\t\"fmt\"\n)\n\nfunc F() { fmt.Println() }\n",
+			managed: []string{"brick/rpc"},
+			want:    "package x\n\nimport (\n\t\"fmt\"\n)\n\nfunc F() { fmt.Println() }\n",
+		},
+		{
+			name:    "keep unused user import",
+			src:     "package x\n\nimport _ \"embed\"\n\nfunc F() {}\n",
+			managed: []string{"brick/rpc"},
+			want:    "package x\n\nimport (\n\t_ \"embed\"\n)\n\nfunc F() {}\n",
+		},
+		{
+			name:    "alias import",
+			src:     "package x\n\nfunc F(m *pb.Msg) {}\n",
+			managed: []string{"pb \"a/b/shop\""},
+			want:    "package x\n\nimport (\n\tpb \"a/b/shop\"\n)\n\nfunc F(m *pb.Msg) {}\n",
+		},
+		{
+			name:    "merge duplicated import decls",
+			src:     "package x\n\nimport \"fmt\"\n\nimport \"strings\"\n\nfunc F() { fmt.Println(strings.ToUpper(\"\")) }\n",
+			managed: nil,
+			want:    "package x\n\nimport (\n\t\"fmt\"\n\t\"strings\"\n)\n\nfunc F() { fmt.Println(strings.ToUpper(\"\")) }\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, err := fixImports("x.go", []byte(c.src), c.managed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != c.want {
+				t.Errorf("got\n%s\nwant\n%s", out, c.want)
+			}
+		})
+	}
+}
+
+func TestGoSourceEdits(t *testing.T) {
+	src := `package x
+
+// A doc
+func A() {}
+
+func B() {}
+
+func C() {}
+`
+	p, err := parseGoSourceBytes("x.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := p.funcDecls()
+	p.replace(fs["A"], "func A() { println() }")
+	p.remove(fs["B"])
+	p.appendText("func D() {}")
+
+	got := string(p.apply())
+	for _, w := range []string{"func A() { println() }", "func C() {}", "\nfunc D() {}\n"} {
+		if !strings.Contains(got, w) {
+			t.Errorf("missing %q in\n%s", w, got)
+		}
+	}
+	for _, a := range []string{"// A doc", "func B()"} {
+		if strings.Contains(got, a) {
+			t.Errorf("unexpected %q in\n%s", a, got)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package logic
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite testdata/*.golden with the current output")
+
+// checkGolden 比较生成结果和 testdata/<name>.golden, 修改生成模板后用 go test -update 更新
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	fn := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(fn, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("read golden %s err %v, run go test -update to create it", fn, err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("%s differs from golden:\n%s", name, lineDiff(string(want), string(got)))
+	}
+}
+
+// lineDiff 只输出第一处不同附近的几行, 足够定位模板的改动
+func lineDiff(want, got string) string {
+	a := strings.Split(want, "\n")
+	b := strings.Split(got, "\n")
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	var out []string
+	for j := i; j < i+5; j++ {
+		if j < len(a) {
+			out = append(out, "- "+a[j])
+		}
+		if j < len(b) {
+			out = append(out, "+ "+b[j])
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// readGenerated 读取生成的文件, 不存在时直接失败
+func readGenerated(t *testing.T, fn string) []byte {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("read generated file %s err %v", fn, err)
+	}
+	return b
+}
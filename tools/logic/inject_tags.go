@@ -0,0 +1,316 @@
+package logic
+
+import (
+	"fmt"
+	"github.com/emicklei/proto"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 字段 tag 注入, 两种写法:
+//
+//	// @inject_tag: db:"user_name" validate:"required"
+//	string user_name = 1 [(ext.tag).bson = "name", (ext.tag).yaml = "name"];
+//
+// json tag 只允许修改选项 (如 omitempty/string), 改名会与网关使用的 protoc json 名不一致, 当作冲突
+var injectTagRe = regexp.MustCompile(`@inject_tag:\s*(.*)$`)
+
+// protoc 生成的 tag, 不允许覆盖
+var reservedTagKeys = map[string]bool{
+	"protobuf":     true,
+	"protobuf_key": true,
+	"protobuf_val": true,
+}
+
+type structTag struct {
+	Key   string
+	Value string
+}
+
+func (p structTag) String() string {
+	return fmt.Sprintf("%s:%s", p.Key, strconv.Quote(p.Value))
+}
+
+// InjectedTag 一个注入到 pb.go 中的 tag
+type InjectedTag struct {
+	Msg   string // Go 类型名
+	Field string // Go 字段名
+	Tag   string
+	Old   string // 原来的值, 新增时为空
+}
+
+func (p *InjectedTag) String() string {
+	if p.Old == "" {
+		return fmt.Sprintf("%s.%s %s", p.Msg, p.Field, p.Tag)
+	}
+	return fmt.Sprintf("%s.%s %s (was %s)", p.Msg, p.Field, p.Tag, p.Old)
+}
+
+// parseStructTag 按顺序解析 `key:"value" key2:"value2"`
+func parseStructTag(s string) ([]structTag, error) {
+	var list []structTag
+	s = strings.TrimSpace(s)
+	for s != "" {
+		i := strings.Index(s, ":")
+		if i <= 0 || i+1 >= len(s) || s[i+1] != '"' {
+			return nil, fmt.Errorf("bad tag syntax `%s`", s)
+		}
+		key := s[:i]
+		s = s[i+1:]
+
+		j := 1
+		for j < len(s) && s[j] != '"' {
+			if s[j] == '\\' {
+				j++
+			}
+			j++
+		}
+		if j >= len(s) {
+			return nil, fmt.Errorf("bad tag value of `%s`", key)
+		}
+		value, err := strconv.Unquote(s[:j+1])
+		if err != nil {
+			return nil, fmt.Errorf("bad tag value of `%s`: %v", key, err)
+		}
+		list = append(list, structTag{Key: key, Value: value})
+		s = strings.TrimSpace(s[j+1:])
+	}
+	return list, nil
+}
+
+func joinStructTag(list []structTag) string {
+	var ss []string
+	for _, t := range list {
+		ss = append(ss, t.String())
+	}
+	return strings.Join(ss, " ")
+}
+
+func fieldCommentLines(f *PbField) []string {
+	var lines []string
+	if c := f.GetPbComment(); c != nil {
+		lines = append(lines, c.Lines...)
+	}
+	if f.NormalField != nil && f.NormalField.InlineComment != nil {
+		lines = append(lines, f.NormalField.InlineComment.Lines...)
+	} else if f.MapField != nil && f.MapField.InlineComment != nil {
+		lines = append(lines, f.MapField.InlineComment.Lines...)
+	}
+	return lines
+}
+
+// FieldInjectTags 收集字段上声明的 tag, 注释和选项声明了同一个 key 但值不同时报错
+func FieldInjectTags(f *PbField) ([]structTag, error) {
+	var list []structTag
+	idx := make(map[string]int)
+	add := func(t structTag) error {
+		if reservedTagKeys[t.Key] {
+			return fmt.Errorf("tag `%s` is generated by protoc and can not be injected", t.Key)
+		}
+		if i, ok := idx[t.Key]; ok {
+			if list[i].Value != t.Value {
+				return fmt.Errorf("tag `%s` declared twice with different values %q and %q",
+					t.Key, list[i].Value, t.Value)
+			}
+			return nil
+		}
+		idx[t.Key] = len(list)
+		list = append(list, t)
+		return nil
+	}
+
+	for _, l := range fieldCommentLines(f) {
+		m := injectTagRe.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		tags, err := parseStructTag(m[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tags {
+			if err := add(t); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, o := range f.GetOptions() {
+		var pairs []*proto.NamedLiteral
+		if o.Name == "(ext.tag)" {
+			pairs = o.Constant.OrderedMap
+		} else if strings.HasPrefix(o.Name, "(ext.tag).") {
+			pairs = append(pairs, &proto.NamedLiteral{
+				Name: strings.TrimPrefix(o.Name, "(ext.tag)."), Literal: &o.Constant})
+		}
+		for _, x := range pairs {
+			if err := add(structTag{Key: x.Name, Value: x.Literal.Source}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return list, nil
+}
+
+func hasTagKey(list []structTag, key string) bool {
+	for _, t := range list {
+		if t.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// modelGormTag 模型中不能作为列的字段让 gorm 忽略, 指定了列名的字段告诉 gorm 列名,
+// 与 BuildDbTable 的规则一致
+func modelGormTag(m *PbMsg, f *PbField) *structTag {
+	if m.Table == "" {
+		return nil
+	}
+	if (f.Db != nil && f.Db.Ignore) || f.IsRepeated() || f.kind() == fieldKindMsg {
+		return &structTag{Key: "gorm", Value: "-"}
+	}
+	if f.Db != nil && f.Db.Column != "" {
+		return &structTag{Key: "gorm", Value: "column:" + f.Db.Column}
+	}
+	return nil
+}
+
+func tagName(v string) string {
+	if i := strings.Index(v, ","); i >= 0 {
+		return v[:i]
+	}
+	return v
+}
+
+// InjectFieldTags 把 proto 中声明的 tag 合并到 pb.go 的结构体字段上, 返回所有注入的 tag.
+// 已有的同名 tag 被替换, 其余 tag 保持原来的顺序. 所有检查都在写文件之前完成, 出错时 pb.go 不变
+func InjectFieldTags(fn string, msgs []*PbMsg) ([]*InjectedTag, error) {
+	wantMap := make(map[string]map[string][]structTag)
+
+	var errs []string
+	for _, m := range msgs {
+		for _, f := range m.Fields {
+			tags, err := FieldInjectTags(f)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s.%s: %v", m.FullName, f.GetName(), err))
+				continue
+			}
+			if t := modelGormTag(m, f); t != nil && !hasTagKey(tags, "gorm") {
+				tags = append(tags, *t)
+			}
+			if len(tags) == 0 {
+				continue
+			}
+			goMsg := GoMsgName(m)
+			if wantMap[goMsg] == nil {
+				wantMap[goMsg] = make(map[string][]structTag)
+			}
+			wantMap[goMsg][goCamelCase(f.GetName())] = tags
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	if len(wantMap) == 0 {
+		return nil, nil
+	}
+
+	src, err := parseGoSource(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var injected []*InjectedTag
+	for _, decl := range src.file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok || wantMap[ts.Name.Name] == nil {
+				continue
+			}
+
+			for _, field := range st.Fields.List {
+				if len(field.Names) != 1 || field.Tag == nil {
+					continue
+				}
+				want := wantMap[ts.Name.Name][field.Names[0].Name]
+				if want == nil {
+					continue
+				}
+				delete(wantMap[ts.Name.Name], field.Names[0].Name)
+
+				old, _ := strconv.Unquote(field.Tag.Value)
+				tags, err := parseStructTag(old)
+				if err != nil {
+					return nil, fmt.Errorf("%s.%s: %v", ts.Name.Name, field.Names[0].Name, err)
+				}
+
+				for _, t := range want {
+					x := &InjectedTag{Msg: ts.Name.Name, Field: field.Names[0].Name, Tag: t.String()}
+					found := false
+					for i := range tags {
+						if tags[i].Key != t.Key {
+							continue
+						}
+						found = true
+						if t.Key == "json" && tagName(tags[i].Value) != tagName(t.Value) {
+							errs = append(errs, fmt.Sprintf(
+								"%s.%s: json tag %q conflicts with protoc json name %q",
+								ts.Name.Name, field.Names[0].Name, t.Value, tagName(tags[i].Value)))
+						}
+						if tags[i].Value != t.Value {
+							x.Old = tags[i].String()
+						}
+						tags[i] = t
+					}
+					if !found {
+						tags = append(tags, t)
+					}
+					injected = append(injected, x)
+				}
+
+				text := joinStructTag(tags)
+				if strings.Contains(text, "`") {
+					text = strconv.Quote(text)
+				} else {
+					text = "`" + text + "`"
+				}
+				src.edits = append(src.edits, goEdit{
+					start: src.offset(field.Tag.Pos()),
+					end:   src.offset(field.Tag.End()),
+					text:  text,
+				})
+			}
+		}
+	}
+
+	// pb.go 中找不到对应的字段, 一般是 oneof 或者 message 名字对应不上
+	for msg, fields := range wantMap {
+		for name := range fields {
+			errs = append(errs, fmt.Sprintf("%s.%s: field not found in %s", msg, name, fn))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	out, err := format.Source(src.apply())
+	if err != nil {
+		return nil, err
+	}
+
+	return injected, ioutil.WriteFile(fn, out, 0644)
+}
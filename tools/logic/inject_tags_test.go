@@ -0,0 +1,134 @@
+package logic
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testInjectPbGo 模拟 protoc 生成的 pb.go
+const testInjectPbGo = "package user\n\n" +
+	"type User struct {\n" +
+	"\tUserName string `protobuf:\"bytes,1,opt,name=user_name,json=userName,proto3\" json:\"user_name,omitempty\"`\n" +
+	"\tAge      uint32 `protobuf:\"varint,2,opt,name=age,proto3\" json:\"age,omitempty\"`\n" +
+	"}\n"
+
+func writeTestPbGo(t *testing.T) string {
+	t.Helper()
+
+	fn := filepath.Join(t.TempDir(), "user.pb.go")
+	if err := ioutil.WriteFile(fn, []byte(testInjectPbGo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestParseStructTag(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string // joinStructTag 的结果, 为空表示解析失败
+	}{
+		{`json:"a,omitempty" db:"b"`, `json:"a,omitempty" db:"b"`},
+		{`  db:"x\"y"  `, `db:"x\"y"`},
+		{`db:`, ""},
+		{`db:"x`, ""},
+		{`:"x"`, ""},
+	}
+
+	for _, c := range cases {
+		list, err := parseStructTag(c.in)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("parseStructTag(%q) want err, got %v", c.in, list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseStructTag(%q) err %v", c.in, err)
+			continue
+		}
+		if got := joinStructTag(list); got != c.want {
+			t.Errorf("parseStructTag(%q) = %s, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestInjectFieldTags(t *testing.T) {
+	head := "syntax = \"proto3\";\npackage user;\nmessage User {\n"
+	cases := []struct {
+		name   string
+		fields string
+		want   string // 为空表示应当报错且不改动文件
+		err    string
+	}{
+		{
+			name: "comment and option",
+			fields: "// @inject_tag: db:\"user_name\" json:\"user_name\"\n" +
+				"string user_name = 1 [(ext.tag).bson = \"name\"];\nuint32 age = 2;\n",
+			want: "json:\"user_name\" db:\"user_name\" bson:\"name\"`",
+		},
+		{
+			name:   "json option only",
+			fields: "string user_name = 1;\nuint32 age = 2 [(ext.tag).json = \"age,string\"];\n",
+			want:   "json:\"age,string\"`",
+		},
+		{
+			name:   "json rename conflicts",
+			fields: "// @inject_tag: json:\"name\"\nstring user_name = 1;\nuint32 age = 2;\n",
+			err:    "json tag \"name\" conflicts with protoc json name \"user_name\"",
+		},
+		{
+			name:   "protobuf reserved",
+			fields: "string user_name = 1 [(ext.tag).protobuf = \"x\"];\nuint32 age = 2;\n",
+			err:    "generated by protoc",
+		},
+		{
+			name:   "comment and option differ",
+			fields: "// @inject_tag: db:\"a\"\nstring user_name = 1 [(ext.tag).db = \"b\"];\nuint32 age = 2;\n",
+			err:    "declared twice",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			snap := parseTestMsgs(t, head+c.fields+"}\n")
+			fn := writeTestPbGo(t)
+
+			injected, err := InjectFieldTags(fn, snap.Msgs)
+			got := string(readGenerated(t, fn))
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want err containing %q, got %v", c.err, err)
+				}
+				if got != testInjectPbGo {
+					t.Errorf("pb.go modified although injection failed:\n%s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(injected) == 0 {
+				t.Error("nothing reported as injected")
+			}
+			if !strings.Contains(got, c.want) {
+				t.Errorf("want %s in:\n%s", c.want, got)
+			}
+			if !strings.Contains(got, "protobuf:\"bytes,1,opt,name=user_name") {
+				t.Errorf("protobuf tag lost:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestInjectFieldTagsMissingField(t *testing.T) {
+	snap := parseTestMsgs(t, "syntax = \"proto3\";\npackage user;\nmessage User {\n"+
+		"string nick = 3 [(ext.tag).db = \"nick\"];\n}\n")
+	fn := writeTestPbGo(t)
+
+	_, err := InjectFieldTags(fn, snap.Msgs)
+	if err == nil || !strings.Contains(err.Error(), "User.Nick: field not found") {
+		t.Fatalf("want field not found err, got %v", err)
+	}
+}
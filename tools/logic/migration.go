@@ -0,0 +1,372 @@
+package logic
+
+import (
+	"brick/log"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DbSchema 迁移快照, 每次生成迁移后保存, 下次与新的表结构比较
+type DbSchema struct {
+	Version string     `json:"version"`
+	Driver  string     `json:"driver,omitempty"`
+	Tables  []*DbTable `json:"tables"`
+}
+
+func (p *DbSchema) Table(name string) *DbTable {
+	for _, t := range p.Tables {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// sqlDialect 生成某种数据库的 DDL
+type sqlDialect interface {
+	Name() string
+	CreateTable(t *DbTable) []string
+	DropTable(t *DbTable) []string
+	AddColumn(t *DbTable, c *DbColumn) []string
+	DropColumn(t *DbTable, c *DbColumn) []string
+	ModifyColumn(t *DbTable, old, c *DbColumn) ([]string, error)
+	CreateIndex(t *DbTable, x *DbIndex) []string
+	DropIndex(t *DbTable, x *DbIndex) []string
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string {
+	return DriverMysql
+}
+
+func (mysqlDialect) quote(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func (mysqlDialect) columnType(c *DbColumn) string {
+	if c.Type != "" {
+		return c.Type
+	}
+	switch c.PbType {
+	case "string":
+		size := c.Size
+		if size == 0 {
+			size = 255
+		}
+		return fmt.Sprintf("VARCHAR(%d)", size)
+	case "bytes":
+		if c.Size > 0 {
+			return fmt.Sprintf("VARBINARY(%d)", c.Size)
+		}
+		return "BLOB"
+	case "int32", "sint32", "sfixed32", "enum":
+		return "INT"
+	case "uint32", "fixed32":
+		return "INT UNSIGNED"
+	case "int64", "sint64", "sfixed64":
+		return "BIGINT"
+	case "uint64", "fixed64":
+		return "BIGINT UNSIGNED"
+	case "bool":
+		return "TINYINT(1)"
+	case "float":
+		return "FLOAT"
+	case "double":
+		return "DOUBLE"
+	}
+	return "TEXT"
+}
+
+func sqlDefault(c *DbColumn) string {
+	if c.PbType == "string" || c.PbType == "bytes" {
+		return "'" + strings.Replace(c.Default, "'", "''", -1) + "'"
+	}
+	return c.Default
+}
+
+func (p mysqlDialect) columnDef(c *DbColumn) string {
+	s := fmt.Sprintf("%s %s NOT NULL", p.quote(c.Name), p.columnType(c))
+	if c.AutoIncr {
+		s += " AUTO_INCREMENT"
+	}
+	if c.HasDefault {
+		s += " DEFAULT " + sqlDefault(c)
+	}
+	return s
+}
+
+func (p mysqlDialect) columnList(cols []string) string {
+	var list []string
+	for _, c := range cols {
+		list = append(list, p.quote(c))
+	}
+	return strings.Join(list, ", ")
+}
+
+func (p mysqlDialect) CreateTable(t *DbTable) []string {
+	var lines []string
+	for _, c := range t.Columns {
+		lines = append(lines, "  "+p.columnDef(c))
+	}
+	var pks []string
+	for _, c := range t.PKColumns() {
+		pks = append(pks, c.Name)
+	}
+	lines = append(lines, fmt.Sprintf("  PRIMARY KEY (%s)", p.columnList(pks)))
+	for _, x := range t.Indexes {
+		kw := "KEY"
+		if x.Unique {
+			kw = "UNIQUE KEY"
+		}
+		lines = append(lines, fmt.Sprintf("  %s %s (%s)", kw, p.quote(x.Name), p.columnList(x.Columns)))
+	}
+	return []string{fmt.Sprintf("CREATE TABLE %s (\n%s\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+		p.quote(t.Name), strings.Join(lines, ",\n"))}
+}
+
+func (p mysqlDialect) DropTable(t *DbTable) []string {
+	return []string{"DROP TABLE " + p.quote(t.Name)}
+}
+
+func (p mysqlDialect) AddColumn(t *DbTable, c *DbColumn) []string {
+	return []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", p.quote(t.Name), p.columnDef(c))}
+}
+
+func (p mysqlDialect) DropColumn(t *DbTable, c *DbColumn) []string {
+	return []string{fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", p.quote(t.Name), p.quote(c.Name))}
+}
+
+func (p mysqlDialect) ModifyColumn(t *DbTable, old, c *DbColumn) ([]string, error) {
+	return []string{fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s", p.quote(t.Name), p.columnDef(c))}, nil
+}
+
+func (p mysqlDialect) CreateIndex(t *DbTable, x *DbIndex) []string {
+	kw := "INDEX"
+	if x.Unique {
+		kw = "UNIQUE INDEX"
+	}
+	return []string{fmt.Sprintf("CREATE %s %s ON %s (%s)",
+		kw, p.quote(x.Name), p.quote(t.Name), p.columnList(x.Columns))}
+}
+
+func (p mysqlDialect) DropIndex(t *DbTable, x *DbIndex) []string {
+	return []string{fmt.Sprintf("DROP INDEX %s ON %s", p.quote(x.Name), p.quote(t.Name))}
+}
+
+var sqlDialects = map[string]sqlDialect{
+	DriverMysql:    mysqlDialect{},
+	DriverPostgres: postgresDialect{},
+	DriverSqlite:   sqliteDialect{},
+}
+
+func getSqlDialect(driver string) (sqlDialect, error) {
+	d := sqlDialects[driver]
+	if d == nil {
+		return nil, fmt.Errorf("unsupported db driver %s", driver)
+	}
+	return d, nil
+}
+
+func sameColumn(a, b *DbColumn) bool {
+	return a.PbType == b.PbType && a.Type == b.Type && a.Size == b.Size &&
+		a.HasDefault == b.HasDefault && a.Default == b.Default && a.AutoIncr == b.AutoIncr
+}
+
+func sameIndex(a, b *DbIndex) bool {
+	return a.Unique == b.Unique && strings.Join(a.Columns, ",") == strings.Join(b.Columns, ",")
+}
+
+func samePK(a, b *DbTable) bool {
+	var x, y []string
+	for _, c := range a.PKColumns() {
+		x = append(x, c.Name)
+	}
+	for _, c := range b.PKColumns() {
+		y = append(y, c.Name)
+	}
+	return strings.Join(x, ",") == strings.Join(y, ",")
+}
+
+// DiffDbSchema 生成 old -> new 的 up 语句, 以及反向的 down 语句
+func DiffDbSchema(d sqlDialect, old, cur *DbSchema) ([]string, []string, error) {
+	var up, down []string
+	// down 按相反的顺序执行
+	add := func(u, dn []string) {
+		up = append(up, u...)
+		down = append(dn, down...)
+	}
+
+	for _, t := range cur.Tables {
+		o := old.Table(t.Name)
+		if o == nil {
+			add(d.CreateTable(t), d.DropTable(t))
+			continue
+		}
+
+		if !samePK(o, t) {
+			return nil, nil, fmt.Errorf("table %s: changing primary key is not supported, write the migration by hand", t.Name)
+		}
+
+		for _, x := range o.Indexes {
+			if n := t.Index(x.Name); n == nil || !sameIndex(x, n) {
+				add(d.DropIndex(o, x), d.CreateIndex(o, x))
+			}
+		}
+		for _, c := range o.Columns {
+			if t.Column(c.Name) == nil {
+				log.Warnf("table %s: column %s dropped, data will be lost", t.Name, c.Name)
+				add(d.DropColumn(o, c), d.AddColumn(o, c))
+			}
+		}
+		for _, c := range t.Columns {
+			oc := o.Column(c.Name)
+			if oc == nil {
+				add(d.AddColumn(t, c), d.DropColumn(t, c))
+			} else if !sameColumn(oc, c) {
+				u, err := d.ModifyColumn(t, oc, c)
+				if err != nil {
+					return nil, nil, fmt.Errorf("table %s: %v", t.Name, err)
+				}
+				dn, err := d.ModifyColumn(o, c, oc)
+				if err != nil {
+					return nil, nil, fmt.Errorf("table %s: %v", t.Name, err)
+				}
+				add(u, dn)
+			}
+		}
+		for _, x := range t.Indexes {
+			if ox := o.Index(x.Name); ox == nil || !sameIndex(ox, x) {
+				add(d.CreateIndex(t, x), d.DropIndex(t, x))
+			}
+		}
+	}
+
+	for _, o := range old.Tables {
+		if cur.Table(o.Name) == nil {
+			log.Warnf("table %s dropped, data will be lost", o.Name)
+			add(d.DropTable(o), d.CreateTable(o))
+		}
+	}
+
+	return up, down, nil
+}
+
+func schemaFileName(dir, svrName string) string {
+	return filepath.Join(dir, svrName+".schema.json")
+}
+
+func LoadDbSchema(fn string) (*DbSchema, error) {
+	if !FileExists(fn) {
+		return &DbSchema{}, nil
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var s DbSchema
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s err %v", fn, err)
+	}
+	return &s, nil
+}
+
+func joinSql(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return strings.Join(list, ";\n\n") + ";\n"
+}
+
+// parseMigrationVersion 版本号是无符号整数 (默认为时间戳 20060102150405), 按数值比较,
+// 与 golang-migrate 等工具解析文件名前缀的方式一致
+func parseMigrationVersion(v string) (uint64, error) {
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid migration version `%s`, must be an unsigned integer", v)
+	}
+	return n, nil
+}
+
+// GenerateMigration 比较模型与上次的快照, 有变化时在 dir 下生成
+// <version>_<svr>.up.sql / .down.sql, 并更新快照
+func GenerateMigration(svrName string, msgs []*PbMsg, dir, driver, version string) error {
+	d, err := getSqlDialect(driver)
+	if err != nil {
+		return err
+	}
+	ver, err := parseMigrationVersion(version)
+	if err != nil {
+		return err
+	}
+
+	tables, err := BuildDbSchema(msgs)
+	if err != nil {
+		return err
+	}
+
+	fn := schemaFileName(dir, svrName)
+	old, err := LoadDbSchema(fn)
+	if err != nil {
+		return err
+	}
+
+	// 快照之前的迁移都是为 old.Driver 生成的, 换数据库需要重新开始
+	if old.Driver != "" && old.Driver != d.Name() {
+		return fmt.Errorf("migrations in %s are generated for %s, not %s", dir, old.Driver, d.Name())
+	}
+
+	cur := &DbSchema{Version: version, Driver: d.Name(), Tables: tables}
+	up, down, err := DiffDbSchema(d, old, cur)
+	if err != nil {
+		return err
+	}
+	if len(up) == 0 {
+		log.Infof("no schema change since version %s", old.Version)
+		return nil
+	}
+
+	if old.Version != "" {
+		a, err := parseMigrationVersion(old.Version)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+		if ver <= a {
+			return fmt.Errorf("version %s must be greater than last version %s", version, old.Version)
+		}
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	head := fmt.Sprintf("-- Code generated by rpc_gen. DO NOT EDIT.\n-- %s %s\n\n", d.Name(), svrName)
+	base := filepath.Join(dir, fmt.Sprintf("%s_%s", version, svrName))
+	err = ioutil.WriteFile(base+".up.sql", []byte(head+joinSql(up)), 0644)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(base+".down.sql", []byte(head+joinSql(down)), 0644)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(cur, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(fn, append(b, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("generate migration %s.up.sql, %d statement(s)", base, len(up))
+	return nil
+}
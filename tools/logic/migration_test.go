@@ -0,0 +1,192 @@
+package logic
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testDbSchema(t *testing.T, fields string) *DbSchema {
+	t.Helper()
+
+	snap := parseTestModels(t, "syntax = \"proto3\";\npackage user;\nmessage User {\n"+fields+"}\n", testModelPbGo)
+	tables, err := BuildDbSchema(snap.Msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DbSchema{Tables: tables}
+}
+
+func TestDiffDbSchema(t *testing.T) {
+	base := "uint64 id = 1 [(ext.db).pk = true];\nstring name = 2 [(ext.db).size = 64];\n"
+	cases := []struct {
+		name string
+		old  string // 为空表示没有旧表
+		cur  string
+		up   []string
+		down []string
+		err  string
+	}{
+		{
+			name: "create",
+			cur:  base,
+			up:   []string{"CREATE TABLE `users`"},
+			down: []string{"DROP TABLE `users`"},
+		},
+		{
+			name: "no change",
+			old:  base,
+			cur:  base,
+		},
+		{
+			name: "add column and index",
+			old:  base,
+			cur:  base + "uint32 age = 3 [(ext.db).index = true];\n",
+			up:   []string{"ADD COLUMN `age`", "CREATE INDEX"},
+			down: []string{"DROP INDEX", "DROP COLUMN `age`"},
+		},
+		{
+			name: "drop column",
+			old:  base + "uint32 age = 3;\n",
+			cur:  base,
+			up:   []string{"DROP COLUMN `age`"},
+			down: []string{"ADD COLUMN `age`"},
+		},
+		{
+			name: "modify column",
+			old:  base,
+			cur:  "uint64 id = 1 [(ext.db).pk = true];\nstring name = 2 [(ext.db).size = 128];\n",
+			up:   []string{"MODIFY COLUMN `name` VARCHAR(128)"},
+			down: []string{"MODIFY COLUMN `name` VARCHAR(64)"},
+		},
+		{
+			name: "change pk",
+			old:  base,
+			cur:  "uint64 id = 1;\nstring name = 2 [(ext.db) = {size: 64, pk: true}];\n",
+			err:  "changing primary key is not supported",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			old := &DbSchema{}
+			if c.old != "" {
+				old = testDbSchema(t, c.old)
+			}
+			cur := testDbSchema(t, c.cur)
+
+			up, down, err := DiffDbSchema(mysqlDialect{}, old, cur)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want err containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSqlList(t, "up", up, c.up)
+			checkSqlList(t, "down", down, c.down)
+		})
+	}
+}
+
+func TestDiffDbSchemaSqlite(t *testing.T) {
+	base := "uint64 id = 1 [(ext.db).pk = true];\nstring name = 2 [(ext.db).size = 64];\n"
+	old := testDbSchema(t, base)
+
+	// sqlite 中长度不影响列定义, 不需要语句
+	up, down, err := DiffDbSchema(sqliteDialect{}, old, testDbSchema(t, "uint64 id = 1 [(ext.db).pk = true];\nstring name = 2 [(ext.db).size = 128];\n"))
+	if err != nil || len(up) != 0 || len(down) != 0 {
+		t.Errorf("want no statement, got %q %q %v", up, down, err)
+	}
+
+	// 真正的修改不能悄悄跳过, 否则快照和数据库不一致
+	cur := testDbSchema(t, "uint64 id = 1 [(ext.db).pk = true];\nstring name = 2 [(ext.db) = {size: 64, default: \"x\"}];\nuint32 age = 3;\n")
+	_, _, err = DiffDbSchema(sqliteDialect{}, old, cur)
+	if err == nil || !strings.Contains(err.Error(), "table users: sqlite can not modify column name") {
+		t.Fatalf("want modify column error, got %v", err)
+	}
+}
+
+// checkSqlList 每条语句按顺序包含对应的片段
+func checkSqlList(t *testing.T, name string, got, want []string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("%s = %q, want %d statements", name, got, len(want))
+	}
+	for i := range want {
+		if !strings.Contains(got[i], want[i]) {
+			t.Errorf("%s[%d] = %s, want it to contain %s", name, i, got[i], want[i])
+		}
+	}
+}
+
+func TestGenerateMigrationGolden(t *testing.T) {
+	for _, driver := range []string{DriverMysql, DriverPostgres, DriverSqlite} {
+		t.Run(driver, func(t *testing.T) {
+			snap := parseTestModels(t, testModelProto, testModelPbGo)
+			dir := t.TempDir()
+
+			err := GenerateMigration("user", snap.Msgs, dir, driver, "20260101000000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			up := readGenerated(t, filepath.Join(dir, "20260101000000_user.up.sql"))
+			down := readGenerated(t, filepath.Join(dir, "20260101000000_user.down.sql"))
+			checkGolden(t, "migration_"+driver, append(append(up, "-- down\n"...), down...))
+
+			// 没有变化时不生成新的迁移
+			err = GenerateMigration("user", snap.Msgs, dir, driver, "20260102000000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if FileExists(filepath.Join(dir, "20260102000000_user.up.sql")) {
+				t.Error("migration generated without schema change")
+			}
+		})
+	}
+}
+
+func TestGenerateMigrationVersion(t *testing.T) {
+	snap := parseTestModels(t, testModelProto, testModelPbGo)
+	dir := t.TempDir()
+
+	err := GenerateMigration("user", snap.Msgs, dir, DriverMysql, "v2")
+	if err == nil || !strings.Contains(err.Error(), "must be an unsigned integer") {
+		t.Fatalf("want invalid version err, got %v", err)
+	}
+	if FileExists(schemaFileName(dir, "user")) {
+		t.Error("snapshot written for invalid version")
+	}
+
+	if err := GenerateMigration("user", snap.Msgs, dir, DriverMysql, "10"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 数值比较, 9 < 10 虽然按字符串更大
+	snap = parseTestModels(t, testModelProto+"message Log {\n  uint64 id = 1 [(ext.db).pk = true];\n}\n",
+		testModelPbGo+"func (*Log) TableName() string {\n\treturn \"logs\"\n}\n")
+	err = GenerateMigration("user", snap.Msgs, dir, DriverMysql, "9")
+	if err == nil || !strings.Contains(err.Error(), "must be greater than last version 10") {
+		t.Fatalf("want version order err, got %v", err)
+	}
+	if err := GenerateMigration("user", snap.Msgs, dir, DriverMysql, "11"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 快照中的版本号被改坏时报错而不是当作 0
+	fn := schemaFileName(dir, "user")
+	b := readGenerated(t, fn)
+	err = ioutil.WriteFile(fn, []byte(strings.Replace(string(b), `"version": "11"`, `"version": "x"`, 1)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap = parseTestModels(t, testModelProto, testModelPbGo)
+	err = GenerateMigration("user", snap.Msgs, dir, DriverMysql, "12")
+	if err == nil || !strings.Contains(err.Error(), "invalid migration version `x`") {
+		t.Fatalf("want invalid snapshot version err, got %v", err)
+	}
+}
@@ -0,0 +1,441 @@
+package logic
+
+import (
+	"brick/log"
+	"fmt"
+	"github.com/emicklei/proto"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 数据库模型, 带 gorm 标记的 message 由 InjectTagWriteGormCode 在 pb.go 中生成 TableName,
+// 表名取它的返回值 (见 GormTables), 字段上用 (ext.db) 指定列属性:
+//
+//	message User {
+//	    uint64 id = 1 [(ext.db).pk = true];
+//	    string name = 2 [(ext.db) = {size: 64, unique: true}];
+//	    uint32 corp_id = 3 [(ext.db).index = "idx_corp_state"];
+//	    uint32 state = 4 [(ext.db) = {index: "idx_corp_state", default: "1"}];
+//	}
+//
+// index/unique 为 true 时使用默认的索引名, 为字符串时同名的字段组成联合索引
+type FieldDb struct {
+	Column     string
+	Type       string // 覆盖默认的 sql 类型
+	Size       int
+	Default    string
+	HasDefault bool
+	PK         bool
+	Index      string
+	Unique     string
+	Ignore     bool
+}
+
+func setFieldDb(d *FieldDb, key string, v *proto.Literal) error {
+	var err error
+	switch key {
+	case "column":
+		d.Column = v.Source
+	case "type":
+		d.Type = v.Source
+	case "size":
+		d.Size, err = strconv.Atoi(v.Source)
+	case "default":
+		d.Default = v.Source
+		d.HasDefault = true
+	case "pk":
+		d.PK = v.Source == "true"
+	case "index":
+		if v.Source != "false" {
+			d.Index = v.Source
+		}
+	case "unique":
+		if v.Source != "false" {
+			d.Unique = v.Source
+		}
+	case "ignore":
+		d.Ignore = v.Source == "true"
+	default:
+		err = fmt.Errorf("unknown db option `%s`", key)
+	}
+	return err
+}
+
+// ParseFieldDb 解析字段上的 (ext.db) 选项, 没有时返回 nil
+func ParseFieldDb(opts []*proto.Option) (*FieldDb, error) {
+	var d *FieldDb
+	for _, o := range opts {
+		if o.Name != "(ext.db)" && !strings.HasPrefix(o.Name, "(ext.db).") {
+			continue
+		}
+		if d == nil {
+			d = &FieldDb{}
+		}
+
+		pairs := o.Constant.OrderedMap
+		if o.Name != "(ext.db)" {
+			pairs = []*proto.NamedLiteral{{Name: strings.TrimPrefix(o.Name, "(ext.db)."), Literal: &o.Constant}}
+		}
+		for _, x := range pairs {
+			if err := setFieldDb(d, x.Name, x.Literal); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
+// GormTables 返回 pb.go 中 TableName 方法声明的表名, key 为 Go 类型名
+func GormTables(fn string) (map[string]string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), fn, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string)
+	for _, decl := range f.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok || fd.Name.Name != "TableName" || fd.Body == nil {
+			continue
+		}
+		typ := recvTypeName(fd)
+		if typ == "" {
+			continue
+		}
+
+		var name string
+		if len(fd.Body.List) == 1 {
+			if ret, ok := fd.Body.List[0].(*ast.ReturnStmt); ok && len(ret.Results) == 1 {
+				if lit, ok := ret.Results[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					name, _ = strconv.Unquote(lit.Value)
+				}
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("%s.TableName in %s must return a string literal", typ, fn)
+		}
+		res[typ] = name
+	}
+	return res, nil
+}
+
+// SetMsgTables 按 GormTables 的结果设置 message 的表名, 不在其中的 message 不是模型
+func SetMsgTables(msgs []*PbMsg, tables map[string]string) {
+	for _, m := range msgs {
+		m.Table = tables[GoMsgName(m)]
+	}
+}
+
+// toSnake 与 gorm 默认的命名规则一致: UserID -> user_id
+func toSnake(s string) string {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' {
+			if i > 0 {
+				prev := s[i-1]
+				nextLower := i+1 < len(s) && 'a' <= s[i+1] && s[i+1] <= 'z'
+				if ('a' <= prev && prev <= 'z') || ('0' <= prev && prev <= '9') ||
+					(nextLower && 'A' <= prev && prev <= 'Z') {
+					out = append(out, '_')
+				}
+			}
+			c += 'a' - 'A'
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
+
+// DbColumn/DbIndex/DbTable 与数据库无关的表结构, 也是迁移快照的格式
+type DbColumn struct {
+	Name       string `json:"name"`
+	Field      string `json:"field"` // Go 字段名
+	PbType     string `json:"pb_type"`
+	Type       string `json:"type,omitempty"`
+	Size       int    `json:"size,omitempty"`
+	Default    string `json:"default,omitempty"`
+	HasDefault bool   `json:"has_default,omitempty"`
+	PK         bool   `json:"pk,omitempty"`
+	AutoIncr   bool   `json:"auto_incr,omitempty"`
+}
+
+type DbIndex struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique,omitempty"`
+}
+
+type DbTable struct {
+	Name    string      `json:"name"`
+	Msg     string      `json:"msg"` // Go 类型名
+	Columns []*DbColumn `json:"columns"`
+	Indexes []*DbIndex  `json:"indexes,omitempty"`
+}
+
+func (p *DbTable) Column(name string) *DbColumn {
+	for _, c := range p.Columns {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (p *DbTable) Index(name string) *DbIndex {
+	for _, x := range p.Indexes {
+		if x.Name == name {
+			return x
+		}
+	}
+	return nil
+}
+
+func (p *DbTable) PKColumns() []*DbColumn {
+	var list []*DbColumn
+	for _, c := range p.Columns {
+		if c.PK {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+func isIntPbType(typ string) bool {
+	switch typ {
+	case "int32", "int64", "uint32", "uint64", "sint32", "sint64",
+		"fixed32", "fixed64", "sfixed32", "sfixed64":
+		return true
+	}
+	return false
+}
+
+// BuildDbTable 由模型 message 生成表结构, 不是模型时返回 nil
+func BuildDbTable(m *PbMsg) (*DbTable, error) {
+	if m.Table == "" {
+		return nil, nil
+	}
+
+	t := &DbTable{Name: m.Table, Msg: GoMsgName(m)}
+	idxMap := make(map[string]*DbIndex)
+	var idxOrder []string
+	addIdx := func(name, col string, unique bool) error {
+		if name == "true" {
+			prefix := "idx"
+			if unique {
+				prefix = "uk"
+			}
+			name = fmt.Sprintf("%s_%s_%s", prefix, t.Name, col)
+		}
+		x := idxMap[name]
+		if x == nil {
+			x = &DbIndex{Name: name, Unique: unique}
+			idxMap[name] = x
+			idxOrder = append(idxOrder, name)
+		} else if x.Unique != unique {
+			return fmt.Errorf("index %s used as both index and unique", name)
+		}
+		x.Columns = append(x.Columns, col)
+		return nil
+	}
+
+	for _, f := range m.Fields {
+		d := f.Db
+		if d == nil {
+			d = &FieldDb{}
+		}
+		if d.Ignore {
+			continue
+		}
+
+		kind := f.kind()
+		if f.IsRepeated() || kind == fieldKindMsg {
+			if f.Db != nil {
+				return nil, fmt.Errorf("field %s: repeated, map and message fields can not be columns, add (ext.db).ignore", f.GetName())
+			}
+			log.Warnf("model %s: skip non-scalar field %s", m.FullName, f.GetName())
+			continue
+		}
+
+		c := &DbColumn{
+			Name:       d.Column,
+			Field:      goCamelCase(f.GetName()),
+			PbType:     f.GetType(),
+			Type:       d.Type,
+			Size:       d.Size,
+			Default:    d.Default,
+			HasDefault: d.HasDefault,
+			PK:         d.PK,
+		}
+		if kind == fieldKindEnum {
+			c.PbType = "enum"
+		}
+		if c.Name == "" {
+			c.Name = toSnake(c.Field)
+		}
+		t.Columns = append(t.Columns, c)
+
+		if d.Index != "" {
+			if err := addIdx(d.Index, c.Name, false); err != nil {
+				return nil, err
+			}
+		}
+		if d.Unique != "" {
+			if err := addIdx(d.Unique, c.Name, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	pks := t.PKColumns()
+	if len(pks) == 0 {
+		return nil, fmt.Errorf("model %s missed primary key, add (ext.db).pk = true", m.FullName)
+	}
+	// 与 gorm 一致, 单个整数主键自增
+	if len(pks) == 1 && isIntPbType(pks[0].PbType) && pks[0].Type == "" {
+		pks[0].AutoIncr = true
+	}
+
+	for _, name := range idxOrder {
+		t.Indexes = append(t.Indexes, idxMap[name])
+	}
+
+	return t, nil
+}
+
+// BuildDbSchema 返回所有模型的表结构, 按表名排序
+func BuildDbSchema(msgs []*PbMsg) ([]*DbTable, error) {
+	var list []*DbTable
+	names := make(map[string]string)
+	for _, m := range msgs {
+		t, err := BuildDbTable(m)
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			continue
+		}
+		if other, ok := names[t.Name]; ok {
+			return nil, fmt.Errorf("table %s declared by both %s and %s", t.Name, other, m.FullName)
+		}
+		names[t.Name] = m.FullName
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+func recvTypeName(fd *ast.FuncDecl) string {
+	if fd.Recv == nil || len(fd.Recv.List) == 0 {
+		return ""
+	}
+	typ := fd.Recv.List[0].Type
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+	if id, ok := typ.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+func receiverMethods(f *ast.File) map[string]bool {
+	res := make(map[string]bool)
+	for _, decl := range f.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		if typ := recvTypeName(fd); typ != "" {
+			res[typ+"."+fd.Name.Name] = true
+		}
+	}
+	return res
+}
+
+// packageMethods 返回目录下其它 go 文件中已经声明的方法, key 为 Type.Method
+func packageMethods(dir string, skip string) map[string]bool {
+	res := make(map[string]bool)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, fn := range files {
+		if filepath.Base(fn) == filepath.Base(skip) {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), fn, nil, 0)
+		if err != nil {
+			continue
+		}
+		for name := range receiverMethods(f) {
+			res[name] = true
+		}
+	}
+	return res
+}
+
+var modelTemp = `// Code generated by rpc_gen. DO NOT EDIT.
+package %s
+
+// ModelIndex 由 (ext.db).index/unique 声明的索引
+type ModelIndex struct {
+	Name    string
+	Columns []string
+	Unique  bool
+}
+%s`
+
+// GenerateModel 为模型生成索引定义, TableName 已由 gorm 注入代码生成,
+// 其它文件中已有的 ModelIndexes 不再生成
+func GenerateModel(PD ProtoDetect, msgs []*PbMsg, rootDir string) error {
+	tables, err := BuildDbSchema(msgs)
+	if err != nil {
+		return err
+	}
+
+	fn := GetTargetFileName(PD, "model", rootDir)
+	if len(tables) == 0 {
+		if FileExists(fn) {
+			return os.Remove(fn)
+		}
+		return nil
+	}
+
+	exists := packageMethods(filepath.Dir(fn), fn)
+
+	var body []string
+	for _, t := range tables {
+		if exists[t.Msg+".ModelIndexes"] {
+			continue
+		}
+		var list []string
+		for _, x := range t.Indexes {
+			var cols []string
+			for _, c := range x.Columns {
+				cols = append(cols, strconv.Quote(c))
+			}
+			list = append(list, fmt.Sprintf("\t\t{Name: %s, Columns: []string{%s}, Unique: %v},",
+				strconv.Quote(x.Name), strings.Join(cols, ", "), x.Unique))
+		}
+		body = append(body, fmt.Sprintf(
+			"func (*%s) ModelIndexes() []ModelIndex {\n\treturn []ModelIndex{\n%s\n\t}\n}",
+			t.Msg, strings.Join(list, "\n")))
+	}
+
+	context := fmt.Sprintf(modelTemp, PD.PackageName, "\n"+strings.Join(body, "\n\n")+"\n")
+	src, err := format.Source([]byte(context))
+	if err != nil {
+		log.Errorf("format %s err %v", fn, err)
+		return err
+	}
+
+	return ioutil.WriteFile(fn, src, 0644)
+}
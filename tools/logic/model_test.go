@@ -0,0 +1,144 @@
+package logic
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testModelProto = `syntax = "proto3";
+package user;
+
+message User {
+  uint64 id = 1 [(ext.db).pk = true];
+  string name = 2 [(ext.db) = {size: 64, unique: true}];
+  uint32 corp_id = 3 [(ext.db).index = "idx_corp_state"];
+  uint32 state = 4 [(ext.db) = {index: "idx_corp_state", default: "1"}];
+  repeated string tags = 5;
+}
+
+message Req {
+  uint64 id = 1;
+}
+`
+
+// testModelPbGo 模拟 gorm 注入代码在 pb.go 中生成的 TableName
+const testModelPbGo = `package user
+
+type User struct{}
+
+func (*User) TableName() string {
+	return "users"
+}
+`
+
+// parseTestModels 解析 proto 并按 pbGo 中的 TableName 标记模型
+func parseTestModels(t *testing.T, src, pbGo string) *ProtoSnapshot {
+	t.Helper()
+
+	snap := parseTestMsgs(t, src)
+	fn := filepath.Join(t.TempDir(), "user.pb.go")
+	if err := ioutil.WriteFile(fn, []byte(pbGo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := GormTables(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetMsgTables(snap.Msgs, tables)
+	return snap
+}
+
+func TestGormTables(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		want map[string]string
+		err  string
+	}{
+		{
+			name: "pointer and value receiver",
+			src: "package user\n" +
+				"func (*User) TableName() string { return \"users\" }\n" +
+				"func (Order) TableName() string { return `orders` }\n" +
+				"func (*User) String() string { return \"x\" }\n" +
+				"func TableName() string { return \"free\" }\n",
+			want: map[string]string{"User": "users", "Order": "orders"},
+		},
+		{
+			name: "not a literal",
+			src:  "package user\nfunc (*User) TableName() string { return prefix + \"users\" }\n",
+			err:  "User.TableName",
+		},
+		{
+			name: "no model",
+			src:  "package user\ntype User struct{}\n",
+			want: map[string]string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "user.pb.go")
+			if err := ioutil.WriteFile(fn, []byte(c.src), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := GormTables(fn)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("want err containing %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("GormTables = %v, want %v", got, c.want)
+			}
+			for k, v := range c.want {
+				if got[k] != v {
+					t.Errorf("GormTables[%s] = %s, want %s", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildDbSchema(t *testing.T) {
+	snap := parseTestModels(t, testModelProto, testModelPbGo)
+
+	tables, err := BuildDbSchema(snap.Msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 || tables[0].Name != "users" || tables[0].Msg != "User" {
+		t.Fatalf("want only table users of User, got %+v", tables)
+	}
+
+	u := tables[0]
+	if u.Column("tags") != nil {
+		t.Error("repeated field tags must not be a column")
+	}
+	if pk := u.PKColumns(); len(pk) != 1 || pk[0].Name != "id" {
+		t.Errorf("want pk id, got %+v", pk)
+	}
+	if x := u.Index("idx_corp_state"); x == nil || x.Unique || strings.Join(x.Columns, ",") != "corp_id,state" {
+		t.Errorf("want index idx_corp_state(corp_id,state), got %+v", x)
+	}
+	if c := u.Column("state"); c == nil || !c.HasDefault || c.Default != "1" {
+		t.Errorf("want state default 1, got %+v", c)
+	}
+}
+
+func TestGenerateModelGolden(t *testing.T) {
+	snap := parseTestModels(t, testModelProto, testModelPbGo)
+	root := t.TempDir()
+
+	if err := GenerateModel(*snap.PD, snap.Msgs, root); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "model", readGenerated(t, GetTargetFileName(*snap.PD, "model", root)))
+}
@@ -0,0 +1,264 @@
+package logic
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 支持的数据库
+const (
+	DriverMysql    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSqlite   = "sqlite"
+)
+
+// CheckDbDriver 检查 -driver 参数
+func CheckDbDriver(driver string) error {
+	_, err := getSqlDialect(driver)
+	return err
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func quoteColumnList(cols []string) string {
+	var list []string
+	for _, c := range cols {
+		list = append(list, quoteIdent(c))
+	}
+	return strings.Join(list, ", ")
+}
+
+// sqlZero 新增 NOT NULL 列时, 已有的行使用零值
+func sqlZero(c *DbColumn, boolLit bool) string {
+	switch c.PbType {
+	case "string", "bytes":
+		return "''"
+	case "bool":
+		if boolLit {
+			return "FALSE"
+		}
+	}
+	return "0"
+}
+
+func createIndexSql(t *DbTable, x *DbIndex) string {
+	kw := "INDEX"
+	if x.Unique {
+		kw = "UNIQUE INDEX"
+	}
+	return fmt.Sprintf("CREATE %s %s ON %s (%s)",
+		kw, quoteIdent(x.Name), quoteIdent(t.Name), quoteColumnList(x.Columns))
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return DriverPostgres
+}
+
+// postgres 没有无符号整数, uint32 用 BIGINT 才不会溢出
+func (postgresDialect) columnType(c *DbColumn) string {
+	if c.Type != "" {
+		return c.Type
+	}
+	if c.AutoIncr {
+		switch c.PbType {
+		case "int32", "sint32", "sfixed32":
+			return "SERIAL"
+		}
+		return "BIGSERIAL"
+	}
+	switch c.PbType {
+	case "string":
+		if c.Size > 0 {
+			return fmt.Sprintf("VARCHAR(%d)", c.Size)
+		}
+		return "TEXT"
+	case "bytes":
+		return "BYTEA"
+	case "int32", "sint32", "sfixed32", "enum":
+		return "INTEGER"
+	case "uint32", "fixed32", "int64", "sint64", "sfixed64", "uint64", "fixed64":
+		return "BIGINT"
+	case "bool":
+		return "BOOLEAN"
+	case "float":
+		return "REAL"
+	case "double":
+		return "DOUBLE PRECISION"
+	}
+	return "TEXT"
+}
+
+func (p postgresDialect) defaultValue(c *DbColumn) string {
+	if c.PbType == "bool" {
+		if c.Default == "1" || strings.ToLower(c.Default) == "true" {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return sqlDefault(c)
+}
+
+func (p postgresDialect) columnDef(c *DbColumn, zeroDefault bool) string {
+	s := fmt.Sprintf("%s %s NOT NULL", quoteIdent(c.Name), p.columnType(c))
+	if c.HasDefault {
+		s += " DEFAULT " + p.defaultValue(c)
+	} else if zeroDefault && !c.AutoIncr {
+		s += " DEFAULT " + sqlZero(c, true)
+	}
+	return s
+}
+
+func (p postgresDialect) CreateTable(t *DbTable) []string {
+	var lines []string
+	for _, c := range t.Columns {
+		lines = append(lines, "  "+p.columnDef(c, false))
+	}
+	var pks []string
+	for _, c := range t.PKColumns() {
+		pks = append(pks, c.Name)
+	}
+	lines = append(lines, fmt.Sprintf("  PRIMARY KEY (%s)", quoteColumnList(pks)))
+
+	list := []string{fmt.Sprintf("CREATE TABLE %s (\n%s\n)", quoteIdent(t.Name), strings.Join(lines, ",\n"))}
+	for _, x := range t.Indexes {
+		list = append(list, createIndexSql(t, x))
+	}
+	return list
+}
+
+func (p postgresDialect) DropTable(t *DbTable) []string {
+	return []string{"DROP TABLE " + quoteIdent(t.Name)}
+}
+
+func (p postgresDialect) AddColumn(t *DbTable, c *DbColumn) []string {
+	return []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", quoteIdent(t.Name), p.columnDef(c, true))}
+}
+
+func (p postgresDialect) DropColumn(t *DbTable, c *DbColumn) []string {
+	return []string{fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", quoteIdent(t.Name), quoteIdent(c.Name))}
+}
+
+func (p postgresDialect) ModifyColumn(t *DbTable, old, c *DbColumn) ([]string, error) {
+	prefix := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s", quoteIdent(t.Name), quoteIdent(c.Name))
+
+	var list []string
+	if p.columnType(old) != p.columnType(c) {
+		typ := p.columnType(c)
+		// SERIAL 只能用于建表, 修改时使用对应的整数类型
+		if typ == "SERIAL" {
+			typ = "INTEGER"
+		} else if typ == "BIGSERIAL" {
+			typ = "BIGINT"
+		}
+		list = append(list, fmt.Sprintf("%s TYPE %s USING %s::%s", prefix, typ, quoteIdent(c.Name), typ))
+	}
+	if old.HasDefault != c.HasDefault || old.Default != c.Default {
+		if c.HasDefault {
+			list = append(list, fmt.Sprintf("%s SET DEFAULT %s", prefix, p.defaultValue(c)))
+		} else {
+			list = append(list, prefix+" DROP DEFAULT")
+		}
+	}
+	return list, nil
+}
+
+func (p postgresDialect) CreateIndex(t *DbTable, x *DbIndex) []string {
+	return []string{createIndexSql(t, x)}
+}
+
+func (p postgresDialect) DropIndex(t *DbTable, x *DbIndex) []string {
+	return []string{"DROP INDEX " + quoteIdent(x.Name)}
+}
+
+// sqliteDialect 主要用于测试, sqlite 的列类型只是亲和性, 修改列类型时不生成语句
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return DriverSqlite
+}
+
+func (sqliteDialect) columnType(c *DbColumn) string {
+	if c.Type != "" {
+		return c.Type
+	}
+	switch c.PbType {
+	case "string":
+		return "TEXT"
+	case "bytes":
+		return "BLOB"
+	case "float", "double":
+		return "REAL"
+	}
+	return "INTEGER"
+}
+
+func (p sqliteDialect) columnDef(c *DbColumn, inlinePK bool, zeroDefault bool) string {
+	s := fmt.Sprintf("%s %s", quoteIdent(c.Name), p.columnType(c))
+	// 自增主键必须写成 INTEGER PRIMARY KEY AUTOINCREMENT
+	if inlinePK {
+		return s + " PRIMARY KEY AUTOINCREMENT"
+	}
+	s += " NOT NULL"
+	if c.HasDefault {
+		s += " DEFAULT " + sqlDefault(c)
+	} else if zeroDefault {
+		s += " DEFAULT " + sqlZero(c, false)
+	}
+	return s
+}
+
+func (p sqliteDialect) CreateTable(t *DbTable) []string {
+	pks := t.PKColumns()
+	inline := len(pks) == 1 && pks[0].AutoIncr
+
+	var lines []string
+	for _, c := range t.Columns {
+		lines = append(lines, "  "+p.columnDef(c, inline && c.PK, false))
+	}
+	if !inline {
+		var names []string
+		for _, c := range pks {
+			names = append(names, c.Name)
+		}
+		lines = append(lines, fmt.Sprintf("  PRIMARY KEY (%s)", quoteColumnList(names)))
+	}
+
+	list := []string{fmt.Sprintf("CREATE TABLE %s (\n%s\n)", quoteIdent(t.Name), strings.Join(lines, ",\n"))}
+	for _, x := range t.Indexes {
+		list = append(list, createIndexSql(t, x))
+	}
+	return list
+}
+
+func (p sqliteDialect) DropTable(t *DbTable) []string {
+	return []string{"DROP TABLE " + quoteIdent(t.Name)}
+}
+
+func (p sqliteDialect) AddColumn(t *DbTable, c *DbColumn) []string {
+	return []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", quoteIdent(t.Name), p.columnDef(c, false, true))}
+}
+
+func (p sqliteDialect) DropColumn(t *DbTable, c *DbColumn) []string {
+	return []string{fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", quoteIdent(t.Name), quoteIdent(c.Name))}
+}
+
+// ModifyColumn sqlite 不支持修改列, 映射到 sqlite 后定义相同的修改(如 int32 -> int64)不需要语句,
+// 其它修改返回错误, 避免快照和数据库不一致
+func (p sqliteDialect) ModifyColumn(t *DbTable, old, c *DbColumn) ([]string, error) {
+	if p.columnDef(old, false, false) == p.columnDef(c, false, false) && old.AutoIncr == c.AutoIncr {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("sqlite can not modify column %s, write the migration by hand (create a new table, copy the data and rename it)", c.Name)
+}
+
+func (p sqliteDialect) CreateIndex(t *DbTable, x *DbIndex) []string {
+	return []string{createIndexSql(t, x)}
+}
+
+func (p sqliteDialect) DropIndex(t *DbTable, x *DbIndex) []string {
+	return []string{"DROP INDEX " + quoteIdent(x.Name)}
+}
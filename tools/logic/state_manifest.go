@@ -0,0 +1,241 @@
+package logic
+
+import (
+	"brick/log"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 状态存储后端
+const (
+	StateDb       = "db"
+	StateRedis    = "redis"
+	StateObjCache = "obj_cache"
+)
+
+// 每种后端生成的文件, 删除后端时一起删除
+var stateBackendFiles = map[string][]string{
+	StateDb:       {"logic_state_db", "logic_state_db_repo", "logic_state_db_test", "logic_state_db_driver"},
+	StateRedis:    {"logic_state_redis", "logic_state_redis_cache"},
+	StateObjCache: {"logic_state_obj_cache", "logic_state_obj_cache_repo", "logic_state_obj_cache_test"},
+}
+
+type StateBackend struct {
+	Conf   string `json:"conf"`
+	Driver string `json:"driver,omitempty"`
+}
+
+// StateManifest 记录服务选择的状态后端, 保存在 impl/<svr>_state.json,
+// GenAll 只重新生成记录中的后端, 并使用记录的配置
+type StateManifest struct {
+	Backends map[string]*StateBackend `json:"backends"`
+
+	fn string
+}
+
+func stateManifestFileName(PD *ProtoDetect, rootDir string) string {
+	return filepath.Join(rootDir, "impl", PD.SvrName+"_state.json")
+}
+
+// LoadStateManifest 读取状态记录, 还没有记录时按已经生成的文件推断,
+// 新项目什么都没有生成过时使用默认的全部后端
+func LoadStateManifest(PD *ProtoDetect, rootDir string) (*StateManifest, error) {
+	p := &StateManifest{Backends: make(map[string]*StateBackend), fn: stateManifestFileName(PD, rootDir)}
+
+	if !FileExists(p.fn) {
+		for name, list := range stateBackendFiles {
+			if FileExists(GetTargetFileName(*PD, list[0], rootDir)) {
+				log.Infof("found state %s generated before, record it in %s", name, p.fn)
+				p.Backends[name] = &StateBackend{}
+			}
+		}
+		if len(p.Backends) == 0 {
+			for name := range stateBackendFiles {
+				p.Backends[name] = &StateBackend{}
+			}
+			log.Infof("new service, use default state %s, remove unused ones with State -rm",
+				strings.Join(p.Names(), ", "))
+		}
+		return p, nil
+	}
+
+	b, err := ioutil.ReadFile(p.fn)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, p)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s err %v", p.fn, err)
+	}
+	if p.Backends == nil {
+		p.Backends = make(map[string]*StateBackend)
+	}
+	for name := range p.Backends {
+		if stateBackendFiles[name] == nil {
+			return nil, fmt.Errorf("unknown state %s in %s", name, p.fn)
+		}
+	}
+	return p, nil
+}
+
+func (p *StateManifest) Get(name string) *StateBackend {
+	return p.Backends[name]
+}
+
+// Set 记录后端的选择, conf 为空时保留原来的配置
+func (p *StateManifest) Set(name string, b *StateBackend) {
+	if old := p.Backends[name]; old != nil {
+		if b.Conf == "" {
+			b.Conf = old.Conf
+		}
+		if b.Driver == "" {
+			b.Driver = old.Driver
+		}
+	}
+	p.Backends[name] = b
+}
+
+func (p *StateManifest) Names() []string {
+	var list []string
+	for name := range p.Backends {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (p *StateManifest) Save() error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.fn, append(b, '\n'), 0644)
+}
+
+// StateFiles 返回后端已经生成的文件
+func StateFiles(PD *ProtoDetect, rootDir string, name string) []string {
+	var list []string
+	for _, objType := range stateBackendFiles[name] {
+		if fn := GetTargetFileName(*PD, objType, rootDir); FileExists(fn) {
+			list = append(list, fn)
+		}
+	}
+	return list
+}
+
+// RemoveStateBackend 删除后端生成的文件和记录, 以及 server/<svr>.toml 中 conf 对应的表,
+// 其它表中引用 conf 的行只提示, 由用户确认后删除
+func RemoveStateBackend(PD *ProtoDetect, rootDir string, p *StateManifest, name string) error {
+	if stateBackendFiles[name] == nil {
+		return fmt.Errorf("unknown state %s, should be one of %s, %s, %s", name, StateDb, StateRedis, StateObjCache)
+	}
+	b := p.Backends[name]
+	if b == nil {
+		return fmt.Errorf("state %s is not configured", name)
+	}
+
+	files := StateFiles(PD, rootDir, name)
+	// obj cache 包装了 db 的 repo, 删除 db 时也要删除
+	if fn := GetTargetFileName(*PD, "logic_state_obj_cache_repo", rootDir); name == StateDb && FileExists(fn) {
+		log.Warnf("obj cache of db models removed together with state db")
+		files = append(files, fn)
+		if fn := GetTargetFileName(*PD, "logic_state_obj_cache_test", rootDir); FileExists(fn) {
+			files = append(files, fn)
+		}
+	}
+	for _, fn := range files {
+		if err := os.Remove(fn); err != nil {
+			return err
+		}
+		log.Infof("remove %s", fn)
+	}
+	delete(p.Backends, name)
+
+	if b.Conf != "" && name != StateObjCache && !confShared(p, b.Conf) {
+		fn := GetTargetFileName(*PD, "conf", rootDir)
+		if err := removeConfSection(fn, confSection(b.Conf)); err != nil {
+			return err
+		}
+		warnConfRefs(fn, b.Conf)
+	}
+	return p.Save()
+}
+
+// confSection $dispatch.mysql.default 的配置在 toml 中是表 [mysql.default]
+func confSection(conf string) string {
+	return strings.TrimPrefix(conf, "$dispatch.")
+}
+
+// confShared 其它后端还在使用同一个配置时不删除
+func confShared(p *StateManifest, conf string) bool {
+	for _, b := range p.Backends {
+		if b.Conf == conf {
+			return true
+		}
+	}
+	return false
+}
+
+// tomlTableName 返回表头 [a.b] 或 [[a.b]] 中的表名, 不是表头时返回空
+func tomlTableName(line string) string {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "[") {
+		return ""
+	}
+	if i := strings.Index(line, "#"); i > 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	return strings.Trim(line, "[] ")
+}
+
+// removeConfSection 删除 toml 中的表 section 和它的子表, 其它内容保持不变
+func removeConfSection(fn string, section string) error {
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	skip, removed := false, false
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if table := tomlTableName(line); table != "" {
+			skip = table == section || strings.HasPrefix(table, section+".")
+			removed = removed || skip
+		}
+		if !skip {
+			lines = append(lines, line)
+		}
+	}
+	if !removed {
+		return nil
+	}
+
+	log.Infof("remove [%s] from %s", section, fn)
+	return ioutil.WriteFile(fn, []byte(strings.Join(lines, "")), 0644)
+}
+
+func warnConfRefs(fn string, conf string) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	// $dispatch.mysql.default 在配置中一般写作 default
+	short := conf[strings.LastIndex(conf, ".")+1:]
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		if strings.Contains(s.Text(), conf) || strings.Contains(s.Text(), short) {
+			log.Warnf("%s:%d still refers to %s: %s", fn, n, conf, strings.TrimSpace(s.Text()))
+		}
+	}
+}
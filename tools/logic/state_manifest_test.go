@@ -0,0 +1,141 @@
+package logic
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+const testStateToml = `[server]
+addr = "0.0.0.0:8080"
+
+[mysql.default]
+dsn = "root@tcp(127.0.0.1:3306)/user"
+
+[mysql.default.pool]
+max_idle = 4
+
+[redis.redis4session]
+addr = "127.0.0.1:6379"
+
+[[config.upstream]]
+name = "default"
+`
+
+func TestRemoveConfSection(t *testing.T) {
+	cases := []struct {
+		name    string
+		section string
+		want    string
+	}{
+		{
+			name:    "table with sub tables",
+			section: "mysql.default",
+			want: `[server]
+addr = "0.0.0.0:8080"
+
+[redis.redis4session]
+addr = "127.0.0.1:6379"
+
+[[config.upstream]]
+name = "default"
+`,
+		},
+		{
+			name:    "last table",
+			section: "redis.redis4session",
+			want: `[server]
+addr = "0.0.0.0:8080"
+
+[mysql.default]
+dsn = "root@tcp(127.0.0.1:3306)/user"
+
+[mysql.default.pool]
+max_idle = 4
+
+[[config.upstream]]
+name = "default"
+`,
+		},
+		{
+			name:    "prefix of another table",
+			section: "mysql.def",
+			want:    testStateToml,
+		},
+		{
+			name:    "missing",
+			section: "postgres.default",
+			want:    testStateToml,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			PD := testClientPD()
+			fn := GetTargetFileName(*PD, "conf", t.TempDir())
+			if err := ioutil.WriteFile(fn, []byte(testStateToml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := removeConfSection(fn, c.section); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(readGenerated(t, fn)); got != c.want {
+				t.Errorf("removeConfSection(%s):\n%s", c.section, lineDiff(c.want, got))
+			}
+		})
+	}
+}
+
+func TestRemoveStateBackend(t *testing.T) {
+	PD := testClientPD()
+	root := t.TempDir()
+	conf := GetTargetFileName(*PD, "conf", root)
+	if err := ioutil.WriteFile(conf, []byte(testStateToml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range stateBackendFiles[StateDb] {
+		if err := ioutil.WriteFile(GetTargetFileName(*PD, x, root), []byte("package impl\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := LoadStateManifest(PD, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := p.Names(); len(names) != 1 || names[0] != StateDb {
+		t.Fatalf("want db inferred from generated files, got %v", names)
+	}
+	p.Set(StateDb, &StateBackend{Conf: "$dispatch.mysql.default", Driver: DriverMysql})
+	p.Set(StateRedis, &StateBackend{Conf: "$dispatch.redis.redis4session"})
+
+	if err := RemoveStateBackend(PD, root, p, StateDb); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range stateBackendFiles[StateDb] {
+		if FileExists(GetTargetFileName(*PD, x, root)) {
+			t.Errorf("%s not removed", x)
+		}
+	}
+	keys, err := tomlKeys(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys["mysql.default"] || keys["mysql.default.pool"] {
+		t.Error("[mysql.default] left in conf")
+	}
+	if !keys["redis.redis4session"] || !keys["server.addr"] {
+		t.Error("other tables removed from conf")
+	}
+
+	// 记录已保存, 重新读取后只剩 redis
+	p, err = LoadStateManifest(PD, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := p.Names(); len(names) != 1 || names[0] != StateRedis {
+		t.Errorf("want only redis left, got %v", names)
+	}
+	if err := RemoveStateBackend(PD, root, p, StateDb); err == nil {
+		t.Error("removing a state not configured should fail")
+	}
+}
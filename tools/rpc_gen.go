@@ -18,6 +18,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var PD *logic.ProtoDetect
@@ -53,6 +54,10 @@ func walkPb(definition *proto.Proto, pd *logic.ProtoDetect) {
 		cmdID := 0
 		url := ""
 		flags := 0
+		timeoutMs := 0
+		idempotent := false
+		retry := 0
+		var interceptors []string
 		for _, opt := range m.Elements {
 			v := &logic.ProtoVisitor{}
 			opt.Accept(v)
@@ -65,6 +70,28 @@ func walkPb(definition *proto.Proto, pd *logic.ProtoDetect) {
 			if v.Flags > 0 {
 				flags = int(v.Flags)
 			}
+
+			if o, ok := opt.(*proto.Option); ok {
+				switch o.Name {
+				case "(ext.Timeout)":
+					timeoutMs, _ = strconv.Atoi(o.Constant.Source)
+				case "(ext.Idempotent)":
+					idempotent = o.Constant.Source == "true"
+				case "(ext.Retry)":
+					retry, _ = strconv.Atoi(o.Constant.Source)
+				case "(ext.Interceptors)":
+					for _, x := range strings.Split(o.Constant.Source, ",") {
+						if x = strings.TrimSpace(x); x != "" {
+							interceptors = append(interceptors, x)
+						}
+					}
+				}
+			}
+		}
+
+		if retry > 0 && !idempotent {
+			log.Warnf("method `%s` has Retry option but is not Idempotent, retry ignored", m.Name)
+			retry = 0
 		}
 
 		//if cmdID == 0 {
@@ -78,6 +105,11 @@ func walkPb(definition *proto.Proto, pd *logic.ProtoDetect) {
 			CmdID:      strconv.Itoa(cmdID),
 			Url:        url,
 			Flags:      strconv.Itoa(flags),
+			TimeoutMs:  timeoutMs,
+			Idempotent: idempotent,
+			Retry:      retry,
+
+			Interceptors: interceptors,
 		}
 
 		if m.Comment != nil {
@@ -90,14 +122,33 @@ func walkPb(definition *proto.Proto, pd *logic.ProtoDetect) {
 	}
 
 	handleEnum := func(e *proto.Enum) {
+		pd.EnumList = append(pd.EnumList, e)
+
 		if strings.HasSuffix(e.Name, "ErrCode") {
 			var pv logic.ProtoVisitor
 			for _, ei := range e.Elements {
 				ei.Accept(&pv)
 			}
+			for _, f := range pv.EnumFields {
+				if f.Integer < 0 {
+					log.Fatalf("%s.%s = %d, error code must not be negative", e.Name, f.Name, f.Integer)
+				}
+			}
+			if pd.ErrCodeRange != nil {
+				for _, f := range pv.EnumFields {
+					if f.Integer != 0 && !pd.ErrCodeRange.Contains(uint32(f.Integer)) {
+						log.Fatalf("%s.%s = %d out of error code range %s",
+							e.Name, f.Name, f.Integer, pd.ErrCodeRange.String())
+					}
+				}
+			}
 			pd.ErrCodes = append(
 				pd.ErrCodes,
-				logic.ErrCodeDef{ErrCodeSetName: e.Name, ErrCodeEnums: pv.EnumFields})
+				logic.ErrCodeDef{
+					ErrCodeSetName: e.Name,
+					ErrCodeEnums:   pv.EnumFields,
+					Msgs:           logic.ParseErrCodeMsgs(pv.EnumFields),
+				})
 		}
 	}
 
@@ -133,10 +184,38 @@ func walkPb(definition *proto.Proto, pd *logic.ProtoDetect) {
 	}
 
 	handleMsg := func(p *proto.Message) {
-		pbMsg := &logic.PbMsg{Name: p.Name, ModName: logic.CurrentMod}
+		pbMsg := &logic.PbMsg{
+			Name:     p.Name,
+			FullName: logic.PbMsgFullName(p),
+			ModName:  logic.CurrentMod,
+		}
+		caches, err := logic.ParseMsgCaches(p)
+		if err != nil {
+			log.Fatalf("%s: %v", pbMsg.FullName, err)
+		}
+		pbMsg.Caches = caches
 		vv := &logic.ProtoVisitor{CurMsg: pbMsg}
 		for _, v := range p.Elements {
 			v.Accept(vv)
+			if r, ok := v.(*proto.Reserved); ok {
+				pbMsg.Reserved = append(pbMsg.Reserved, r)
+			}
+			if o, ok := v.(*proto.Oneof); ok {
+				pbMsg.Oneofs = append(pbMsg.Oneofs, o)
+			}
+		}
+		for _, f := range pbMsg.Fields {
+			rules, err := logic.ParseFieldRules(f.GetOptions())
+			if err != nil {
+				log.Fatalf("%s.%s: %v", pbMsg.FullName, f.GetName(), err)
+			}
+			f.Rules = rules
+
+			db, err := logic.ParseFieldDb(f.GetOptions())
+			if err != nil {
+				log.Fatalf("%s.%s: %v", pbMsg.FullName, f.GetName(), err)
+			}
+			f.Db = db
 		}
 		pbList = append(pbList, pbMsg)
 
@@ -149,6 +228,12 @@ func walkPb(definition *proto.Proto, pd *logic.ProtoDetect) {
 		}
 	}
 
+	rg, err := logic.GetErrCodeRange(definition)
+	if err != nil {
+		log.Fatalf("%s: %v", logic.CurrentPb, err)
+	}
+	pd.ErrCodeRange = rg
+
 	proto.Walk(
 		definition,
 		proto.WithService(handleService),
@@ -198,27 +283,43 @@ func getIncludePathList(pbFilePath string) []string {
 	return incPaths
 }
 
+// pbGoPath 返回 protoc 为 svrName 生成的 pb.go 路径
+func pbGoPath(projectRoot string, pd *logic.ProtoDetect, svrName string) string {
+	outDir := utils.AdjPathSep(projectRoot + "/src")
+	if pd.GoPackageName == "" {
+		return fmt.Sprintf("%s%s%s.pb.go", outDir, sep, svrName)
+	}
+
+	n := pd.GoPackageName
+	if runtime.GOOS == "windows" {
+		n = strings.Replace(n, `/`, `\`, -1)
+	}
+	return fmt.Sprintf("%s%s%s%s%s.pb.go", outDir, sep, n, sep, svrName)
+}
+
+// loadGormTables 由 pb.go 中 gorm 注入代码生成的 TableName 确定数据库模型, pb.go 不存在时没有模型
+func loadGormTables(pbGo string, msgs []*logic.PbMsg) {
+	tables := make(map[string]string)
+	if logic.FileExists(pbGo) {
+		var err error
+		tables, err = logic.GormTables(pbGo)
+		if err != nil {
+			log.Fatalf("load gorm tables fail, err %s", err)
+		}
+	}
+	logic.SetMsgTables(msgs, tables)
+}
+
 func generateProto(projectRoot, svrName string, pbFilePath string) error {
 	var incPaths []string
 
 	incPaths = getIncludePathList(pbFilePath)
-	var outDir string
-	var outPbPath string
-
-	outDir = utils.AdjPathSep(projectRoot + "/src")
+	outDir := utils.AdjPathSep(projectRoot + "/src")
 
 	// include proto
 	target := fmt.Sprintf("--go_out=%s", outDir)
 
-	if PD.GoPackageName == "" {
-		outPbPath = fmt.Sprintf("%s%s%s.pb.go", outDir, sep, svrName)
-	} else {
-		n := PD.GoPackageName
-		if runtime.GOOS == "windows" {
-			n = strings.Replace(n, `/`, `\`, -1)
-		}
-		outPbPath = fmt.Sprintf("%s%s%s%s%s.pb.go", outDir, sep, n, sep, svrName)
-	}
+	outPbPath := pbGoPath(projectRoot, PD, svrName)
 
 	var args []string
 	for _, x := range incPaths {
@@ -251,28 +352,48 @@ func generateProto(projectRoot, svrName string, pbFilePath string) error {
 		log.Error("err:", errStr)
 	}
 
-	areas, gormMsgList, err := logic.InjectTagParseFile(outPbPath)
+	// @inject_tag 统一由 InjectFieldTags 处理, 这里只取 gorm 标记, 不再改写 tag,
+	// 否则 json 改名在冲突检查之前就已经写进了 pb.go
+	_, gormMsgList, err := logic.InjectTagParseFile(outPbPath)
 	if err != nil {
 		log.Fatalf("parse error, err %s", err)
 	}
 
-	if len(areas) > 0 {
-		err = logic.InjectTagWriteFile(outPbPath, areas)
-		if err != nil {
-			log.Fatalf("write fail, err %s", err)
-		}
-	}
-
 	if len(gormMsgList) > 0 {
 		err = logic.InjectTagWriteGormCode(outPbPath, gormMsgList)
 		if err != nil {
 			log.Fatalf("write fail, err %s", err)
 		}
 	}
+	loadGormTables(outPbPath, currentPbMsgs())
+
+	injected, err := logic.InjectFieldTags(outPbPath, currentPbMsgs())
+	if err != nil {
+		log.Fatalf("inject tag fail, err %s", err)
+	}
+	for _, x := range injected {
+		log.Infof("inject tag %s", x)
+	}
+
+	err = logic.GenerateValidate(outPbPath, currentPbMsgs())
+	if err != nil {
+		log.Fatalf("generate validate fail, err %s", err)
+	}
 
 	return nil
 }
 
+// currentPbMsgs 返回当前 proto 文件中定义的 message, 不包含 import 的
+func currentPbMsgs() []*logic.PbMsg {
+	var list []*logic.PbMsg
+	for _, m := range pbList {
+		if m.ModName == logic.CurrentMod {
+			list = append(list, m)
+		}
+	}
+	return list
+}
+
 func findProjectRoot(mod string) string {
 	abs, err := filepath.Abs(mod)
 	if err != nil {
@@ -307,6 +428,7 @@ const (
 	flagSetStateRedis    = 1 << 8
 	flagSetStateObjCache = 1 << 9
 	flagGenDoc           = 1 << 10
+	flagState            = 1 << 11
 	flagGenAll = 0xffffffff
 )
 
@@ -424,11 +546,8 @@ func genCode(flags int) {
 
 	protoFile := tools_lib.OptStr("p")
 
+	dbDriver := tools_lib.OptStrDef("driver", "")
 	dbConf := tools_lib.OptStrDef("db", "")
-	if dbConf != "" && strings.Index(dbConf, "$dispatch.mysql.") == -1 {
-		dbConf = fmt.Sprintf("$dispatch.mysql.%s", dbConf)
-	}
-
 	redisConf := tools_lib.OptStrDef("redis", "")
 	objCacheConf := tools_lib.OptStrDef("obj_cache", "")
 
@@ -442,6 +561,9 @@ func genCode(flags int) {
 	logic.SetCurrentPb(protoFile)
 
 	logic.PbIncPaths = incPaths
+	logic.PruneRemovedRpc = tools_lib.OptStrDef("prune", "") == "1"
+	logic.ForceRegion = tools_lib.OptStrDef("force", "") == "1"
+	logic.AllowDefChange = tools_lib.OptStrDef("allow_def_change", "") == "1"
 
 	PD = parsePbOrDie(protoFile)
 	if PD.GoPackageName == "" {
@@ -468,11 +590,60 @@ func genCode(flags int) {
 		log.Fatalf("make dir fail, dir %s, err %s", modPath, err)
 	}
 
+	// 没有指定时使用之前选择的状态后端配置
+	state, err := logic.LoadStateManifest(PD, modPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if flags == flagState {
+		handleState(state, modPath)
+		return
+	}
+
+	// 没有指定时重新生成已有的部署文件
+	deploy, err := logic.DeployTargets(*PD, modPath, tools_lib.OptStrDef("deploy", ""))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if b := state.Get(logic.StateDb); b != nil {
+		if dbDriver == "" {
+			dbDriver = b.Driver
+		}
+		if dbConf == "" {
+			dbConf = b.Conf
+		}
+	}
+	if dbDriver == "" {
+		dbDriver = logic.DriverMysql
+	}
+	if err := logic.CheckDbDriver(dbDriver); err != nil {
+		log.Fatal(err)
+	}
+	if dbConf != "" && !strings.HasPrefix(dbConf, "$dispatch.") {
+		dbConf = fmt.Sprintf("$dispatch.%s.%s", dbDriver, dbConf)
+	}
+	if err := logic.CheckStateDbConf(dbConf, dbDriver); err != nil {
+		log.Fatal(err)
+	}
+	if b := state.Get(logic.StateRedis); b != nil && redisConf == "" {
+		redisConf = b.Conf
+	}
+	if b := state.Get(logic.StateObjCache); b != nil && objCacheConf == "" {
+		objCacheConf = b.Conf
+	}
+
 	if (flags & flagGenPb) != 0 {
 		err = generateProto(projectRoot, PD.SvrName, protoFile)
 		if err != nil {
 			log.Fatalf("Generate proto buffer file failed,error is %v", err)
 		}
+		err = logic.GenerateModel(*PD, currentPbMsgs(), modPath)
+		if err != nil {
+			log.Fatalf("Generate model file failed,error is %v", err)
+		}
+	} else {
+		loadGormTables(pbGoPath(projectRoot, PD, PD.SvrName), currentPbMsgs())
 	}
 
 	if (flags & flagGenTypes) != 0 {
@@ -486,6 +657,14 @@ func genCode(flags int) {
 		if err != nil {
 			log.Fatalf("Generate typescript file failed,error is %v", err)
 		}
+		err = logic.GenerateTsErrCode(PD, x)
+		if err != nil {
+			log.Fatalf("Generate typescript errcode file failed,error is %v", err)
+		}
+		err = logic.GenerateTsValidate(PD, currentPbMsgs(), x)
+		if err != nil {
+			log.Fatalf("Generate typescript validate file failed,error is %v", err)
+		}
 	}
 
 	if flags == flagRegisterOss {
@@ -500,6 +679,15 @@ func genCode(flags int) {
 		if err != nil {
 			log.Fatalf("Generate logic state db file failed,error is %v", err)
 		}
+		err = logic.GenerateLogicStateDbDriver(PD, modPath, dbConf, dbDriver)
+		if err != nil {
+			log.Fatalf("Generate logic state db driver file failed,error is %v", err)
+		}
+		err = logic.GenerateLogicStateDbRepo(PD, currentPbMsgs(), modPath)
+		if err != nil {
+			log.Fatalf("Generate logic state db repo file failed,error is %v", err)
+		}
+		state.Set(logic.StateDb, &logic.StateBackend{Conf: dbConf, Driver: dbDriver})
 	}
 
 	if flags == flagSetStateRedis {
@@ -507,6 +695,11 @@ func genCode(flags int) {
 		if err != nil {
 			log.Fatalf("Generate logic state redis file failed,error is %v", err)
 		}
+		err = logic.GenerateLogicStateRedisCache(PD, currentPbMsgs(), modPath, redisConf)
+		if err != nil {
+			log.Fatalf("Generate logic state redis cache file failed,error is %v", err)
+		}
+		state.Set(logic.StateRedis, &logic.StateBackend{Conf: redisConf})
 	}
 
 	if flags == flagSetStateObjCache {
@@ -514,6 +707,18 @@ func genCode(flags int) {
 		if err != nil {
 			log.Fatalf("Generate logic state redis file failed,error is %v", err)
 		}
+		err = logic.GenerateLogicStateObjCacheRepo(PD, currentPbMsgs(), modPath, objCacheConf, false)
+		if err != nil {
+			log.Fatalf("Generate logic state obj cache repo file failed,error is %v", err)
+		}
+		state.Set(logic.StateObjCache, &logic.StateBackend{Conf: objCacheConf})
+	}
+
+	if flags == flagSetStateDb || flags == flagSetStateRedis || flags == flagSetStateObjCache {
+		err = state.Save()
+		if err != nil {
+			log.Fatalf("save state failed,error is %v", err)
+		}
 	}
 
 	if flags == flagGenDoc {
@@ -524,10 +729,26 @@ func genCode(flags int) {
 	}
 
 	if (flags & flagGenErrCode) != 0 {
+		reg, err := logic.LoadErrCodeRegistry(protoFile, incPaths)
+		if err != nil {
+			log.Fatalf("load error code registry failed, error is %v", err)
+		}
+		problems := reg.Problems()
+		for _, c := range problems {
+			log.Error(c)
+		}
+		if len(problems) > 0 {
+			log.Fatalf("found %d error code problem(s)", len(problems))
+		}
+
 		err = logic.GenerateErrCode(*PD, modPath)
 		if err != nil {
 			log.Fatalf("Generate errcode file failed,error is %v", err)
 		}
+		err = logic.GenerateErrors(*PD, modPath)
+		if err != nil {
+			log.Fatalf("Generate errors file failed,error is %v", err)
+		}
 	}
 
 	if flags == flagGenAll && len(PD.RpcList) != 0 {
@@ -552,27 +773,46 @@ func genCode(flags int) {
 		if err != nil {
 			log.Fatalf("Generate server file failed,error is %v", err)
 		}
+		err = logic.GenerateServerBootstrap(*PD, modPath)
+		if err != nil {
+			log.Fatalf("Generate server bootstrap file failed,error is %v", err)
+		}
+		err = logic.GenerateServerGrpc(*PD, modPath)
+		if err != nil {
+			log.Fatalf("Generate server grpc file failed,error is %v", err)
+		}
 
 		err = logic.GenerateConf(*PD, modPath)
 		if err != nil {
 			log.Fatalf("Generate conf file failed,error is %v", err)
 		}
-		err = logic.GenerateSupervisorConf(*PD, modPath)
+		err = logic.GenerateServerInterceptor(*PD, modPath)
 		if err != nil {
-			log.Fatalf("Generate supervisor conf file failed,error is %v", err)
+			log.Fatalf("Generate server interceptor file failed,error is %v", err)
 		}
-
-		err = logic.GenerateLogicStateDb(PD, modPath, dbConf, true)
+		err = logic.GenerateLogicConfig(PD, currentPbMsgs(), modPath)
 		if err != nil {
-			log.Fatalf("Generate logic state db file failed,error is %v", err)
+			log.Fatalf("Generate logic config file failed,error is %v", err)
 		}
-		err = logic.GenerateLogicStateRedis(PD, modPath, redisConf, true)
+		for _, x := range deploy {
+			if x == logic.DeploySupervisor {
+				err = logic.GenerateSupervisorConf(*PD, modPath)
+			} else {
+				err = logic.GenerateDeploy(*PD, modPath, x)
+			}
+			if err != nil {
+				log.Fatalf("Generate %s deploy file failed,error is %v", x, err)
+			}
+		}
+		err = logic.RemoveDeploy(*PD, modPath, deploy)
 		if err != nil {
-			log.Fatalf("Generate logic state redis file failed,error is %v", err)
+			log.Fatalf("Remove deploy file failed,error is %v", err)
 		}
-		err = logic.GenerateLogicStateObjCache(PD, modPath, objCacheConf, true)
+
+		// 只重新生成已经选择的状态后端, State -rm 删除的不会再生成
+		err = genStateBackends(state, modPath, dbConf, dbDriver, redisConf, objCacheConf)
 		if err != nil {
-			log.Fatalf("Generate logic state redis file failed,error is %v", err)
+			log.Fatal(err)
 		}
 
 		err = logic.GenerateTool(PD, modPath)
@@ -587,6 +827,57 @@ func genCode(flags int) {
 	//log.Infof("code = %d", code)
 }
 
+// genStateBackends 生成 state 中记录的状态后端并保存记录, 新项目的记录默认包含全部后端
+func genStateBackends(state *logic.StateManifest, modPath, dbConf, dbDriver, redisConf, objCacheConf string) error {
+	var err error
+	if state.Get(logic.StateDb) != nil {
+		err = logic.GenerateLogicStateDb(PD, modPath, dbConf, true)
+		if err != nil {
+			return fmt.Errorf("Generate logic state db file failed,error is %v", err)
+		}
+		err = logic.GenerateLogicStateDbDriver(PD, modPath, dbConf, dbDriver)
+		if err != nil {
+			return fmt.Errorf("Generate logic state db driver file failed,error is %v", err)
+		}
+		err = logic.GenerateLogicStateDbRepo(PD, currentPbMsgs(), modPath)
+		if err != nil {
+			return fmt.Errorf("Generate logic state db repo file failed,error is %v", err)
+		}
+	}
+	if state.Get(logic.StateRedis) != nil {
+		err = logic.GenerateLogicStateRedis(PD, modPath, redisConf, true)
+		if err != nil {
+			return fmt.Errorf("Generate logic state redis file failed,error is %v", err)
+		}
+		err = logic.GenerateLogicStateRedisCache(PD, currentPbMsgs(), modPath, redisConf)
+		if err != nil {
+			return fmt.Errorf("Generate logic state redis cache file failed,error is %v", err)
+		}
+	}
+	if state.Get(logic.StateObjCache) != nil {
+		err = logic.GenerateLogicStateObjCache(PD, modPath, objCacheConf, true)
+		if err != nil {
+			return fmt.Errorf("Generate logic state redis file failed,error is %v", err)
+		}
+		// 对象缓存包装 db 的 repo, 没有 db 时不生成
+		repoConf := objCacheConf
+		if state.Get(logic.StateDb) == nil {
+			repoConf = "0"
+		}
+		err = logic.GenerateLogicStateObjCacheRepo(PD, currentPbMsgs(), modPath, repoConf, true)
+		if err != nil {
+			return fmt.Errorf("Generate logic state obj cache repo file failed,error is %v", err)
+		}
+	}
+	if len(state.Names()) > 0 {
+		err = state.Save()
+		if err != nil {
+			return fmt.Errorf("save state failed,error is %v", err)
+		}
+	}
+	return nil
+}
+
 func init() {
 	log.SetModName("rpc_gen")
 
@@ -617,7 +908,7 @@ func NewProject() {
 	log.Info("success")
 }
 
-// usage: -p <proto file> -I <proto include path sep by ,>
+// usage: -p <proto file> -I <proto include path sep by ,> -prune <1 to delete client funcs of removed rpc> -force <1 to overwrite edited generated regions> -allow_def_change <1 to allow changing CmdID or url of existing rpc> -deploy <supervisor,systemd,docker,k8s sep by ,>
 func GenAll() {
 	genCode(flagGenAll)
 }
@@ -642,11 +933,41 @@ func RegisterOss() {
 	genCode(flagRegisterOss)
 }
 
-// usage: -p <proto file> -I <proto include path sep by ,> -db <$dispatch.mysql.default>
+// usage: -p <proto file> -I <proto include path sep by ,> -db <$dispatch.mysql.default> -driver <mysql|postgres|sqlite, default mysql>
 func SetStateDb() {
 	genCode(flagSetStateDb)
 }
 
+// usage: -p <proto file> -I <proto include path sep by ,> -rm <db, redis or obj_cache to remove>
+func State() {
+	genCode(flagState)
+}
+
+func handleState(state *logic.StateManifest, modPath string) {
+	rm := tools_lib.OptStrDef("rm", "")
+	if rm != "" {
+		err := logic.RemoveStateBackend(PD, modPath, state, rm)
+		if err != nil {
+			log.Fatalf("remove state %s failed, error is %v", rm, err)
+		}
+		log.Infof("state %s removed", rm)
+		return
+	}
+
+	names := state.Names()
+	if len(names) == 0 {
+		log.Infof("no state configured for %s", PD.SvrName)
+		return
+	}
+	for _, name := range names {
+		b := state.Get(name)
+		log.Infof("%s conf=%s driver=%s", name, b.Conf, b.Driver)
+		for _, fn := range logic.StateFiles(PD, modPath, name) {
+			log.Infof("    %s", fn)
+		}
+	}
+}
+
 // usage: -p <proto file> -I <proto include path sep by ,> -redis <redis4session>
 func SetStateRedis() {
 	genCode(flagSetStateRedis)
@@ -680,11 +1001,134 @@ func ServerProfile() {
 	log.Infof("success")
 }
 
+// usage: -p <proto file> -I <proto include path sep by ,>
+func NextErrCode() {
+	protoFile := tools_lib.OptStr("p")
+
+	logic.SetCurrentPb(protoFile)
+	reg, err := logic.LoadErrCodeRegistry(protoFile, getIncludePathList(protoFile))
+	if err != nil {
+		log.Fatalf("load error code registry failed, error is %v", err)
+	}
+
+	for _, c := range reg.Problems() {
+		log.Warn(c)
+	}
+
+	code, err := reg.NextFree(logic.CurrentMod)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if rg := reg.Ranges[logic.CurrentMod]; rg != nil {
+		log.Infof("error code range of %s is %s", logic.CurrentMod, rg.String())
+	}
+	log.Infof("next free error code of %s is %d", logic.CurrentMod, code)
+}
+
 // usage: -p <proto file> -I <proto include path sep by ,>
 func GenDoc() {
 	genCode(flagGenDoc)
 }
 
+// loadSnapshot 解析一个版本的 proto, 解析前重置全局状态, 以便同一进程中解析多个版本
+func loadSnapshot(protoFile string) *logic.ProtoSnapshot {
+	return loadSnapshotWithInc(protoFile, getIncludePathList(protoFile))
+}
+
+func loadSnapshotWithInc(protoFile string, incPaths []string) *logic.ProtoSnapshot {
+	pbImportParsed = make(map[string]bool)
+	pbList = nil
+	logic.PbMap = make(map[string]*logic.PbMsg)
+
+	logic.SetCurrentPb(protoFile)
+	logic.PbIncPaths = incPaths
+
+	mod := logic.CurrentMod
+	pd := parsePbOrDie(protoFile)
+	if pd.SvrName == "" {
+		pd.SvrName = pd.PackageName
+	}
+
+	snap := &logic.ProtoSnapshot{PD: pd}
+	for _, m := range pbList {
+		if m.ModName == mod {
+			snap.Msgs = append(snap.Msgs, m)
+		}
+	}
+	return snap
+}
+
+func reportDiff(issues []*logic.DiffIssue, strict bool) {
+	failed := 0
+	for _, v := range issues {
+		fmt.Println(v.String())
+		if v.Severity == logic.DiffError || (strict && v.Severity == logic.DiffWarn) {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		log.Errorf("found %d breaking change(s)", failed)
+		os.Exit(1)
+	}
+	log.Infof("no breaking change")
+}
+
+// usage: -new <new proto file> -old <old proto file> -against <git ref, instead of -old> -I <proto include path sep by ,> -strict <1 to fail on warnings>
+func Diff() {
+	newFile := tools_lib.OptStr("new")
+	against := tools_lib.OptStrDef("against", "")
+	strict := tools_lib.OptStrDef("strict", "") == "1"
+
+	var oldSnap *logic.ProtoSnapshot
+	if against != "" {
+		var err error
+		oldSnap, err = loadGitSnapshot(against, newFile)
+		if err != nil {
+			log.Fatalf("load %s at %s err %v", newFile, against, err)
+		}
+		if oldSnap == nil {
+			return
+		}
+	} else {
+		oldSnap = loadSnapshot(tools_lib.OptStr("old"))
+	}
+
+	newSnap := loadSnapshot(newFile)
+
+	reportDiff(logic.DiffProto(oldSnap, newSnap), strict)
+}
+
+// usage: -p <proto file> -I <proto include path sep by ,> -o <migration dir, default migrations> -v <version, unsigned integer, default current time> -driver <mysql|postgres|sqlite, default mysql> -pb <pb.go of the proto, default src/<go_package>/<svr>.pb.go>
+func GenMigration() {
+	protoFile := tools_lib.OptStr("p")
+	dir := tools_lib.OptStrDef("o", "migrations")
+	version := tools_lib.OptStrDef("v", time.Now().Format("20060102150405"))
+	driver := tools_lib.OptStrDef("driver", logic.DriverMysql)
+	pbGo := tools_lib.OptStrDef("pb", "")
+
+	snap := loadSnapshot(protoFile)
+	setMsgPtr()
+
+	if pbGo == "" {
+		projectRoot := findProjectRoot(".")
+		if projectRoot == "" {
+			log.Fatalf("not found `src` path by search up of current directory, use -pb")
+		}
+		pbGo = pbGoPath(projectRoot, snap.PD, snap.PD.SvrName)
+	}
+	if !logic.FileExists(pbGo) {
+		log.Fatalf("%s not found, generate the proto first or use -pb", pbGo)
+	}
+	loadGormTables(pbGo, snap.Msgs)
+
+	err := logic.GenerateMigration(snap.PD.SvrName, snap.Msgs, dir, driver, version)
+	if err != nil {
+		log.Fatalf("generate migration err %v", err)
+	}
+}
+
 var pbRpcTmpl = `
 
 	// @desc:
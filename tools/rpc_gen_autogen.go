@@ -32,6 +32,10 @@ func wrapperSetStateDb() {
 	SetStateDb()
 }
 
+func wrapperState() {
+	State()
+}
+
 func wrapperSetStateRedis() {
 	SetStateRedis()
 }
@@ -52,18 +56,34 @@ func wrapperAddRpc() {
 	AddRpc()
 }
 
+func wrapperNextErrCode() {
+	NextErrCode()
+}
+
+func wrapperDiff() {
+	Diff()
+}
+
+func wrapperGenMigration() {
+	GenMigration()
+}
+
 func main() {
 	tools_lib.Register("NewProject", `-r <project root>`, wrapperNewProject)
-	tools_lib.Register("GenAll", `-p <proto file> -I <proto include path sep by ,>`, wrapperGenAll)
+	tools_lib.Register("GenAll", `-p <proto file> -I <proto include path sep by ,> -prune <1 to delete client funcs of removed rpc> -force <1 to overwrite edited generated regions> -allow_def_change <1 to allow changing CmdID or url of existing rpc> -deploy <supervisor,systemd,docker,k8s sep by ,>`, wrapperGenAll)
 	tools_lib.Register("Proto2Go", `-p <proto file> -I <proto include path sep by ,>`, wrapperProto2Go)
 	tools_lib.Register("Proto2ErrCode", `-p <proto file> -I <proto include path sep by ,>`, wrapperProto2ErrCode)
 	tools_lib.Register("Proto2Types", `-p <proto file> -I <proto include path sep by ,>`, wrapperProto2Types)
 	tools_lib.Register("RegisterOss", `-p <proto file> -I <proto include path sep by ,>`, wrapperRegisterOss)
-	tools_lib.Register("SetStateDb", `-p <proto file> -I <proto include path sep by ,> -db <$dispatch.mysql.default>`, wrapperSetStateDb)
+	tools_lib.Register("SetStateDb", `-p <proto file> -I <proto include path sep by ,> -db <$dispatch.mysql.default> -driver <mysql|postgres|sqlite, default mysql>`, wrapperSetStateDb)
+	tools_lib.Register("State", `-p <proto file> -I <proto include path sep by ,> -rm <db, redis or obj_cache to remove>`, wrapperState)
 	tools_lib.Register("SetStateRedis", `-p <proto file> -I <proto include path sep by ,> -redis <redis4session>`, wrapperSetStateRedis)
 	tools_lib.Register("SetStateObjCache", `-p <proto file> -I <proto include path sep by ,> -obj_cache <1>`, wrapperSetStateObjCache)
 	tools_lib.Register("ServerProfile", `-s <server name> -a <address> -x <start or stop>`, wrapperServerProfile)
 	tools_lib.Register("GenDoc", `-p <proto file> -I <proto include path sep by ,>`, wrapperGenDoc)
 	tools_lib.Register("AddRpc", `-p <proto file> -r <rpc name> -l <list option, sep by ,>`, wrapperAddRpc)
+	tools_lib.Register("NextErrCode", `-p <proto file> -I <proto include path sep by ,>`, wrapperNextErrCode)
+	tools_lib.Register("Diff", `-new <new proto file> -old <old proto file> -against <git ref, instead of -old> -I <proto include path sep by ,> -strict <1 to fail on warnings>`, wrapperDiff)
+	tools_lib.Register("GenMigration", `-p <proto file> -I <proto include path sep by ,> -o <migration dir, default migrations> -v <version, unsigned integer, default current time> -driver <mysql|postgres|sqlite, default mysql> -pb <pb.go of the proto, default src/<go_package>/<svr>.pb.go>`, wrapperGenMigration)
 	tools_lib.Run()
 }
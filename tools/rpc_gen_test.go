@@ -0,0 +1,56 @@
+package main
+
+import (
+	"brick/tools/rpc_gen/logic"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 新项目没有状态记录也没有生成过状态文件时, GenAll 生成默认的全部后端并记录下来
+func TestGenStateBackendsNewProject(t *testing.T) {
+	root := t.TempDir()
+	PD = logic.NewProtoDetect()
+	PD.PackageName = "shop"
+	PD.SvrName = "shop"
+	PD.GoPackageName = "shop"
+	defer func() { PD = nil }()
+
+	driver := logic.GetTargetFileName(*PD, "logic_state_db_driver", root)
+	if err := os.MkdirAll(filepath.Dir(driver), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := logic.LoadStateManifest(PD, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = genStateBackends(state, root, "", logic.DriverMysql, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !logic.FileExists(driver) {
+		t.Error("db driver not generated for a new project")
+	}
+
+	// 记录已保存, 再次生成时使用记录而不是默认值
+	state, err = logic.LoadStateManifest(PD, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{logic.StateDb, logic.StateObjCache, logic.StateRedis}
+	if got := state.Names(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got state %v, want %v", got, want)
+	}
+	if err := logic.RemoveStateBackend(PD, root, state, logic.StateRedis); err != nil {
+		t.Fatal(err)
+	}
+	state, err = logic.LoadStateManifest(PD, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Names(); len(got) != 2 || state.Get(logic.StateRedis) != nil {
+		t.Errorf("removed state came back: %v", got)
+	}
+}